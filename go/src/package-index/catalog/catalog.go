@@ -0,0 +1,136 @@
+// Package catalog holds the packages that are available to be indexed and
+// their dependencies, as opposed to the ones that are indexed, and plans the
+// INDEX messages that install a package.
+package catalog
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+// Catalog maps each available package to its dependencies. It is immutable
+// once loaded, so it is safe for concurrent use.
+type Catalog struct {
+	deps map[string][]string
+}
+
+var errNotInCatalog = errors.New("package is not in the catalog")
+
+// Parse reads a catalog in the format of the test suite's
+// brew-dependencies.txt: a line per package, holding its name, a colon and
+// its dependencies, separated by spaces.
+//
+//	abcl: readline  rlwrap
+//	readline:
+//
+// A dependency that has no line of its own is taken to have no
+// dependencies. Blank lines are ignored.
+func Parse(r io.Reader) (*Catalog, error) {
+	c := &Catalog{deps: make(map[string][]string)}
+	s := bufio.NewScanner(r)
+	for n := 1; s.Scan(); n++ {
+		line := strings.TrimSpace(s.Text())
+		if line == "" {
+			continue
+		}
+		k := strings.IndexByte(line, ':')
+		if k <= 0 || strings.ContainsAny(line[:k], " \t") {
+			return nil, fmt.Errorf("Parse: line %d: expected \"<package>: <dependency>...\"", n)
+		}
+		pkg := line[:k]
+		deps := strings.Fields(line[k+1:])
+		c.deps[pkg] = deps
+		for _, d := range deps {
+			if _, ok := c.deps[d]; !ok {
+				c.deps[d] = nil
+			}
+		}
+	}
+	if err := s.Err(); err != nil {
+		return nil, fmt.Errorf("Parse: %v", err)
+	}
+	return c, nil
+}
+
+// Load reads the catalog in the file at path; see Parse.
+func Load(path string) (*Catalog, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("Load: %v", err)
+	}
+	defer f.Close()
+	return Parse(f)
+}
+
+// Len returns the number of packages in the catalog.
+func (c *Catalog) Len() int {
+	return len(c.deps)
+}
+
+// Deps returns the direct dependencies of pkg. Returns false if pkg is not
+// in the catalog.
+func (c *Catalog) Deps(pkg string) ([]string, bool) {
+	deps, ok := c.deps[pkg]
+	return deps, ok
+}
+
+// Plan returns the packages that have to be indexed, in order, for pkg to be
+// indexed: pkg itself and its transitive dependencies, less those for which
+// indexed returns true, each after all of its dependencies. The dependencies
+// of an indexed package are assumed to be indexed too, so they are not
+// examined. Plan fails if pkg is not in the catalog, or if the catalog has a
+// dependency cycle through it, which no order can satisfy.
+//
+// It costs O(n + e) calls of indexed for the n packages and e dependencies
+// it examines.
+func (c *Catalog) Plan(pkg string, indexed func(pkg string) bool) ([]string, error) {
+	if _, ok := c.deps[pkg]; !ok {
+		return nil, errNotInCatalog
+	}
+	// Iterative post-order DFS, so that a long chain cannot overflow the
+	// stack. A package is on the stack from when it is first seen until
+	// all of its dependencies have been planned.
+	type frame struct {
+		pkg  string
+		deps []string
+	}
+	const (
+		onStack = 1
+		done    = 2
+	)
+	var plan []string
+	state := make(map[string]int)
+	if indexed(pkg) {
+		return nil, nil
+	}
+	state[pkg] = onStack
+	stack := []frame{{pkg, c.deps[pkg]}}
+	for len(stack) > 0 {
+		top := &stack[len(stack)-1]
+		if len(top.deps) == 0 {
+			plan = append(plan, top.pkg)
+			state[top.pkg] = done
+			stack = stack[:len(stack)-1]
+			continue
+		}
+		d := top.deps[0]
+		top.deps = top.deps[1:]
+		switch state[d] {
+		case onStack:
+			return nil, fmt.Errorf("dependency cycle through %q and %q", top.pkg, d)
+		case done:
+			continue
+		}
+		if indexed(d) {
+			state[d] = done
+			continue
+		}
+		state[d] = onStack
+		stack = append(stack, frame{d, c.deps[d]})
+	}
+	return plan, nil
+}
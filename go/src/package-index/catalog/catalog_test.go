@@ -0,0 +1,101 @@
+package catalog
+
+import (
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func mustParse(t *testing.T, s string) *Catalog {
+	c, err := Parse(strings.NewReader(s))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+func TestParse(t *testing.T) {
+	c := mustParse(t, "abcl: readline  rlwrap\n\nreadline:\nrlwrap: readline\n")
+	if c.Len() != 3 {
+		t.Fatalf("Len() = %d, want 3", c.Len())
+	}
+	if deps, ok := c.Deps("abcl"); !ok || !reflect.DeepEqual(deps, []string{"readline", "rlwrap"}) {
+		t.Fatalf("Deps(abcl) = %v, %v", deps, ok)
+	}
+	if deps, ok := c.Deps("readline"); !ok || len(deps) != 0 {
+		t.Fatalf("Deps(readline) = %v, %v", deps, ok)
+	}
+	// A dependency without a line of its own has no dependencies.
+	c = mustParse(t, "a: b\n")
+	if deps, ok := c.Deps("b"); !ok || len(deps) != 0 {
+		t.Fatalf("Deps(b) = %v, %v", deps, ok)
+	}
+	if _, ok := c.Deps("z"); ok {
+		t.Fatal("Deps(z) found a package not in the catalog")
+	}
+	for _, s := range []string{"a b\n", ": b\n", "a b: c\n"} {
+		if _, err := Parse(strings.NewReader(s)); err == nil {
+			t.Errorf("Parse(%q) succeeded", s)
+		}
+	}
+}
+
+func TestPlan(t *testing.T) {
+	c := mustParse(t, "a: b c\nb: c d\nc: d\ne: f\nf: g\ng: e\nh: e\n")
+	indexed := map[string]bool{}
+	query := func(pkg string) bool { return indexed[pkg] }
+	for _, test := range []struct {
+		pkg     string
+		indexed []string
+		want    []string
+	}{
+		{"d", nil, []string{"d"}},
+		{"a", nil, []string{"d", "c", "b", "a"}},
+		{"a", []string{"d"}, []string{"c", "b", "a"}},
+		// The dependencies of an indexed package are not examined.
+		{"a", []string{"b"}, []string{"d", "c", "a"}},
+		{"a", []string{"a"}, nil},
+	} {
+		indexed = map[string]bool{}
+		for _, p := range test.indexed {
+			indexed[p] = true
+		}
+		got, err := c.Plan(test.pkg, query)
+		if err != nil {
+			t.Fatalf("Plan(%s) with %v indexed: %v", test.pkg, test.indexed, err)
+		}
+		if !reflect.DeepEqual(got, test.want) {
+			t.Fatalf("Plan(%s) with %v indexed = %v, want %v", test.pkg, test.indexed, got, test.want)
+		}
+	}
+	indexed = map[string]bool{}
+	for _, pkg := range []string{"e", "h", "z"} {
+		if plan, err := c.Plan(pkg, query); err == nil {
+			t.Errorf("Plan(%s) = %v, want an error", pkg, plan)
+		}
+	}
+	// A cycle that has been indexed anyway is not in the way.
+	indexed["f"] = true
+	if plan, err := c.Plan("h", query); err != nil || !reflect.DeepEqual(plan, []string{"e", "h"}) {
+		t.Fatalf("Plan(h) = %v, %v", plan, err)
+	}
+}
+
+// TestPlanLongChain checks that Plan does not recurse once per package.
+func TestPlanLongChain(t *testing.T) {
+	const n = 100000
+	c := &Catalog{deps: make(map[string][]string, n)}
+	name := strconv.Itoa
+	for k := 0; k < n-1; k++ {
+		c.deps[name(k)] = []string{name(k + 1)}
+	}
+	c.deps[name(n-1)] = nil
+	plan, err := c.Plan(name(0), func(string) bool { return false })
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(plan) != n || plan[0] != name(n-1) || plan[n-1] != name(0) {
+		t.Fatalf("Plan() returned %d packages, from %q to %q", len(plan), plan[0], plan[len(plan)-1])
+	}
+}
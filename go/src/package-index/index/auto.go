@@ -0,0 +1,116 @@
+package index
+
+// AutoRemover is implemented by indexes that record why each package was
+// indexed, so that, like apt's autoremove, packages that were only indexed
+// as dependencies can be collected once nothing depends on them.
+type AutoRemover interface {
+	// IndexAuto is Index for a package that is only wanted as a dependency
+	// of another: if it indexes pkg, pkg is marked auto-installed. A package
+	// that is already indexed keeps its mark. Conversely, Index marks an
+	// auto-installed package as explicitly installed.
+	IndexAuto(pkg string, deps map[string]struct{}) (ok bool)
+	// MarkAuto sets (auto) or clears the auto-installed mark of pkg. Returns
+	// false if pkg isn't indexed.
+	MarkAuto(pkg string, auto bool) (ok bool)
+	// Auto reports whether pkg is marked auto-installed. Returns false for
+	// ok if pkg isn't indexed.
+	Auto(pkg string) (auto, ok bool)
+	// AutoRemove removes every auto-installed package that nothing depends
+	// on and is not held, then those that this leaves unreferenced, and so
+	// on, atomically with respect to other mutations. Returns the removed
+	// packages in the order they were removed (dependents first).
+	AutoRemove() (removed []string)
+}
+
+// IndexAuto implements AutoRemover.
+func (i *index) IndexAuto(pkg string, deps map[string]struct{}) bool {
+	i.l.Lock()
+	defer i.l.Unlock()
+	ok := i.indexAs(pkg, deps, entry{auto: true})
+	i.commit()
+	return ok
+}
+
+// MarkAuto implements AutoRemover.
+func (i *index) MarkAuto(pkg string, auto bool) bool {
+	i.l.Lock()
+	defer i.l.Unlock()
+	p, ok := i.find(pkg)
+	if !ok {
+		return false
+	}
+	i.mark(p, auto)
+	i.commit()
+	return true
+}
+
+// Auto implements AutoRemover.
+func (i *index) Auto(pkg string) (auto, ok bool) {
+	i.l.RLock()
+	defer i.l.RUnlock()
+	p, ok := i.find(pkg)
+	if !ok {
+		return false, false
+	}
+	return i.m[p].auto, true
+}
+
+// AutoRemove implements AutoRemover in O(n + e) for the n packages indexed
+// and the e edges of those removed.
+func (i *index) AutoRemove() []string {
+	i.l.Lock()
+	defer i.l.Unlock()
+	var orphans, removed []string
+	for pkg, e := range i.m {
+		if e.auto && e.refCount == 0 && !e.held {
+			orphans = append(orphans, pkg)
+		}
+	}
+	for len(orphans) > 0 {
+		pkg := orphans[len(orphans)-1]
+		orphans = orphans[:len(orphans)-1]
+		e := i.m[pkg]
+		i.delete(pkg, e)
+		removed = append(removed, pkg)
+		for _, id := range e.deps {
+			d := i.names.name(id)
+			if de := i.m[d]; de.auto && de.refCount == 0 && !de.held {
+				orphans = append(orphans, d)
+			}
+		}
+	}
+	i.commit()
+	return removed
+}
+
+// find returns the indexed package that pkg refers to, which for a bare name
+// must be the only indexed version. The caller must hold the lock.
+func (i *index) find(pkg string) (string, bool) {
+	if _, ok := i.m[pkg]; ok {
+		return pkg, true
+	}
+	matches := i.lookup(pkg)
+	if len(matches) != 1 {
+		return "", false
+	}
+	return matches[0], true
+}
+
+// mark sets the auto-installed mark of pkg, which must be indexed. The caller
+// must hold the write lock.
+func (i *index) mark(pkg string, auto bool) {
+	e := i.m[pkg]
+	if e.auto == auto {
+		return
+	}
+	i.remember(pkg)
+	if i.journal != nil {
+		*i.journal = append(*i.journal, change{pkg: pkg, marked: true, e: e})
+	}
+	e.auto = auto
+	i.m[pkg] = e
+	i.record(Updated, pkg)
+	if i.wal != nil {
+		i.wal.mark(pkg, e)
+	}
+}
@@ -0,0 +1,83 @@
+package index
+
+import (
+	"os"
+	"reflect"
+	"sort"
+	"testing"
+)
+
+func TestAutoRemove(t *testing.T) {
+	i := newIndex()
+	// app -> lib -> base, app -> tool; lib, base and tool are auto.
+	i.IndexAuto("base", nil)
+	i.IndexAuto("lib", map[string]struct{}{"base": struct{}{}})
+	i.IndexAuto("tool", nil)
+	i.Index("app", map[string]struct{}{"lib": struct{}{}, "tool": struct{}{}})
+	// Explicitly indexing tool clears its mark; auto-indexing app again does
+	// not set one.
+	i.Index("tool", nil)
+	i.IndexAuto("app", nil)
+	if auto, _ := i.Auto("tool"); auto {
+		t.Fatal("Index did not clear the auto mark of tool")
+	}
+	if auto, _ := i.Auto("app"); auto {
+		t.Fatal("IndexAuto marked an explicitly indexed package")
+	}
+	if removed := i.AutoRemove(); len(removed) != 0 {
+		t.Fatalf("AutoRemove() removed %v while everything is referenced", removed)
+	}
+	i.Remove("app")
+	if removed := i.AutoRemove(); !reflect.DeepEqual(removed, []string{"lib", "base"}) {
+		t.Fatalf("AutoRemove() = %v, want [lib base]", removed)
+	}
+	if !i.Query("tool") {
+		t.Fatal("AutoRemove removed an explicitly indexed package")
+	}
+	if !i.MarkAuto("tool", true) || i.MarkAuto("app", true) {
+		t.Fatal("MarkAuto reported the wrong packages as indexed")
+	}
+	if removed := i.AutoRemove(); !reflect.DeepEqual(removed, []string{"tool"}) {
+		t.Fatalf("AutoRemove() = %v, want [tool]", removed)
+	}
+}
+
+func TestAutoBatch(t *testing.T) {
+	i := newIndex()
+	i.IndexAuto("A", nil)
+	// A failed batch restores the mark it cleared.
+	i.Batch([]Op{{Package: "A"}, {Package: "B", Dependencies: map[string]struct{}{"C": struct{}{}}}})
+	if auto, _ := i.Auto("A"); !auto {
+		t.Fatal("failed batch cleared the auto mark of A")
+	}
+	i.Batch([]Op{{Package: "B", Auto: true}})
+	if removed := i.AutoRemove(); len(removed) != 2 {
+		t.Fatalf("AutoRemove() = %v, want A and B", removed)
+	}
+}
+
+func TestAutoDurable(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	d := mustOpen(t, dir)
+	a := d.(AutoRemover)
+	a.IndexAuto("A", nil)
+	a.IndexAuto("B", nil)
+	a.IndexAuto("C", nil)
+	a.MarkAuto("C", false)
+	if err := d.Checkpoint(); err != nil {
+		t.Fatal(err)
+	}
+	a.MarkAuto("B", false)
+	a.IndexAuto("D", nil)
+	if err := d.Close(); err != nil {
+		t.Fatal(err)
+	}
+	d = mustOpen(t, dir)
+	defer d.Close()
+	removed := d.(AutoRemover).AutoRemove()
+	sort.Strings(removed)
+	if !reflect.DeepEqual(removed, []string{"A", "D"}) {
+		t.Fatalf("AutoRemove() after reopen = %v, want [A D]", removed)
+	}
+}
@@ -0,0 +1,54 @@
+package index
+
+// Op is a single mutation within a batch.
+type Op struct {
+	// Remove selects REMOVE semantics; otherwise the op is an INDEX.
+	Remove bool
+	// Auto makes an INDEX mark the package auto-installed, as IndexAuto
+	// does.
+	Auto         bool
+	Package      string
+	Dependencies map[string]struct{}
+	// Conflicts are the conflicts an INDEX declares, as IndexConflicting
+	// does.
+	Conflicts map[string]struct{}
+}
+
+// Batcher is implemented by indexes that can apply several mutations
+// atomically.
+type Batcher interface {
+	// Batch applies ops in order as a single atomic mutation. Each op sees
+	// the effects of the ops before it, so a batch may index a package
+	// together with its dependencies, provided the dependencies come first.
+	// Returns true if every op would have returned true had it been sent on
+	// its own in that order; otherwise the index is left unchanged and
+	// Batch returns false.
+	Batch(ops []Op) (ok bool)
+}
+
+// Batch implements Batcher. It applies ops one by one and, if one fails,
+// undoes the ones before it, so the cost of a failed batch is at most twice
+// that of a successful one.
+func (i *index) Batch(ops []Op) bool {
+	i.l.Lock()
+	defer i.l.Unlock()
+	var journal []change
+	i.journal = &journal
+	defer func() { i.journal = nil }()
+	for _, op := range ops {
+		var ok bool
+		if op.Remove {
+			ok = i.remove(op.Package)
+		} else {
+			ok = i.indexAs(op.Package, op.Dependencies, entry{auto: op.Auto, conflicts: op.Conflicts})
+		}
+		if !ok {
+			i.journal = nil
+			i.undo(journal)
+			i.abort()
+			return false
+		}
+	}
+	i.commit()
+	return true
+}
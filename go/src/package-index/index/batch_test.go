@@ -0,0 +1,58 @@
+package index
+
+import (
+	"os"
+	"testing"
+)
+
+func TestBatch(t *testing.T) {
+	i := newIndex()
+	b := map[string]struct{}{"B": struct{}{}}
+	// Intra-batch dependencies are satisfied.
+	if !i.Batch([]Op{{Package: "B"}, {Package: "A", Dependencies: b}}) {
+		t.Fatal("batch indexing A and its dep B failed")
+	}
+	if !i.Query("A") || !i.Query("B") {
+		t.Fatal("A or B missing after batch")
+	}
+	// A failure part way through leaves the index unchanged.
+	if i.Batch([]Op{
+		{Remove: true, Package: "A"},
+		{Package: "C"},
+		{Package: "D", Dependencies: map[string]struct{}{"E": struct{}{}}},
+	}) {
+		t.Fatal("batch with missing dep succeeded")
+	}
+	if !i.Query("A") || i.Query("C") || i.Query("D") {
+		t.Fatal("failed batch was partially applied")
+	}
+	if i.Remove("B") {
+		t.Fatal("remove B succeeded after failed batch (A depends on it)")
+	}
+	if i.Batch([]Op{{Remove: true, Package: "B"}, {Remove: true, Package: "A"}}) {
+		t.Fatal("batch removing B before A succeeded")
+	}
+	if !i.Batch([]Op{{Remove: true, Package: "A"}, {Remove: true, Package: "B"}}) {
+		t.Fatal("batch removing A before B failed")
+	}
+	if i.Query("A") || i.Query("B") {
+		t.Fatal("A or B present after batch remove")
+	}
+}
+
+func TestBatchDurable(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	i := mustOpen(t, dir)
+	i.(Batcher).Batch([]Op{{Package: "B"}, {Package: "A", Dependencies: map[string]struct{}{"B": struct{}{}}}})
+	// A failed batch must not leave anything behind in the log.
+	i.(Batcher).Batch([]Op{{Package: "C"}, {Package: "D", Dependencies: map[string]struct{}{"E": struct{}{}}}})
+	if err := i.Close(); err != nil {
+		t.Fatal(err)
+	}
+	i = mustOpen(t, dir)
+	defer i.Close()
+	if !i.Query("A") || !i.Query("B") || i.Query("C") {
+		t.Fatal("batches replayed incorrectly")
+	}
+}
@@ -0,0 +1,79 @@
+package index
+
+// Conditional is implemented by indexes that support optimistic concurrency
+// control: each package carries the revision at which it was last modified
+// (see revision.go), and a mutation can be made conditional on it being
+// unchanged. A package that isn't indexed has revision 0, so a conditional
+// INDEX with expected revision 0 indexes a package only if nobody else has.
+type Conditional interface {
+	// ModRevision returns the revision at which pkg was last indexed,
+	// updated, marked, held or leased. Returns false if pkg isn't indexed.
+	ModRevision(pkg string) (rev uint64, ok bool)
+	// IndexIf, RemoveIf and UpdateIf are Index, Remove and Updater.Update,
+	// except that they change nothing and return true for conflict if the
+	// revision of pkg is not expected. A bare name must refer to a single
+	// indexed version, or to none.
+	IndexIf(pkg string, deps map[string]struct{}, expected uint64) (ok, conflict bool)
+	RemoveIf(pkg string, expected uint64) (ok, conflict bool)
+	UpdateIf(pkg string, deps map[string]struct{}, expected uint64) (ok, conflict bool)
+}
+
+// ModRevision implements Conditional.
+func (i *index) ModRevision(pkg string) (uint64, bool) {
+	i.l.RLock()
+	defer i.l.RUnlock()
+	p, ok := i.find(pkg)
+	if !ok {
+		return 0, false
+	}
+	return i.m[p].rev, true
+}
+
+// IndexIf implements Conditional.
+func (i *index) IndexIf(pkg string, deps map[string]struct{}, expected uint64) (ok, conflict bool) {
+	i.l.Lock()
+	defer i.l.Unlock()
+	if ok, conflict = i.check(pkg, expected); !ok || conflict {
+		return false, conflict
+	}
+	ok = i.index(pkg, deps)
+	i.commit()
+	return ok, false
+}
+
+// RemoveIf implements Conditional.
+func (i *index) RemoveIf(pkg string, expected uint64) (ok, conflict bool) {
+	i.l.Lock()
+	defer i.l.Unlock()
+	if ok, conflict = i.check(pkg, expected); !ok || conflict {
+		return false, conflict
+	}
+	ok = i.remove(pkg)
+	i.commit()
+	return ok, false
+}
+
+// UpdateIf implements Conditional.
+func (i *index) UpdateIf(pkg string, deps map[string]struct{}, expected uint64) (ok, conflict bool) {
+	i.l.Lock()
+	defer i.l.Unlock()
+	if ok, conflict = i.check(pkg, expected); !ok || conflict {
+		return false, conflict
+	}
+	ok = i.update(pkg, deps)
+	i.commit()
+	return ok, false
+}
+
+// check compares the revision of pkg with expected. It returns false for ok
+// if pkg is a bare name with several indexed versions, so has no revision.
+// The caller must hold the lock.
+func (i *index) check(pkg string, expected uint64) (ok, conflict bool) {
+	var rev uint64
+	if p, found := i.find(pkg); found {
+		rev = i.m[p].rev
+	} else if len(i.lookup(pkg)) > 0 {
+		return false, false
+	}
+	return true, rev != expected
+}
@@ -0,0 +1,79 @@
+package index
+
+import (
+	"os"
+	"testing"
+)
+
+func TestConditional(t *testing.T) {
+	i := newIndex()
+	if ok, conflict := i.IndexIf("B", nil, 1); ok || !conflict {
+		t.Fatalf("IndexIf(B, 1) = %v, %v, want a conflict", ok, conflict)
+	}
+	if ok, conflict := i.IndexIf("B", nil, 0); !ok || conflict {
+		t.Fatalf("IndexIf(B, 0) = %v, %v", ok, conflict)
+	}
+	if rev, ok := i.ModRevision("B"); !ok || rev != 1 {
+		t.Fatalf("ModRevision(B) = %d, %v, want 1", rev, ok)
+	}
+	i.Index("A", map[string]struct{}{"B": struct{}{}}) // 2
+	i.Index("C", nil)                                  // 3
+	// Another client got in first.
+	if ok, conflict := i.IndexIf("B", nil, 0); ok || !conflict {
+		t.Fatalf("IndexIf(B, 0) = %v, %v, want a conflict", ok, conflict)
+	}
+	// Depending on a package does not change it.
+	if rev, _ := i.ModRevision("B"); rev != 1 {
+		t.Fatalf("ModRevision(B) = %d, want 1", rev)
+	}
+	if ok, conflict := i.UpdateIf("A", map[string]struct{}{"C": struct{}{}}, 1); ok || !conflict {
+		t.Fatalf("UpdateIf(A, 1) = %v, %v, want a conflict", ok, conflict)
+	}
+	if ok, conflict := i.UpdateIf("A", map[string]struct{}{"C": struct{}{}}, 2); !ok || conflict {
+		t.Fatalf("UpdateIf(A, 2) = %v, %v", ok, conflict)
+	}
+	if rev, _ := i.ModRevision("A"); rev != 4 {
+		t.Fatalf("ModRevision(A) = %d, want 4", rev)
+	}
+	// A failed mutation is not a conflict.
+	if ok, conflict := i.RemoveIf("C", 3); ok || conflict {
+		t.Fatalf("RemoveIf(C, 3) = %v, %v, want a failure", ok, conflict)
+	}
+	if ok, conflict := i.RemoveIf("A", 2); ok || !conflict {
+		t.Fatalf("RemoveIf(A, 2) = %v, %v, want a conflict", ok, conflict)
+	}
+	if ok, conflict := i.RemoveIf("A", 4); !ok || conflict {
+		t.Fatalf("RemoveIf(A, 4) = %v, %v", ok, conflict)
+	}
+	if _, ok := i.ModRevision("A"); ok {
+		t.Fatal("ModRevision(A) found a removed package")
+	}
+	// A bare name must not be ambiguous.
+	i.Index("ssl@1.1", nil)
+	i.Index("ssl@3.0", nil)
+	if ok, conflict := i.RemoveIf("ssl", 0); ok || conflict {
+		t.Fatalf("RemoveIf(ssl, 0) = %v, %v, want a failure", ok, conflict)
+	}
+}
+
+func TestModRevisionDurable(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	d := mustOpen(t, dir)
+	d.Index("A", nil)
+	d.Index("B", nil)
+	d.(AutoRemover).MarkAuto("A", true)
+	if err := d.Checkpoint(); err != nil {
+		t.Fatal(err)
+	}
+	d.Index("C", nil)
+	d.Close()
+	d = mustOpen(t, dir)
+	defer d.Close()
+	c := d.(Conditional)
+	for pkg, want := range map[string]uint64{"A": 3, "B": 2, "C": 4} {
+		if rev, ok := c.ModRevision(pkg); !ok || rev != want {
+			t.Errorf("ModRevision(%s) = %d, %v after reopen, want %d", pkg, rev, ok, want)
+		}
+	}
+}
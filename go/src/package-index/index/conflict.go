@@ -0,0 +1,114 @@
+package index
+
+// Conflicter is implemented by indexes that let a package declare the
+// packages it cannot coexist with, like the Conflicts field of a Debian
+// package, e.g. mariadb conflicting with mysql. A conflict is a package name,
+// optionally with a version constraint as in a dependency, and is met by the
+// packages a dependency on it could resolve to: for a bare name, the
+// unversioned package and every version.
+//
+// The index never holds two packages of which one declares a conflict that
+// the other meets. An index of a package fails if it would: if an indexed
+// package meets one of the package's conflicts, or the package meets a
+// conflict that an indexed package declares. This applies to every way of
+// indexing a package. A DEFER request whose dependencies are all present
+// fails if it would conflict, and a parked one whose dependencies arrive
+// stays parked until the package it conflicts with is removed.
+type Conflicter interface {
+	// IndexConflicting is Index for a package that declares conflicts. A
+	// package that is already indexed keeps the conflicts it was indexed
+	// with.
+	IndexConflicting(pkg string, deps, conflicts map[string]struct{}) (ok bool)
+	// Conflicts returns the conflicts pkg declared, sorted. Returns false if
+	// pkg isn't indexed.
+	Conflicts(pkg string) (conflicts []string, ok bool)
+}
+
+// IndexConflicting implements Conflicter.
+func (i *index) IndexConflicting(pkg string, deps, conflicts map[string]struct{}) bool {
+	i.l.Lock()
+	defer i.l.Unlock()
+	ok := i.indexAs(pkg, deps, entry{conflicts: conflicts})
+	i.commit()
+	return ok
+}
+
+// Conflicts implements Conflicter.
+func (i *index) Conflicts(pkg string) ([]string, bool) {
+	i.l.RLock()
+	defer i.l.RUnlock()
+	p, ok := i.find(pkg)
+	if !ok {
+		return nil, false
+	}
+	return sortedKeys(i.m[p].conflicts), true
+}
+
+// conflicted reports whether indexing pkg, declaring conflicts, would
+// introduce a conflict, in O(c + k) for the c conflicts declared against
+// pkg's name and the k indexed packages with the names of its conflicts. The
+// caller must hold the lock.
+func (i *index) conflicted(pkg string, conflicts map[string]struct{}) bool {
+	for c := range conflicts {
+		name, _, _ := splitVersion(c)
+		if _, ok := i.m[name]; ok && meets(name, c) {
+			return true
+		}
+		for p := range i.versions[name] {
+			if meets(p, c) {
+				return true
+			}
+		}
+	}
+	name, _, _ := splitVersion(pkg)
+	for p := range i.conflictors[name] {
+		for c := range i.m[p].conflicts {
+			if meets(pkg, c) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// meets reports whether pkg meets the conflict c.
+func meets(pkg, c string) bool {
+	if pkg == c {
+		return true
+	}
+	name, cons, err := ParseDependency(c)
+	if err != nil {
+		return false
+	}
+	pname, v, versioned, err := ParsePackage(pkg)
+	if err != nil || pname != name {
+		return false
+	}
+	if cons == nil {
+		return true
+	}
+	return versioned && cons.Match(v)
+}
+
+// declare records that pkg, which is indexed with entry e, declares e's
+// conflicts. The caller must hold the write lock.
+func (i *index) declare(pkg string, e entry) {
+	for c := range e.conflicts {
+		name, _, _ := splitVersion(c)
+		if i.conflictors[name] == nil {
+			i.conflictors[name] = make(map[string]struct{})
+		}
+		i.conflictors[name][pkg] = struct{}{}
+	}
+}
+
+// undeclare undoes declare.
+func (i *index) undeclare(pkg string, e entry) {
+	for c := range e.conflicts {
+		name, _, _ := splitVersion(c)
+		delete(i.conflictors[name], pkg)
+		if len(i.conflictors[name]) == 0 {
+			delete(i.conflictors, name)
+		}
+	}
+}
@@ -0,0 +1,99 @@
+package index
+
+import (
+	"os"
+	"reflect"
+	"testing"
+)
+
+func TestConflicts(t *testing.T) {
+	i := newIndex()
+	i.Index("mysql@8.0", nil)
+	if i.IndexConflicting("mariadb", nil, map[string]struct{}{"mysql": struct{}{}}) {
+		t.Fatal("IndexConflicting(mariadb) succeeded while mysql@8.0 is indexed")
+	}
+	if !i.IndexConflicting("mariadb", nil, map[string]struct{}{"mysql@<8": struct{}{}}) {
+		t.Fatal("IndexConflicting(mariadb) failed with no conflicting version indexed")
+	}
+	if got, ok := i.Conflicts("mariadb"); !ok || !reflect.DeepEqual(got, []string{"mysql@<8"}) {
+		t.Fatalf("Conflicts(mariadb) = %v, %v", got, ok)
+	}
+	if _, ok := i.Conflicts("mysql@5"); ok {
+		t.Fatal("Conflicts found a package that isn't indexed")
+	}
+	// The other direction.
+	if i.Index("mysql@5.7", nil) || i.IndexAuto("mysql@5.7", nil) {
+		t.Fatal("indexed mysql@5.7, which conflicts with mariadb")
+	}
+	if i.Batch([]Op{{Package: "mysql@5.7"}}) {
+		t.Fatal("a batch indexed mysql@5.7, which conflicts with mariadb")
+	}
+	// An unversioned package does not meet a version constraint.
+	if !i.Index("mysql", nil) {
+		t.Fatal("Index(mysql) failed")
+	}
+	if i.Batch([]Op{{Package: "A", Conflicts: map[string]struct{}{"B": struct{}{}}}, {Package: "B"}}) {
+		t.Fatal("a batch indexed B after A, which conflicts with it")
+	}
+	// A parked request that would conflict stays parked.
+	i.IndexOrDefer("mysql@5.7", map[string]struct{}{"libc": struct{}{}})
+	i.Index("libc", nil)
+	if pending := i.Pending(); !reflect.DeepEqual(pending, []string{"mysql@5.7"}) {
+		t.Fatalf("Pending() = %v, want [mysql@5.7]", pending)
+	}
+	i.Remove("mariadb")
+	if len(i.conflictors) != 0 {
+		t.Fatalf("conflictors = %v after the only conflicting package was removed", i.conflictors)
+	}
+	if !i.Query("mysql@5.7") || len(i.Pending()) != 0 {
+		t.Fatal("mysql@5.7 was not promoted once mariadb was removed")
+	}
+}
+
+func TestConflictsDefer(t *testing.T) {
+	i := newIndex()
+	i.IndexConflicting("mysql", nil, map[string]struct{}{"mariadb": struct{}{}})
+	i.Index("libc", nil)
+	// Nothing is missing, so there is nothing to wait for.
+	if ok, deferred := i.IndexOrDefer("mariadb", map[string]struct{}{"libc": struct{}{}}); ok || deferred {
+		t.Fatalf("IndexOrDefer(mariadb) = %v, %v, want a failure", ok, deferred)
+	}
+	if pending := i.Pending(); len(pending) != 0 {
+		t.Fatalf("Pending() = %v, want none", pending)
+	}
+	// Parked for a missing dependency, then blocked by the conflict once it
+	// arrives, and promoted when the conflicting package goes.
+	i.IndexOrDefer("mariadb", map[string]struct{}{"libc": struct{}{}, "ssl": struct{}{}})
+	i.Index("ssl", nil)
+	if i.Query("mariadb") {
+		t.Fatal("mariadb was promoted while mysql is indexed")
+	}
+	if !i.Remove("mysql") {
+		t.Fatal("Remove(mysql) failed")
+	}
+	if !i.Query("mariadb") || len(i.Pending()) != 0 {
+		t.Fatal("mariadb was not promoted once mysql was removed")
+	}
+}
+
+func TestConflictsDurable(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	d := mustOpen(t, dir)
+	c := d.(Conflicter)
+	c.IndexConflicting("A", nil, map[string]struct{}{"B": struct{}{}})
+	if err := d.Checkpoint(); err != nil {
+		t.Fatal(err)
+	}
+	c.IndexConflicting("C", nil, map[string]struct{}{"D@1": struct{}{}, "E": struct{}{}})
+	d.Close()
+	d = mustOpen(t, dir)
+	defer d.Close()
+	c = d.(Conflicter)
+	if got, _ := c.Conflicts("C"); !reflect.DeepEqual(got, []string{"D@1", "E"}) {
+		t.Fatalf("Conflicts(C) = %v after reopen, want [D@1 E]", got)
+	}
+	if d.Index("B", nil) || d.Index("D@1.2", nil) {
+		t.Fatal("indexed a conflicting package after reopen")
+	}
+}
@@ -0,0 +1,172 @@
+package index
+
+import "sort"
+
+// Deferrer is implemented by indexes that can park an INDEX whose
+// dependencies are missing until they arrive, so that clients need not index
+// packages in dependency order.
+type Deferrer interface {
+	// IndexOrDefer indexes pkg as Index would if it can. Otherwise it parks
+	// the request and returns deferred: pkg is indexed as soon as a mutation
+	// makes all of its dependencies present, atomically with that mutation.
+	// Until then pkg is not indexed, so Query reports false and nothing can
+	// depend on it. Parking a package that is already parked replaces its
+	// dependencies. Returns false and does not park if pkg or one of deps is
+	// malformed, or if all of deps are present and pkg is refused only
+	// because it conflicts with an indexed package; see Conflicter.
+	IndexOrDefer(pkg string, deps map[string]struct{}) (ok, deferred bool)
+	// Pending returns the parked packages in lexical order.
+	Pending() []string
+	// Cancel discards the parked request for pkg. Returns false if there is
+	// none.
+	Cancel(pkg string) (ok bool)
+}
+
+// IndexOrDefer implements Deferrer.
+func (i *index) IndexOrDefer(pkg string, deps map[string]struct{}) (ok, deferred bool) {
+	if _, _, _, err := ParsePackage(pkg); err != nil {
+		return false, false
+	}
+	for d := range deps {
+		if _, _, err := ParseDependency(d); err != nil {
+			return false, false
+		}
+	}
+	i.l.Lock()
+	defer i.l.Unlock()
+	if i.index(pkg, deps) {
+		i.commit()
+		return true, false
+	}
+	if _, ok := i.resolve(deps); ok {
+		// Only a conflict stands in the way. Parking would leave the
+		// client waiting on a removal that nothing may ever make.
+		return false, false
+	}
+	parked := make(map[string]struct{}, len(deps))
+	for d := range deps {
+		parked[d] = struct{}{}
+	}
+	i.park(pkg, parked)
+	if i.wal != nil {
+		i.wal.deferIndex(pkg, deps)
+	}
+	i.commit()
+	return false, true
+}
+
+// Pending implements Deferrer.
+func (i *index) Pending() []string {
+	i.l.RLock()
+	defer i.l.RUnlock()
+	pkgs := make([]string, 0, len(i.deferred))
+	for pkg := range i.deferred {
+		pkgs = append(pkgs, pkg)
+	}
+	sort.Strings(pkgs)
+	return pkgs
+}
+
+// Cancel implements Deferrer.
+func (i *index) Cancel(pkg string) bool {
+	i.l.Lock()
+	defer i.l.Unlock()
+	if _, ok := i.deferred[pkg]; !ok {
+		return false
+	}
+	i.undefer(pkg)
+	if i.wal != nil {
+		i.wal.cancel(pkg)
+	}
+	i.commit()
+	return true
+}
+
+// park records a request to index pkg with deps once they are present. The
+// caller must hold the write lock. deps must not be modified afterwards.
+func (i *index) park(pkg string, deps map[string]struct{}) {
+	if _, ok := i.deferred[pkg]; ok {
+		i.undefer(pkg)
+	}
+	if i.deferred == nil {
+		i.deferred = make(map[string]map[string]struct{})
+		i.waiting = make(map[string]map[string]struct{})
+	}
+	i.deferred[pkg] = deps
+	// Wait on every dependency, not just the missing ones: one that is
+	// present now may be removed before the rest arrive.
+	for d := range deps {
+		name, _, _ := ParseDependency(d)
+		if i.waiting[name] == nil {
+			i.waiting[name] = make(map[string]struct{})
+		}
+		i.waiting[name][pkg] = struct{}{}
+	}
+}
+
+// undefer discards the parked request for pkg, which must exist. The caller
+// must hold the write lock.
+func (i *index) undefer(pkg string) {
+	for d := range i.deferred[pkg] {
+		name, _, _ := ParseDependency(d)
+		delete(i.waiting[name], pkg)
+		if len(i.waiting[name]) == 0 {
+			delete(i.waiting, name)
+		}
+	}
+	delete(i.deferred, pkg)
+}
+
+// promote indexes the parked packages whose dependencies have all arrived,
+// or whose conflict went with a removed package, including those unblocked
+// by other promotions. Only packages waiting on the name of an arrived
+// package, and those in unconflicted, are examined. The caller must hold the
+// write lock.
+func (i *index) promote() {
+	for len(i.unconflicted) > 0 {
+		p := i.unconflicted[len(i.unconflicted)-1]
+		i.unconflicted = i.unconflicted[:len(i.unconflicted)-1]
+		if deps, ok := i.deferred[p]; ok {
+			i.tryPromote(p, deps)
+		}
+	}
+	for len(i.arrived) > 0 {
+		pkg := i.arrived[len(i.arrived)-1]
+		i.arrived = i.arrived[:len(i.arrived)-1]
+		if _, ok := i.deferred[pkg]; ok {
+			// Indexed directly, so the parked request is moot.
+			i.undefer(pkg)
+		}
+		name, _, _ := splitVersion(pkg)
+		for p := range i.waiting[name] {
+			i.tryPromote(p, i.deferred[p])
+		}
+	}
+}
+
+// tryPromote indexes pkg, which is parked with deps, if deps resolve and
+// nothing conflicts with it. The caller must hold the write lock.
+func (i *index) tryPromote(pkg string, deps map[string]struct{}) {
+	if _, ok := i.resolve(deps); !ok || i.conflicted(pkg, nil) {
+		return
+	}
+	i.undefer(pkg)
+	// This cannot fail now that deps resolve and nothing conflicts with
+	// pkg. It appends pkg to arrived, so the packages waiting on pkg are
+	// examined in turn.
+	i.index(pkg, deps)
+}
+
+// unconflict is called when a package that declared conflicts is removed. The
+// parked packages that met one of them may now be promoted. The caller must
+// hold the write lock.
+func (i *index) unconflict(conflicts map[string]struct{}) {
+	for p := range i.deferred {
+		for c := range conflicts {
+			if meets(p, c) {
+				i.unconflicted = append(i.unconflicted, p)
+				break
+			}
+		}
+	}
+}
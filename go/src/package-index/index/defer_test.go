@@ -0,0 +1,118 @@
+package index
+
+import (
+	"os"
+	"reflect"
+	"testing"
+)
+
+func TestIndexOrDefer(t *testing.T) {
+	i := newIndex()
+	b := map[string]struct{}{"B": struct{}{}}
+	c := map[string]struct{}{"C": struct{}{}}
+	if ok, deferred := i.IndexOrDefer("A", b); ok || !deferred {
+		t.Fatalf("IndexOrDefer(A) = %v, %v, want deferred", ok, deferred)
+	}
+	if ok, deferred := i.IndexOrDefer("B", c); ok || !deferred {
+		t.Fatalf("IndexOrDefer(B) = %v, %v, want deferred", ok, deferred)
+	}
+	if i.Query("A") || i.Query("B") {
+		t.Fatal("parked package is indexed")
+	}
+	if got := i.Pending(); !reflect.DeepEqual(got, []string{"A", "B"}) {
+		t.Fatalf("Pending() = %v", got)
+	}
+	// Indexing C unblocks B, which unblocks A.
+	if !i.Index("C", nil) {
+		t.Fatal("index C failed")
+	}
+	if !i.Query("A") || !i.Query("B") {
+		t.Fatal("parked packages not promoted")
+	}
+	if len(i.Pending()) != 0 {
+		t.Fatalf("Pending() = %v after promotion", i.Pending())
+	}
+	if i.Remove("B") {
+		t.Fatal("remove B succeeded (promoted A depends on it)")
+	}
+	if ok, deferred := i.IndexOrDefer("D", c); !ok || deferred {
+		t.Fatalf("IndexOrDefer(D) = %v, %v, want ok", ok, deferred)
+	}
+}
+
+func TestIndexOrDeferVersions(t *testing.T) {
+	i := newIndex()
+	i.IndexOrDefer("curl", map[string]struct{}{"openssl@>=3": struct{}{}})
+	i.Index("openssl@1.1.1", nil)
+	if i.Query("curl") {
+		t.Fatal("curl promoted by a version that does not match")
+	}
+	i.Index("openssl@3.0.2", nil)
+	if !i.Query("curl") {
+		t.Fatal("curl not promoted by a matching version")
+	}
+	if deps, _ := i.Deps("curl"); !reflect.DeepEqual(deps, []string{"openssl@3.0.2"}) {
+		t.Fatalf("Deps(curl) = %v", deps)
+	}
+}
+
+func TestCancel(t *testing.T) {
+	i := newIndex()
+	i.IndexOrDefer("A", map[string]struct{}{"B": struct{}{}})
+	if i.Cancel("B") {
+		t.Fatal("cancel of a package that is not parked succeeded")
+	}
+	if !i.Cancel("A") {
+		t.Fatal("cancel A failed")
+	}
+	i.Index("B", nil)
+	if i.Query("A") {
+		t.Fatal("cancelled package promoted")
+	}
+}
+
+func TestDeferFailedBatch(t *testing.T) {
+	i := newIndex()
+	i.IndexOrDefer("A", map[string]struct{}{"B": struct{}{}})
+	if i.Batch([]Op{{Package: "B"}, {Package: "C", Dependencies: map[string]struct{}{"D": struct{}{}}}}) {
+		t.Fatal("batch with missing dep succeeded")
+	}
+	if i.Query("A") || len(i.Pending()) != 1 {
+		t.Fatal("failed batch promoted A")
+	}
+	if !i.Batch([]Op{{Package: "B"}}) || !i.Query("A") {
+		t.Fatal("batch did not promote A")
+	}
+}
+
+func TestDeferDurable(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	i := mustOpen(t, dir)
+	d := i.(Deferrer)
+	d.IndexOrDefer("A", map[string]struct{}{"B": struct{}{}})
+	d.IndexOrDefer("C", map[string]struct{}{"D": struct{}{}})
+	d.IndexOrDefer("E", map[string]struct{}{"F": struct{}{}})
+	d.Cancel("E")
+	i.Index("B", nil)
+	if err := i.Checkpoint(); err != nil {
+		t.Fatal(err)
+	}
+	d.IndexOrDefer("G", map[string]struct{}{"D": struct{}{}})
+	if err := i.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	i = mustOpen(t, dir)
+	defer i.Close()
+	if !i.Query("A") {
+		t.Fatal("promotion of A lost")
+	}
+	if got := i.(Deferrer).Pending(); !reflect.DeepEqual(got, []string{"C", "G"}) {
+		t.Fatalf("Pending() = %v after reopen", got)
+	}
+	i.Index("D", nil)
+	if !i.Query("C") || !i.Query("G") {
+		t.Fatal("recovered parked packages not promoted")
+	}
+}
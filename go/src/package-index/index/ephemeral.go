@@ -0,0 +1,93 @@
+package index
+
+import "log"
+
+// EphemeralIndexer is implemented by indexes that can hold packages that
+// belong to a client session, like ZooKeeper's ephemeral nodes. The session
+// removes its packages when it ends. A durable index also records which
+// packages are ephemeral: the sessions that owned them do not survive a
+// restart, so it removes them when it is reopened, leaving those that are
+// held or that other packages depend on, as a session would.
+type EphemeralIndexer interface {
+	// IndexEphemeral indexes pkg as an ephemeral package owned by owner,
+	// which must not be 0, if pkg is not already indexed. It returns
+	// conflict if it is.
+	IndexEphemeral(pkg string, deps map[string]struct{}, owner uint64) (ok, conflict bool)
+	// RemoveEphemeral removes pkg if it is an ephemeral package owned by
+	// owner. It returns disowned if it is not, because someone else has
+	// removed it, and perhaps indexed it again, since owner indexed it; held
+	// if it is held; and otherwise false if other packages depend on it.
+	RemoveEphemeral(pkg string, owner uint64) (ok, disowned, held bool)
+}
+
+// previousRun owns the ephemeral packages that a durable index keeps when it
+// is reopened; no session can own them.
+const previousRun = ^uint64(0)
+
+// IndexEphemeral implements EphemeralIndexer.
+func (i *index) IndexEphemeral(pkg string, deps map[string]struct{}, owner uint64) (ok, conflict bool) {
+	i.l.Lock()
+	defer i.l.Unlock()
+	if ok, conflict = i.check(pkg, 0); !ok || conflict {
+		return false, conflict
+	}
+	if !i.indexAs(pkg, deps, entry{owner: owner}) {
+		return false, false
+	}
+	i.commit()
+	return true, false
+}
+
+// RemoveEphemeral implements EphemeralIndexer. Ownership is a property of
+// the package rather than of its revision, so a package that its owner or
+// anyone else has since held and released, marked, renewed or updated is
+// still removed.
+func (i *index) RemoveEphemeral(pkg string, owner uint64) (ok, disowned, held bool) {
+	i.l.Lock()
+	defer i.l.Unlock()
+	p, found := i.find(pkg)
+	if !found || i.m[p].owner != owner {
+		return false, true, false
+	}
+	if i.m[p].held {
+		return false, false, true
+	}
+	ok = i.remove(p)
+	i.commit()
+	return ok, false, false
+}
+
+// dropEphemeral removes the ephemeral packages left by the sessions of a
+// previous run, dependents first, in O(n + e·d) for the e ephemeral packages
+// and the depth d of the dependencies among them. The caller must hold the
+// write lock.
+func (i *index) dropEphemeral() {
+	var left []string
+	for pkg, e := range i.m {
+		if e.owner != 0 {
+			left = append(left, pkg)
+		}
+	}
+	// Each pass removes the packages whose dependents the previous one
+	// removed.
+	for removed := true; removed; {
+		removed = false
+		kept := left[:0]
+		for _, pkg := range left {
+			if e := i.m[pkg]; e.refCount > 0 || e.held {
+				kept = append(kept, pkg)
+				continue
+			}
+			i.delete(pkg, i.m[pkg])
+			removed = true
+		}
+		left = kept
+	}
+	for _, pkg := range left {
+		if i.m[pkg].held {
+			log.Printf("index: keeping ephemeral package %q of a previous run: it is held", pkg)
+		} else {
+			log.Printf("index: keeping ephemeral package %q of a previous run: other packages depend on it", pkg)
+		}
+	}
+}
@@ -0,0 +1,84 @@
+package index
+
+import (
+	"os"
+	"testing"
+)
+
+func TestEphemeral(t *testing.T) {
+	i := newIndex()
+	i.Index("p", nil)
+	if ok, conflict := i.IndexEphemeral("p", nil, 1); ok || !conflict {
+		t.Fatalf("IndexEphemeral(p) = %v, %v for an indexed package, want a conflict", ok, conflict)
+	}
+	if ok, _ := i.IndexEphemeral("a", map[string]struct{}{"z": struct{}{}}, 1); ok {
+		t.Fatal("IndexEphemeral(a) succeeded with a missing dependency")
+	}
+	if ok, _ := i.IndexEphemeral("a", nil, 1); !ok {
+		t.Fatal("IndexEphemeral(a) failed")
+	}
+	if ok, disowned, _ := i.RemoveEphemeral("p", 1); ok || !disowned {
+		t.Fatalf("RemoveEphemeral(p) = %v, %v for a persistent package", ok, disowned)
+	}
+	if ok, disowned, _ := i.RemoveEphemeral("a", 2); ok || !disowned {
+		t.Fatalf("RemoveEphemeral(a) = %v, %v for another owner", ok, disowned)
+	}
+	i.Hold("a", true)
+	if ok, disowned, held := i.RemoveEphemeral("a", 1); ok || disowned || !held {
+		t.Fatalf("RemoveEphemeral(a) = %v, %v, %v while held", ok, disowned, held)
+	}
+	// Changes that leave the package indexed do not change its owner.
+	i.Hold("a", false)
+	i.MarkAuto("a", true)
+	if ok, disowned, held := i.RemoveEphemeral("a", 1); !ok || disowned || held {
+		t.Fatalf("RemoveEphemeral(a) = %v, %v, %v after a hold and mark", ok, disowned, held)
+	}
+	// A package removed and indexed again by another owner is theirs.
+	i.IndexEphemeral("b", nil, 1)
+	i.Remove("b")
+	i.IndexEphemeral("b", nil, 2)
+	if ok, disowned, _ := i.RemoveEphemeral("b", 1); ok || !disowned {
+		t.Fatalf("RemoveEphemeral(b) = %v, %v for its previous owner", ok, disowned)
+	}
+	i.IndexEphemeral("c", nil, 2)
+	i.Index("d", map[string]struct{}{"c": struct{}{}})
+	if ok, disowned, held := i.RemoveEphemeral("c", 2); ok || disowned || held {
+		t.Fatalf("RemoveEphemeral(c) = %v, %v, %v with a dependent", ok, disowned, held)
+	}
+	if ok, _, _ := i.RemoveEphemeral("b", 2); !ok {
+		t.Fatal("RemoveEphemeral(b) failed")
+	}
+}
+
+func TestEphemeralDurable(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	d := mustOpen(t, dir)
+	e := d.(EphemeralIndexer)
+	e.IndexEphemeral("a", nil, 1)
+	e.IndexEphemeral("b", map[string]struct{}{"a": struct{}{}}, 1)
+	e.IndexEphemeral("c", nil, 1)
+	if err := d.Checkpoint(); err != nil {
+		t.Fatal(err)
+	}
+	e.IndexEphemeral("d", map[string]struct{}{"c": struct{}{}}, 1)
+	e.IndexEphemeral("h", nil, 1)
+	d.Index("p", map[string]struct{}{"c": struct{}{}})
+	d.(Holder).Hold("h", true)
+	d.Close()
+	d = mustOpen(t, dir)
+	// The removals are logged, so they outlast a second reopen.
+	d.Close()
+	d = mustOpen(t, dir)
+	defer d.Close()
+	for _, pkg := range []string{"a", "b", "d"} {
+		if d.Query(pkg) {
+			t.Errorf("ephemeral package %s survived a reopen", pkg)
+		}
+	}
+	for _, pkg := range []string{"c", "h", "p"} {
+		if !d.Query(pkg) {
+			t.Errorf("%s was removed on reopen", pkg)
+		}
+	}
+}
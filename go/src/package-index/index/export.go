@@ -0,0 +1,71 @@
+package index
+
+import "sort"
+
+// Exporter is implemented by indexes that can dump their contents in a form
+// from which they can be rebuilt.
+type Exporter interface {
+	// Export returns an INDEX op for every indexed package, each after the
+	// ops of all of its dependencies, so that applying them in order (e.g.
+	// with Batch) to an empty index rebuilds this one. Dependencies are the
+	// exact packages they resolved to, so versioned dependencies resolve
+	// the same way again. Auto is set for auto-installed packages, and
+	// Conflicts to the conflicts a package declared. The order is
+	// deterministic: packages are visited by name.
+	Export() []Op
+}
+
+// Export implements Exporter in O((n + e) log n) for the n packages and e
+// edges of the index.
+func (i *index) Export() []Op {
+	i.l.RLock()
+	defer i.l.RUnlock()
+	ops := make([]Op, 0, len(i.m))
+	done := make(map[string]struct{}, len(i.m))
+	// Iterative post-order DFS, so that a long chain cannot overflow the
+	// stack. The graph is acyclic, so no package is met again while its
+	// frame is on the stack.
+	type frame struct {
+		pkg  string
+		deps []string
+	}
+	pkgs := make([]string, 0, len(i.m))
+	for pkg := range i.m {
+		pkgs = append(pkgs, pkg)
+	}
+	sort.Strings(pkgs)
+	for _, pkg := range pkgs {
+		if _, ok := done[pkg]; ok {
+			continue
+		}
+		done[pkg] = struct{}{}
+		stack := []frame{{pkg, i.sortedDeps(i.m[pkg])}}
+		for len(stack) > 0 {
+			top := &stack[len(stack)-1]
+			if len(top.deps) > 0 {
+				d := top.deps[0]
+				top.deps = top.deps[1:]
+				if _, ok := done[d]; !ok {
+					done[d] = struct{}{}
+					stack = append(stack, frame{d, i.sortedDeps(i.m[d])})
+				}
+				continue
+			}
+			e := i.m[top.pkg]
+			deps := make(map[string]struct{}, len(e.deps))
+			for _, d := range e.deps {
+				deps[i.names.name(d)] = struct{}{}
+			}
+			var conflicts map[string]struct{}
+			if len(e.conflicts) > 0 {
+				conflicts = make(map[string]struct{}, len(e.conflicts))
+				for c := range e.conflicts {
+					conflicts[c] = struct{}{}
+				}
+			}
+			ops = append(ops, Op{Package: top.pkg, Auto: e.auto, Dependencies: deps, Conflicts: conflicts})
+			stack = stack[:len(stack)-1]
+		}
+	}
+	return ops
+}
@@ -0,0 +1,62 @@
+package index
+
+import (
+	"fmt"
+	"math/rand"
+	"reflect"
+	"testing"
+)
+
+func TestExport(t *testing.T) {
+	i := newTestGraph(t)
+	i.IndexAuto("F", map[string]struct{}{"A": struct{}{}})
+	var order []string
+	for _, op := range i.Export() {
+		order = append(order, op.Package)
+	}
+	if want := []string{"D", "B", "C", "A", "E", "F"}; !reflect.DeepEqual(order, want) {
+		t.Fatalf("Export() order = %v, want %v", order, want)
+	}
+	if ops := newIndex().Export(); len(ops) != 0 {
+		t.Fatalf("Export() of empty index = %v", ops)
+	}
+}
+
+// TestExportReplay checks that replaying the export of a random index into an
+// empty one rebuilds it.
+func TestExportReplay(t *testing.T) {
+	i := newIndex()
+	r := rand.New(rand.NewSource(1))
+	pkg := func() string { return fmt.Sprint(r.Intn(50)) }
+	for k := 0; k < 2000; k++ {
+		deps := make(map[string]struct{})
+		for n := r.Intn(4); n > 0; n-- {
+			deps[pkg()] = struct{}{}
+		}
+		if r.Intn(3) == 0 {
+			i.Remove(pkg())
+		} else if r.Intn(2) == 0 {
+			i.IndexAuto(pkg(), deps)
+		} else {
+			i.Index(pkg(), deps)
+		}
+	}
+	i.Index("ssl@1.1", nil)
+	i.Index("ssl@1.1.5", nil)
+	i.Index("curl", map[string]struct{}{"ssl@1.1": struct{}{}})
+	i.IndexConflicting("mariadb", nil, map[string]struct{}{"mysql": struct{}{}})
+	ops := i.Export()
+	clone := newIndex()
+	if !clone.Batch(ops) {
+		t.Fatal("replaying the export failed")
+	}
+	if len(clone.m) != len(i.m) {
+		t.Fatalf("clone has %d packages, want %d", len(clone.m), len(i.m))
+	}
+	for p, e := range i.m {
+		c := clone.m[p]
+		if !reflect.DeepEqual(clone.sortedDeps(c), i.sortedDeps(e)) || !reflect.DeepEqual(c.conflicts, e.conflicts) || c.refCount != e.refCount || c.auto != e.auto {
+			t.Fatalf("clone has %s = %+v, want %+v", p, c, e)
+		}
+	}
+}
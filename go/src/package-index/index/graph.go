@@ -0,0 +1,104 @@
+package index
+
+import "sort"
+
+// Grapher is implemented by indexes that can answer questions about the
+// dependency graph beyond whether a package is indexed.
+type Grapher interface {
+	// Deps returns the transitive dependency closure of pkg: every package
+	// that must be indexed for pkg to be indexed, sorted by name. Returns
+	// false if pkg isn't indexed.
+	Deps(pkg string) (deps []string, ok bool)
+	// Dependents returns the packages that depend on pkg, sorted by name. If
+	// transitive is false these are only the packages that list pkg as a
+	// dependency, i.e. the ones that block its removal; otherwise they are
+	// every package that would have to be removed before pkg could be.
+	// Returns false if pkg isn't indexed.
+	Dependents(pkg string, transitive bool) (dependents []string, ok bool)
+}
+
+// Deps implements Grapher in O(n + e) for the n packages and e dependency
+// edges in the closure. A bare name refers to its only indexed version.
+func (i *index) Deps(pkg string) ([]string, bool) {
+	i.l.RLock()
+	defer i.l.RUnlock()
+	pkg, ok := i.find(pkg)
+	if !ok {
+		return nil, false
+	}
+	return sortedKeys(i.closure(pkg, i.depNames)), true
+}
+
+// Dependents implements Grapher. The direct case is O(r log r) for the r
+// dependents of pkg; the transitive case is O(n + e) for the n packages and e
+// edges in the closure. A bare name refers to its only indexed version.
+func (i *index) Dependents(pkg string, transitive bool) ([]string, bool) {
+	i.l.RLock()
+	defer i.l.RUnlock()
+	pkg, ok := i.find(pkg)
+	if !ok {
+		return nil, false
+	}
+	e := i.m[pkg]
+	if !transitive {
+		names := i.rdepNames(e)
+		sort.Strings(names)
+		return names, true
+	}
+	return sortedKeys(i.closure(pkg, i.rdepNames)), true
+}
+
+// depNames returns the names of the packages e depends on, in no particular
+// order. The caller must hold the lock.
+func (i *index) depNames(e entry) []string {
+	names := make([]string, len(e.deps))
+	for k, d := range e.deps {
+		names[k] = i.names.name(d)
+	}
+	return names
+}
+
+// sortedDeps returns the names of the packages e depends on, sorted. The
+// caller must hold the lock.
+func (i *index) sortedDeps(e entry) []string {
+	names := i.depNames(e)
+	sort.Strings(names)
+	return names
+}
+
+// rdepNames returns the names of the packages that depend on e, in no
+// particular order. The caller must hold the lock.
+func (i *index) rdepNames(e entry) []string {
+	names := make([]string, 0, len(e.rdeps))
+	for r := range e.rdeps {
+		names = append(names, i.names.name(r))
+	}
+	return names
+}
+
+// closure returns the packages reachable from pkg by following the edges
+// returned by next. The caller must hold the lock.
+func (i *index) closure(pkg string, next func(entry) []string) map[string]struct{} {
+	seen := make(map[string]struct{})
+	stack := []string{pkg}
+	for len(stack) > 0 {
+		p := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+		for _, d := range next(i.m[p]) {
+			if _, ok := seen[d]; !ok {
+				seen[d] = struct{}{}
+				stack = append(stack, d)
+			}
+		}
+	}
+	return seen
+}
+
+func sortedKeys(set map[string]struct{}) []string {
+	keys := make([]string, 0, len(set))
+	for k := range set {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,112 @@
+package index
+
+import (
+	"reflect"
+	"testing"
+)
+
+// newTestGraph indexes:
+//
+//	A -> B -> D
+//	A -> C -> D
+//	E
+func newTestGraph(t *testing.T) *index {
+	i := newIndex()
+	for _, p := range []struct {
+		pkg  string
+		deps []string
+	}{
+		{"D", nil},
+		{"E", nil},
+		{"B", []string{"D"}},
+		{"C", []string{"D"}},
+		{"A", []string{"B", "C"}},
+	} {
+		deps := make(map[string]struct{})
+		for _, d := range p.deps {
+			deps[d] = struct{}{}
+		}
+		if !i.Index(p.pkg, deps) {
+			t.Fatalf("index %s failed", p.pkg)
+		}
+	}
+	return i
+}
+
+func TestDeps(t *testing.T) {
+	i := newTestGraph(t)
+	tcs := []struct {
+		pkg  string
+		deps []string
+		ok   bool
+	}{
+		{"A", []string{"B", "C", "D"}, true},
+		{"B", []string{"D"}, true},
+		{"D", []string{}, true},
+		{"E", []string{}, true},
+		{"F", nil, false},
+	}
+	for _, tc := range tcs {
+		deps, ok := i.Deps(tc.pkg)
+		if ok != tc.ok || !reflect.DeepEqual(deps, tc.deps) {
+			t.Fatalf("Deps(%q) = %v, %v; expected %v, %v", tc.pkg, deps, ok, tc.deps, tc.ok)
+		}
+	}
+}
+
+func TestDependents(t *testing.T) {
+	i := newTestGraph(t)
+	tcs := []struct {
+		pkg        string
+		transitive bool
+		dependents []string
+		ok         bool
+	}{
+		{"D", false, []string{"B", "C"}, true},
+		{"D", true, []string{"A", "B", "C"}, true},
+		{"B", false, []string{"A"}, true},
+		{"A", true, []string{}, true},
+		{"E", false, []string{}, true},
+		{"F", true, nil, false},
+	}
+	for _, tc := range tcs {
+		dependents, ok := i.Dependents(tc.pkg, tc.transitive)
+		if ok != tc.ok || !reflect.DeepEqual(dependents, tc.dependents) {
+			t.Fatalf("Dependents(%q, %v) = %v, %v; expected %v, %v", tc.pkg, tc.transitive, dependents, ok, tc.dependents, tc.ok)
+		}
+	}
+	if !i.Remove("A") {
+		t.Fatal("remove A failed")
+	}
+	if dependents, _ := i.Dependents("B", false); len(dependents) != 0 {
+		t.Fatalf("B still has dependents %v after removing A", dependents)
+	}
+}
+
+// A bare name refers to the only indexed version of a package, as it does
+// for MARK and HOLD.
+func TestGraphBareName(t *testing.T) {
+	i := newIndex()
+	i.Index("c@1.2.0", nil)
+	i.Index("app", map[string]struct{}{"c": struct{}{}})
+	if deps, ok := i.Deps("c"); !ok || !reflect.DeepEqual(deps, []string{}) {
+		t.Fatalf("Deps(c) = %v, %v", deps, ok)
+	}
+	if deps, ok := i.Deps("app"); !ok || !reflect.DeepEqual(deps, []string{"c@1.2.0"}) {
+		t.Fatalf("Deps(app) = %v, %v", deps, ok)
+	}
+	if dependents, ok := i.Dependents("c", false); !ok || !reflect.DeepEqual(dependents, []string{"app"}) {
+		t.Fatalf("Dependents(c) = %v, %v", dependents, ok)
+	}
+	if dependents, ok := i.Dependents("c@1.2", true); !ok || !reflect.DeepEqual(dependents, []string{"app"}) {
+		t.Fatalf("Dependents(c@1.2) = %v, %v", dependents, ok)
+	}
+	// With two versions indexed the bare name is ambiguous.
+	i.Index("c@1.3.0", nil)
+	if _, ok := i.Deps("c"); ok {
+		t.Fatal("Deps(c) succeeded with two versions indexed")
+	}
+	if _, ok := i.Dependents("c", false); ok {
+		t.Fatal("Dependents(c) succeeded with two versions indexed")
+	}
+}
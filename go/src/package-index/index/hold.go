@@ -0,0 +1,102 @@
+package index
+
+import "sort"
+
+// Holder is implemented by indexes that can protect packages from removal,
+// like apt-mark hold. A held package cannot be removed by any means, whether
+// or not anything depends on it: Remove, a batch, Purge, AutoRemove and the
+// lease reaper all leave it, and a purge that would remove it removes nothing.
+type Holder interface {
+	// Hold sets (held) or clears the hold on pkg. Returns false if pkg
+	// isn't indexed.
+	Hold(pkg string, held bool) (ok bool)
+	// Holds returns the held packages, sorted.
+	Holds() []string
+	// RemoveUnheld is Remove, except that if it fails because pkg, or one
+	// of the versions a bare name refers to, is held, it returns true for
+	// held.
+	RemoveUnheld(pkg string) (ok, held bool)
+}
+
+// Hold implements Holder.
+func (i *index) Hold(pkg string, held bool) bool {
+	i.l.Lock()
+	defer i.l.Unlock()
+	p, ok := i.find(pkg)
+	if !ok {
+		return false
+	}
+	i.hold(p, held)
+	i.commit()
+	return true
+}
+
+// Holds implements Holder in O(n log n) for the n packages indexed.
+func (i *index) Holds() []string {
+	i.l.RLock()
+	defer i.l.RUnlock()
+	var held []string
+	for pkg, e := range i.m {
+		if e.held {
+			held = append(held, pkg)
+		}
+	}
+	sort.Strings(held)
+	return held
+}
+
+// RemoveUnheld implements Holder.
+func (i *index) RemoveUnheld(pkg string) (ok, held bool) {
+	i.l.Lock()
+	defer i.l.Unlock()
+	if i.isHeld(pkg) {
+		return false, true
+	}
+	ok = i.remove(pkg)
+	i.commit()
+	return ok, false
+}
+
+// isHeld reports whether pkg, or any version a bare name refers to, is held.
+// The caller must hold the lock.
+func (i *index) isHeld(pkg string) bool {
+	if e, ok := i.m[pkg]; ok {
+		return e.held
+	}
+	for _, p := range i.lookup(pkg) {
+		if i.m[p].held {
+			return true
+		}
+	}
+	return false
+}
+
+// hold sets the hold on pkg, which must be indexed. The caller must hold the
+// write lock.
+func (i *index) hold(pkg string, held bool) {
+	e := i.m[pkg]
+	if e.held == held {
+		return
+	}
+	i.remember(pkg)
+	if i.journal != nil {
+		*i.journal = append(*i.journal, change{pkg: pkg, marked: true, e: e})
+	}
+	e.held = held
+	i.m[pkg] = e
+	if !held {
+		// The reaper may have left the package because of the hold, or,
+		// when cascading, a package it depends on.
+		if i.cascade {
+			for p := range i.blocked {
+				i.unblock(p)
+			}
+		} else {
+			i.unblock(pkg)
+		}
+	}
+	i.record(Updated, pkg)
+	if i.wal != nil {
+		i.wal.mark(pkg, e)
+	}
+}
@@ -0,0 +1,110 @@
+package index
+
+import (
+	"os"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestHold(t *testing.T) {
+	i := newIndex()
+	i.Index("glibc", nil)
+	i.Index("ssl@1.1", nil)
+	i.Index("ssl@3.0", nil)
+	i.Index("app", map[string]struct{}{"glibc": struct{}{}})
+	if i.Hold("zlib", true) {
+		t.Fatal("Hold(zlib) succeeded for a package that isn't indexed")
+	}
+	if !i.Hold("glibc", true) || !i.Hold("ssl@3.0", true) {
+		t.Fatal("Hold failed")
+	}
+	if holds := i.Holds(); !reflect.DeepEqual(holds, []string{"glibc", "ssl@3.0"}) {
+		t.Fatalf("Holds() = %v, want [glibc ssl@3.0]", holds)
+	}
+	if removed := i.Purge("glibc"); len(removed) != 0 {
+		t.Fatalf("Purge(glibc) removed %v", removed)
+	}
+	i.Remove("app")
+	if i.Remove("glibc") {
+		t.Fatal("Remove removed a held package")
+	}
+	if ok, held := i.RemoveUnheld("glibc"); ok || !held {
+		t.Fatalf("RemoveUnheld(glibc) = %v, %v, want a hold", ok, held)
+	}
+	// A bare name removes none of the versions if any is held.
+	if ok, held := i.RemoveUnheld("ssl"); ok || !held {
+		t.Fatalf("RemoveUnheld(ssl) = %v, %v, want a hold", ok, held)
+	}
+	if !i.Query("ssl@1.1") {
+		t.Fatal("RemoveUnheld(ssl) removed an unheld version")
+	}
+	if i.Batch([]Op{{Remove: true, Package: "glibc"}}) {
+		t.Fatal("a batch removed a held package")
+	}
+	i.Hold("glibc", false)
+	if ok, held := i.RemoveUnheld("glibc"); !ok || held {
+		t.Fatalf("RemoveUnheld(glibc) = %v, %v after unholding", ok, held)
+	}
+}
+
+func TestHoldAutoRemove(t *testing.T) {
+	i := newIndex()
+	i.IndexAuto("base", nil)
+	i.IndexAuto("lib", map[string]struct{}{"base": struct{}{}})
+	i.Hold("base", true)
+	if removed := i.AutoRemove(); !reflect.DeepEqual(removed, []string{"lib"}) {
+		t.Fatalf("AutoRemove() = %v, want [lib]", removed)
+	}
+}
+
+func TestHoldLease(t *testing.T) {
+	i := newIndex()
+	i.IndexLease("A", nil, time.Hour)
+	i.Hold("A", true)
+	if removed := reapAt(i, 2*time.Hour); len(removed) != 0 {
+		t.Fatalf("reap() removed %v while A is held", removed)
+	}
+	i.Hold("A", false)
+	if removed := reapAt(i, 2*time.Hour); !reflect.DeepEqual(removed, []string{"A"}) {
+		t.Fatalf("reap() = %v after unholding, want [A]", removed)
+	}
+	// Nor does a cascade remove a held dependent.
+	i.SetLeaseCascade(true)
+	i.IndexLease("B", nil, time.Hour)
+	i.Index("C", map[string]struct{}{"B": struct{}{}})
+	i.Hold("C", true)
+	if removed := reapAt(i, 2*time.Hour); len(removed) != 0 {
+		t.Fatalf("reap() removed %v while C is held", removed)
+	}
+	i.Hold("C", false)
+	if removed := reapAt(i, 2*time.Hour); !reflect.DeepEqual(removed, []string{"C", "B"}) {
+		t.Fatalf("reap() = %v after unholding, want [C B]", removed)
+	}
+}
+
+func TestHoldDurable(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	d := mustOpen(t, dir)
+	h := d.(Holder)
+	d.(AutoRemover).IndexAuto("A", nil)
+	d.Index("B", nil)
+	d.Index("C", nil)
+	h.Hold("A", true)
+	h.Hold("C", true)
+	if err := d.Checkpoint(); err != nil {
+		t.Fatal(err)
+	}
+	h.Hold("B", true)
+	h.Hold("C", false)
+	d.Close()
+	d = mustOpen(t, dir)
+	defer d.Close()
+	if holds := d.(Holder).Holds(); !reflect.DeepEqual(holds, []string{"A", "B"}) {
+		t.Fatalf("Holds() = %v after reopen, want [A B]", holds)
+	}
+	if auto, _ := d.(AutoRemover).Auto("A"); !auto {
+		t.Fatal("A lost its auto mark with its hold")
+	}
+}
@@ -1,6 +1,10 @@
 package index
 
-import "sync"
+import (
+	"log"
+	"sync"
+	"time"
+)
 
 type Index interface {
 	// Returns true if the package could be indexed or if it was already
@@ -9,6 +13,9 @@ type Index interface {
 	//
 	// NB: empty string is a valid (albeit silly) package name, even though
 	// the frontend protocol does not support it.
+	//
+	// Implementations, and those of the optional interfaces that take deps,
+	// must not keep deps once they return, so that the caller may reuse it.
 	Index(pkg string, deps map[string]struct{}) (ok bool)
 	// Returns true if the package could be removed from the index. Returns
 	// false if the package could not be removed from the index because some
@@ -23,69 +30,476 @@ type Index interface {
 type index struct {
 	l sync.RWMutex
 	m map[string]entry
+	// names interns the name of every package ever indexed. The keys of m
+	// are its strings.
+	names names
+	// versions indexes the versioned packages in m by name, so that a
+	// dependency constraint or a bare name can find them.
+	versions map[string]map[string]Version
+	// conflictors maps a package name to the indexed packages that declare
+	// a conflict with some package of that name; see conflict.go.
+	conflictors map[string]map[string]struct{}
+	// journal, when non-nil, records each insert and delete so that a
+	// failed batch can be undone.
+	journal *[]change
+	// deferred holds the requests parked by IndexOrDefer, mapping each
+	// package to its requested deps; see defer.go.
+	deferred map[string]map[string]struct{}
+	// waiting maps a package name to the parked packages that have a
+	// dependency on it.
+	waiting map[string]map[string]struct{}
+	// arrived lists the packages inserted since the last commit while some
+	// request was parked, so that commit can promote what they unblocked.
+	arrived []string
+	// unconflicted lists the parked packages that a removal since the last
+	// commit freed of a conflict.
+	unconflicted []string
+	// unpublished holds the events of the mutations since the last commit,
+	// which publishes them to feed; see watch.go.
+	unpublished []Event
+	feed        feed
+	// edges, fanIn and fanOut are kept up to date for Stats. chain caches
+	// the length of the longest dependency chain, or is -1 if a mutation has
+	// invalidated it; it is reset under the write lock, and filled in under
+	// the read lock by whoever holds chainL. See stats.go.
+	edges         int
+	fanIn, fanOut degrees
+	chainL        sync.Mutex
+	chain         int
+	// rev is the current revision and horizon the oldest one that can still
+	// be read. history holds the past states of the packages changed since
+	// horizon, and histNames indexes its versioned packages by name. pruneQ
+	// and superseded schedule the pruning of history, in revision order. See
+	// revision.go.
+	rev        uint64
+	horizon    uint64
+	history    map[string][]version
+	histNames  map[string]map[string]Version
+	pruneQ     []pkgRev
+	superseded []supersession
+	retention  time.Duration
+	// leases holds a timer for each lease, and blocked the expired leased
+	// packages that the reaper left because others depend on them. The
+	// reaper runs while reaping is set, and rescheduled asks commit to wake
+	// it. See lease.go.
+	leases      leaseQueue
+	blocked     map[string]struct{}
+	cascade     bool
+	reaping     bool
+	rescheduled bool
+	wake        chan struct{}
+	// wal is nil for a purely in-memory index.
+	wal *wal
+	// snapshotL serializes snapshots. It is acquired before l.
+	snapshotL sync.Mutex
 }
 
-// TODO: entry is not a flat struct, as it holds a map. This representation
-// will fragment the heap. We could make entry flat, but we would need to put
-// bounds on deps.
+// entry refers to other packages by their IDs in the index's names, so that
+// deps and rdeps hold no pointers for the garbage collector to trace and a
+// package's name is stored once however many packages depend on it. deps is a
+// sorted slice, a single allocation, as it is never modified once the package
+// is indexed. rdeps is modified in place and its size is unbounded, so it
+// stays a map, but one of integers.
+//
+// This is not a flat adjacency structure: the index is still a map of
+// entries keyed by name, and each entry owns its deps slice and, once
+// something depends on it, its rdeps map, so the number of heap objects
+// still grows with the number of packages. What it saves over maps of names
+// is the per-edge strings and the pointers the collector would scan.
 type entry struct {
 	refCount int64
-	deps     map[string]struct{}
+	// id is the package's ID in names.
+	id uint32
+	// deps holds the packages this one depends on. A versioned dependency is
+	// resolved to the version that satisfied it at index time.
+	deps ids
+	// rdeps holds the packages that depend on this one, so refCount ==
+	// len(rdeps).
+	rdeps map[uint32]struct{}
+	// conflicts holds the conflicts the package declared; see Conflicter.
+	// Like deps it is never modified.
+	conflicts map[string]struct{}
+	// auto marks a package that was indexed only as a dependency; see
+	// AutoRemover.
+	auto bool
+	// held marks a package that cannot be removed; see Holder.
+	held bool
+	// rev is the revision at which the package was last changed; see
+	// Conditional.
+	rev uint64
+	// expires is when the package's lease expires, in Unix nanoseconds, or 0
+	// if it is not leased; see Leaser.
+	expires int64
+	// owner is the session that owns an ephemeral package, or 0 if it is
+	// not ephemeral; see EphemeralIndexer.
+	owner uint64
 }
 
 func NewIndex() Index {
+	return newIndex()
+}
+
+func newIndex() *index {
 	return &index{
-		m: make(map[string]entry),
+		m:           make(map[string]entry),
+		versions:    make(map[string]map[string]Version),
+		conflictors: make(map[string]map[string]struct{}),
+		history:     make(map[string][]version),
+		histNames:   make(map[string]map[string]Version),
+		retention:   DefaultRetention,
 	}
 }
 
+// Index implements Index. pkg may be versioned, and deps may carry version
+// constraints; see version.go. It also returns false if pkg conflicts with an
+// indexed package; see Conflicter.
 func (i *index) Index(pkg string, deps map[string]struct{}) bool {
 	i.l.Lock()
 	defer i.l.Unlock()
+	ok := i.index(pkg, deps)
+	i.commit()
+	return ok
+}
+
+// Remove implements Index. A bare name removes every indexed version of the
+// package, or none of them if any is depended on.
+func (i *index) Remove(pkg string) bool {
+	i.l.Lock()
+	defer i.l.Unlock()
+	ok := i.remove(pkg)
+	i.commit()
+	return ok
+}
+
+// Query implements Index. A bare name matches any indexed version of the
+// package.
+func (i *index) Query(pkg string) bool {
+	i.l.RLock()
+	defer i.l.RUnlock()
 	if _, ok := i.m[pkg]; ok {
 		return true
 	}
-	// Don't hold references to empty deps.
-	if len(deps) == 0 {
-		deps = nil
-	} else {
-		for d := range deps {
-			if _, ok := i.m[d]; !ok {
-				return false
+	return len(i.lookup(pkg)) > 0
+}
+
+// index is Index without the locking and commit.
+func (i *index) index(pkg string, deps map[string]struct{}) bool {
+	return i.indexAs(pkg, deps, entry{})
+}
+
+// indexAs is index for a package with the auto-installed mark, lease,
+// conflicts and ephemerality of as; see AutoRemover, Leaser, Conflicter and
+// EphemeralIndexer.
+func (i *index) indexAs(pkg string, deps map[string]struct{}, as entry) bool {
+	if _, ok := i.m[pkg]; ok {
+		i.reindex(pkg, as)
+		return true
+	}
+	name, v, versioned, err := ParsePackage(pkg)
+	if err != nil {
+		return false
+	}
+	if versioned {
+		for p, w := range i.versions[name] {
+			if v.Compare(w) == 0 {
+				// Indexed under an equivalent name, e.g. 1.1 and 1.1.0.
+				i.reindex(p, as)
+				return true
 			}
 		}
-		for d := range deps {
-			depEntry := i.m[d]
-			depEntry.refCount++
-			i.m[d] = depEntry
-		}
 	}
-	i.m[pkg] = entry{deps: deps}
+	resolved, ok := i.resolve(deps)
+	if !ok || i.conflicted(pkg, as.conflicts) {
+		return false
+	}
+	as.deps = resolved
+	i.insert(pkg, as)
 	return true
 }
 
-func (i *index) Remove(pkg string) bool {
-	i.l.Lock()
-	defer i.l.Unlock()
-	entry, ok := i.m[pkg]
-	if !ok {
+// reindex handles an index of pkg, which is already indexed, as as. Only an
+// explicit install changes its mark, and only a permanent one its lease.
+func (i *index) reindex(pkg string, as entry) {
+	if as.auto {
+		return
+	}
+	i.mark(pkg, false)
+	if as.expires == 0 {
+		i.lease(pkg, 0)
+	}
+}
+
+// remove is Remove without the locking and commit. A held package is not
+// removed.
+func (i *index) remove(pkg string) bool {
+	if e, ok := i.m[pkg]; ok {
+		if e.refCount > 0 || e.held {
+			return false
+		}
+		i.delete(pkg, e)
 		return true
 	}
-	if entry.refCount > 0 {
-		return false
+	matches := i.lookup(pkg)
+	for _, p := range matches {
+		if e := i.m[p]; e.refCount > 0 || e.held {
+			return false
+		}
 	}
-	delete(i.m, pkg)
-	for d := range entry.deps {
-		depEntry := i.m[d]
-		depEntry.refCount--
-		i.m[d] = depEntry
+	for _, p := range matches {
+		i.delete(p, i.m[p])
 	}
 	return true
 }
 
-func (i *index) Query(pkg string) bool {
-	i.l.RLock()
-	defer i.l.RUnlock()
-	_, ok := i.m[pkg]
-	return ok
+// lookup returns the indexed packages that pkg refers to: for a bare name,
+// the unversioned package and every version; for a versioned name, the
+// version that is equal to it. The caller must hold the lock.
+func (i *index) lookup(pkg string) []string {
+	name, v, versioned, err := ParsePackage(pkg)
+	if err != nil {
+		return nil
+	}
+	var matches []string
+	if !versioned {
+		if _, ok := i.m[name]; ok {
+			matches = append(matches, name)
+		}
+	}
+	for p, w := range i.versions[name] {
+		if !versioned || v.Compare(w) == 0 {
+			matches = append(matches, p)
+		}
+	}
+	return matches
+}
+
+// resolve maps each dependency in deps to the ID of the indexed package that
+// satisfies it. It returns false if some dependency is not satisfied.
+func (i *index) resolve(deps map[string]struct{}) (ids, bool) {
+	if len(deps) == 0 {
+		return nil, true
+	}
+	resolved := make([]uint32, 0, len(deps))
+	for d := range deps {
+		if e, ok := i.m[d]; ok {
+			resolved = append(resolved, e.id)
+			continue
+		}
+		p, ok := i.resolveDep(d)
+		if !ok {
+			return nil, false
+		}
+		resolved = append(resolved, i.m[p].id)
+	}
+	// Two dependencies may resolve to the same package.
+	return makeIDs(resolved), true
+}
+
+// resolveDep returns the indexed package that satisfies the dependency d: d
+// itself if it is indexed, otherwise the highest version of d's package that
+// matches d's constraint, if any. A bare name is satisfied by any version.
+func (i *index) resolveDep(d string) (string, bool) {
+	if _, ok := i.m[d]; ok {
+		return d, true
+	}
+	name, c, err := ParseDependency(d)
+	if err != nil {
+		return "", false
+	}
+	best, found := "", false
+	var bestV Version
+	for p, v := range i.versions[name] {
+		if c.Match(v) && (!found || v.Compare(bestV) > 0) {
+			best, bestV, found = p, v, true
+		}
+	}
+	return best, found
+}
+
+// insert adds pkg to the index with entry e and takes a reference on each of
+// e's deps. The caller must hold the write lock and must have checked that pkg
+// is not indexed and that all of e's deps are. e must not have dependents.
+func (i *index) insert(pkg string, e entry) {
+	e.id = i.names.intern(pkg)
+	// Key everything by the interned copy of the name, so that the caller's
+	// is not kept.
+	pkg = i.names.name(e.id)
+	i.remember(pkg)
+	// Don't hold references to empty deps.
+	if len(e.deps) == 0 {
+		e.deps = nil
+	}
+	if len(e.conflicts) == 0 {
+		e.conflicts = nil
+	}
+	for _, d := range e.deps {
+		i.link(e.id, i.names.name(d))
+	}
+	i.countPackage(e, 1)
+	i.m[pkg] = e
+	i.addVersion(pkg)
+	i.declare(pkg, e)
+	if e.expires != 0 {
+		i.schedule(pkg, e.expires)
+	}
+	if len(i.deferred) > 0 {
+		i.arrived = append(i.arrived, pkg)
+	}
+	i.record(Indexed, pkg)
+	if i.journal != nil {
+		*i.journal = append(*i.journal, change{pkg: pkg})
+	}
+	if i.wal != nil {
+		i.wal.put(pkg, e, &i.names)
+	}
+}
+
+// delete removes pkg, whose current entry is e, from the index and releases
+// its references on its deps. The caller must hold the write lock.
+func (i *index) delete(pkg string, e entry) {
+	i.remember(pkg)
+	delete(i.m, pkg)
+	for _, d := range e.deps {
+		i.unlink(e.id, i.names.name(d))
+	}
+	i.countPackage(e, -1)
+	if name, _, versioned, _ := ParsePackage(pkg); versioned {
+		delete(i.versions[name], pkg)
+		if len(i.versions[name]) == 0 {
+			delete(i.versions, name)
+		}
+	}
+	i.undeclare(pkg, e)
+	if len(e.conflicts) > 0 && len(i.deferred) > 0 {
+		i.unconflict(e.conflicts)
+	}
+	delete(i.blocked, pkg)
+	i.record(Removed, pkg)
+	if i.journal != nil {
+		*i.journal = append(*i.journal, change{pkg: pkg, removed: true, e: e})
+	}
+	if i.wal != nil {
+		i.wal.del(pkg)
+	}
+}
+
+// addVersion adds pkg to the versions index if it is versioned.
+func (i *index) addVersion(pkg string) {
+	name, v, versioned, err := ParsePackage(pkg)
+	if !versioned || err != nil {
+		return
+	}
+	if i.versions[name] == nil {
+		i.versions[name] = make(map[string]Version)
+	}
+	i.versions[name][pkg] = v
+}
+
+// change is a journal record of an insert, delete, replace, mark (which
+// includes a hold) or lease.
+type change struct {
+	pkg     string
+	removed bool
+	updated bool
+	marked  bool
+	leased  bool
+	// e is the entry of a removed package, or the previous entry of an
+	// updated, marked or leased one.
+	e entry
+}
+
+// undo reverts the changes recorded in journal, newest first.
+func (i *index) undo(journal []change) {
+	for k := len(journal) - 1; k >= 0; k-- {
+		c := journal[k]
+		switch {
+		case c.removed:
+			i.insert(c.pkg, c.e)
+		case c.updated:
+			i.replace(c.pkg, i.m[c.pkg], c.e.deps)
+		case c.marked:
+			i.mark(c.pkg, c.e.auto)
+			i.hold(c.pkg, c.e.held)
+		case c.leased:
+			i.lease(c.pkg, c.e.expires)
+		default:
+			i.delete(c.pkg, i.m[c.pkg])
+		}
+	}
+}
+
+// link records that the package with ID id depends on dep, which must be
+// indexed.
+func (i *index) link(id uint32, dep string) {
+	depEntry := i.m[dep]
+	i.fanIn.move(int(depEntry.refCount), int(depEntry.refCount)+1)
+	i.edges++
+	depEntry.refCount++
+	if depEntry.rdeps == nil {
+		depEntry.rdeps = make(map[uint32]struct{})
+	}
+	depEntry.rdeps[id] = struct{}{}
+	i.m[dep] = depEntry
+}
+
+// unlink undoes link.
+func (i *index) unlink(id uint32, dep string) {
+	depEntry := i.m[dep]
+	i.fanIn.move(int(depEntry.refCount), int(depEntry.refCount)-1)
+	i.edges--
+	depEntry.refCount--
+	delete(depEntry.rdeps, id)
+	if len(depEntry.rdeps) == 0 {
+		depEntry.rdeps = nil
+	}
+	i.m[dep] = depEntry
+	if depEntry.refCount == 0 && len(i.blocked) > 0 {
+		i.unblock(dep)
+	}
+}
+
+// abort discards the mutations performed since the last commit from the log.
+// The caller must already have undone them in memory.
+func (i *index) abort() {
+	i.arrived = i.arrived[:0]
+	i.unconflicted = i.unconflicted[:0]
+	i.unpublished = i.unpublished[:0]
+	if i.wal != nil {
+		i.wal.abort()
+	}
+}
+
+// commit makes the mutations performed since the last commit durable. The
+// caller must hold the write lock and must not release it until commit
+// returns, so that no reader can observe state that has not been logged.
+//
+// If the log cannot be written the in-memory index is ahead of what we can
+// recover, and there is no response code in the protocol that tells a client
+// "your mutation happened but may be forgotten". Like most databases faced
+// with a failed log write, we give up and let recovery sort it out.
+//
+// Parked requests that the mutations unblocked are promoted first, so that
+// they are logged in the same record. Watchers hear of the mutations once
+// they are durable. Mutations that changed any package make a new revision.
+// If they changed any lease, the reaper is woken to reschedule.
+func (i *index) commit() {
+	i.promote()
+	if i.wal != nil {
+		if len(i.unpublished) > 0 {
+			// Only commit publishes, and we hold the write lock, so the
+			// feed's sequence number cannot change under us.
+			i.wal.sequence(i.feed.seq + uint64(len(i.unpublished)))
+		}
+		if err := i.wal.commit(); err != nil {
+			log.Fatalf("index: write-ahead log: %v", err)
+		}
+	}
+	if len(i.unpublished) > 0 {
+		i.advance()
+		i.feed.publish(i.unpublished)
+		i.unpublished = i.unpublished[:0]
+	}
+	if i.rescheduled {
+		i.wakeReaper()
+	}
 }
@@ -1,7 +1,10 @@
 package index
 
 import (
+	"fmt"
 	"math/rand"
+	"runtime"
+	"sync/atomic"
 	"testing"
 )
 
@@ -16,12 +19,27 @@ import (
 // implementation, we would want benchmarks for comparison.
 //
 // Each benchmark seeds math/rand with a const for determinism.
+//
+// The Parallel benchmarks compare Index implementations under concurrent
+// writers. They only show a difference with several CPUs, so run them with
+// e.g. -cpu 1,8,32.
 
 // Perform random manipulations of a small number of packages with a small
 // number of dependencies.
 func BenchmarkRandomSmall(b *testing.B) {
+	benchmarkRandomSmall(b, NewIndex())
+}
+
+// BenchmarkRandomSmall with no history kept, which guards the cost of the
+// bookkeeping every mutation does regardless.
+func BenchmarkRandomSmallNoHistory(b *testing.B) {
+	i := newIndex()
+	i.SetRetention(0)
+	benchmarkRandomSmall(b, i)
+}
+
+func benchmarkRandomSmall(b *testing.B, i Index) {
 	rand.Seed(1)
-	i := NewIndex()
 	ops := []func(){
 		func() { i.Index("A", map[string]struct{}{"B": struct{}{}}) },
 		func() { i.Index("B", nil) },
@@ -53,6 +71,168 @@ func BenchmarkIndexRemove1000Deps(b *testing.B) {
 	}
 }
 
+// Many goroutines index and remove their own packages, each of which depends
+// on a couple of packages drawn from a shared base set. This is the access
+// pattern of the test-suite's -concurrency runs: all writes, little true
+// contention on any one package.
+func benchmarkParallelWrites(b *testing.B, i Index) {
+	rand.Seed(1)
+	base := make([]string, 0, 1000)
+	for p := range genPkgSet(cap(base)) {
+		base = append(base, p)
+		i.Index(p, nil)
+	}
+	depSets := make([]map[string]struct{}, 256)
+	for k := range depSets {
+		depSets[k] = map[string]struct{}{
+			base[rand.Intn(len(base))]: struct{}{},
+			base[rand.Intn(len(base))]: struct{}{},
+		}
+	}
+	var goroutines int64
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		g := atomic.AddInt64(&goroutines, 1)
+		pkgs := make([]string, 64)
+		for k := range pkgs {
+			pkgs[k] = fmt.Sprintf("g%d-%d", g, k)
+		}
+		n := 0
+		for pb.Next() {
+			pkg := pkgs[n%len(pkgs)]
+			if n/len(pkgs)%2 == 0 {
+				i.Index(pkg, depSets[n%len(depSets)])
+			} else {
+				i.Remove(pkg)
+			}
+			n++
+		}
+	})
+}
+
+func BenchmarkParallelWrites(b *testing.B) {
+	benchmarkParallelWrites(b, NewIndex())
+}
+
+func BenchmarkParallelWritesSharded(b *testing.B) {
+	benchmarkParallelWrites(b, NewShardedIndex(64))
+}
+
+// Many goroutines query a fixed set of packages, and every writeEvery'th
+// operation indexes or removes a package instead.
+func benchmarkParallelReadMostly(b *testing.B, i Index, writeEvery int) {
+	rand.Seed(1)
+	pkgs := make([]string, 0, 1000)
+	for p := range genPkgSet(cap(pkgs)) {
+		pkgs = append(pkgs, p)
+		i.Index(p, nil)
+	}
+	var goroutines int64
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		g := atomic.AddInt64(&goroutines, 1)
+		own := fmt.Sprintf("g%d", g)
+		deps := map[string]struct{}{pkgs[int(g)%len(pkgs)]: struct{}{}}
+		n := 0
+		for pb.Next() {
+			switch {
+			case n%writeEvery != 0:
+				i.Query(pkgs[n%len(pkgs)])
+			case n/writeEvery%2 == 0:
+				i.Index(own, deps)
+			default:
+				i.Remove(own)
+			}
+			n++
+		}
+	})
+}
+
+func BenchmarkParallelRead100to1(b *testing.B) {
+	benchmarkParallelReadMostly(b, NewIndex(), 100)
+}
+
+func BenchmarkParallelRead100to1Sharded(b *testing.B) {
+	benchmarkParallelReadMostly(b, NewShardedIndex(64), 100)
+}
+
+func BenchmarkParallelRead100to1LockFree(b *testing.B) {
+	benchmarkParallelReadMostly(b, NewLockFreeIndex(), 100)
+}
+
+func BenchmarkParallelRead1000to1(b *testing.B) {
+	benchmarkParallelReadMostly(b, NewIndex(), 1000)
+}
+
+func BenchmarkParallelRead1000to1LockFree(b *testing.B) {
+	benchmarkParallelReadMostly(b, NewLockFreeIndex(), 1000)
+}
+
+// Index a graph of 100,000 packages with up to 8 dependencies each, log the
+// heap bytes it takes per package, and time full garbage collections with it
+// live. This measures what the index costs the rest of the process, rather
+// than the speed of its operations. Each call gets its own copies of the
+// names, as it would from the wire parser, so an index that keeps the
+// caller's strings pays for them.
+func benchmarkGC(b *testing.B, newIndex func() Index) {
+	rand.Seed(1)
+	const n = 100000
+	names := make([]string, n)
+	for k := range names {
+		names[k] = fmt.Sprintf("package-%d", k)
+	}
+	var before, after runtime.MemStats
+	runtime.GC()
+	runtime.ReadMemStats(&before)
+	i := newIndex()
+	for k, p := range names {
+		deps := make(map[string]struct{})
+		for d := rand.Intn(9); d > 0 && k > 0; d-- {
+			deps[string([]byte(names[rand.Intn(k)]))] = struct{}{}
+		}
+		i.Index(string([]byte(p)), deps)
+	}
+	runtime.GC()
+	runtime.ReadMemStats(&after)
+	b.Logf("%d heap bytes/package", (after.HeapAlloc-before.HeapAlloc)/n)
+	b.ResetTimer()
+	for k := 0; k < b.N; k++ {
+		runtime.GC()
+	}
+	b.StopTimer()
+	gcSink = i
+}
+
+// gcSink keeps the index in benchmarkGC live until the benchmark ends.
+var gcSink Index
+
+// Copy an index of 100,000 packages with up to 8 dependencies each, as
+// Checkpoint does while it blocks every other reader and writer.
+func BenchmarkSnapshotCopy(b *testing.B) {
+	rand.Seed(1)
+	const n = 100000
+	i := newIndex()
+	names := make([]string, n)
+	for k := range names {
+		names[k] = fmt.Sprintf("package-%d", k)
+		deps := make(map[string]struct{})
+		for d := rand.Intn(9); d > 0 && k > 0; d-- {
+			deps[names[rand.Intn(k)]] = struct{}{}
+		}
+		i.Index(names[k], deps)
+	}
+	b.ResetTimer()
+	for k := 0; k < b.N; k++ {
+		i.l.Lock()
+		i.copyState()
+		i.l.Unlock()
+	}
+}
+
+func BenchmarkGC(b *testing.B) {
+	benchmarkGC(b, NewIndex)
+}
+
 // The functions below are for generating test data and should not be called
 // under the benchmark timer.
 
@@ -4,7 +4,15 @@ import "testing"
 
 // go test -cover coverage: 100.0% of statements
 func TestIndex(t *testing.T) {
-	i := NewIndex()
+	testIndex(t, NewIndex())
+}
+
+func TestShardedIndex(t *testing.T) {
+	testIndex(t, NewShardedIndex(4))
+}
+
+// testIndex checks the behaviour that every Index implementation must share.
+func testIndex(t *testing.T, i Index) {
 	if !i.Remove("A") {
 		t.Fatal("remove un-indexed pkg failed")
 	}
@@ -0,0 +1,223 @@
+package index
+
+import (
+	"container/heap"
+	"time"
+)
+
+// A package may be indexed with a lease, which expires after a time-to-live
+// unless it is renewed, e.g. by a CI job that indexes scratch packages and
+// may die without removing them. A background reaper removes packages whose
+// leases have expired. By default it leaves a package that others still
+// depend on until they are gone; with SetLeaseCascade it removes them too,
+// leased or not. Either way it leaves held packages until they are unheld.
+//
+// Leases are absolute wall-clock times, so they keep running while a durable
+// index is closed, and leases that expired in the meantime are reaped as soon
+// as it is reopened.
+
+// Leaser is implemented by indexes that support packages with a limited
+// lifetime.
+type Leaser interface {
+	// IndexLease is Index for a package that should be removed once ttl has
+	// passed without it being renewed. A package that is already indexed
+	// keeps its lease, or lack of one. Conversely, Index makes a leased
+	// package permanent.
+	IndexLease(pkg string, deps map[string]struct{}, ttl time.Duration) (ok bool)
+	// Renew makes the lease of pkg expire ttl from now. Returns false if pkg
+	// isn't indexed or isn't leased.
+	Renew(pkg string, ttl time.Duration) (ok bool)
+	// Expiry returns when the lease of pkg expires. Returns false if pkg
+	// isn't indexed or isn't leased.
+	Expiry(pkg string) (expires time.Time, ok bool)
+	// SetLeaseCascade sets whether an expired package that others depend on
+	// is removed along with its dependents, or left until they are removed.
+	SetLeaseCascade(cascade bool)
+}
+
+// leaseTimer schedules a check of the lease of pkg at expires, in Unix
+// nanoseconds. A timer is stale once the lease has been renewed or the
+// package removed; stale timers are discarded when they fire.
+type leaseTimer struct {
+	expires int64
+	pkg     string
+}
+
+// leaseQueue is a min-heap of leaseTimers by expiry.
+type leaseQueue []leaseTimer
+
+func (q leaseQueue) Len() int            { return len(q) }
+func (q leaseQueue) Less(i, j int) bool  { return q[i].expires < q[j].expires }
+func (q leaseQueue) Swap(i, j int)       { q[i], q[j] = q[j], q[i] }
+func (q *leaseQueue) Push(x interface{}) { *q = append(*q, x.(leaseTimer)) }
+func (q *leaseQueue) Pop() interface{} {
+	old := *q
+	t := old[len(old)-1]
+	*q = old[:len(old)-1]
+	return t
+}
+
+// IndexLease implements Leaser.
+func (i *index) IndexLease(pkg string, deps map[string]struct{}, ttl time.Duration) bool {
+	i.l.Lock()
+	defer i.l.Unlock()
+	ok := i.indexAs(pkg, deps, entry{expires: time.Now().Add(ttl).UnixNano()})
+	i.commit()
+	return ok
+}
+
+// Renew implements Leaser.
+func (i *index) Renew(pkg string, ttl time.Duration) bool {
+	i.l.Lock()
+	defer i.l.Unlock()
+	p, ok := i.find(pkg)
+	if !ok || i.m[p].expires == 0 {
+		return false
+	}
+	i.lease(p, time.Now().Add(ttl).UnixNano())
+	i.commit()
+	return true
+}
+
+// Expiry implements Leaser.
+func (i *index) Expiry(pkg string) (time.Time, bool) {
+	i.l.RLock()
+	defer i.l.RUnlock()
+	p, ok := i.find(pkg)
+	if !ok || i.m[p].expires == 0 {
+		return time.Time{}, false
+	}
+	return time.Unix(0, i.m[p].expires), true
+}
+
+// SetLeaseCascade implements Leaser.
+func (i *index) SetLeaseCascade(cascade bool) {
+	i.l.Lock()
+	defer i.l.Unlock()
+	i.cascade = cascade
+	if cascade {
+		// The packages left for their dependents can go now.
+		for pkg := range i.blocked {
+			i.unblock(pkg)
+		}
+		if i.rescheduled {
+			i.wakeReaper()
+		}
+	}
+}
+
+// lease sets the lease of pkg, which must be indexed, to expire at expires,
+// or makes it permanent if expires is 0. The caller must hold the write lock.
+func (i *index) lease(pkg string, expires int64) {
+	e := i.m[pkg]
+	if e.expires == expires {
+		return
+	}
+	i.remember(pkg)
+	if i.journal != nil {
+		*i.journal = append(*i.journal, change{pkg: pkg, leased: true, e: e})
+	}
+	e.expires = expires
+	i.m[pkg] = e
+	delete(i.blocked, pkg)
+	if expires != 0 {
+		i.schedule(pkg, expires)
+	}
+	i.record(Updated, pkg)
+	if i.wal != nil {
+		i.wal.lease(pkg, e)
+	}
+}
+
+// schedule arranges for the lease of pkg to be checked at expires. The
+// caller must hold the write lock.
+func (i *index) schedule(pkg string, expires int64) {
+	heap.Push(&i.leases, leaseTimer{expires, pkg})
+	i.rescheduled = true
+}
+
+// block records that the reaper left pkg, whose lease has expired, because
+// of its dependents or a hold. The caller must hold the write lock.
+func (i *index) block(pkg string) {
+	if i.blocked == nil {
+		i.blocked = make(map[string]struct{})
+	}
+	i.blocked[pkg] = struct{}{}
+}
+
+// unblock is called when pkg loses its last dependent or its hold. If the
+// reaper left pkg because of them, it is due to be reaped again. The caller
+// must hold the write lock.
+func (i *index) unblock(pkg string) {
+	if _, ok := i.blocked[pkg]; ok {
+		delete(i.blocked, pkg)
+		i.schedule(pkg, i.m[pkg].expires)
+	}
+}
+
+// reap removes the packages whose leases expired by now, in Unix
+// nanoseconds, and returns them in the order they were removed. The caller
+// must hold the write lock.
+func (i *index) reap(now int64) []string {
+	var removed []string
+	for len(i.leases) > 0 && i.leases[0].expires <= now {
+		t := heap.Pop(&i.leases).(leaseTimer)
+		e, ok := i.m[t.pkg]
+		if !ok || e.expires != t.expires {
+			continue
+		}
+		if e.refCount > 0 && !i.cascade || e.held {
+			i.block(t.pkg)
+			continue
+		}
+		order := i.removalOrder(t.pkg)
+		if i.anyHeld(order) {
+			i.block(t.pkg)
+			continue
+		}
+		// Removing a package may unblock its deps, which puts them back
+		// at the front of the queue.
+		for _, p := range order {
+			i.delete(p, i.m[p])
+			removed = append(removed, p)
+		}
+	}
+	i.commit()
+	return removed
+}
+
+// wakeReaper makes the reaper recompute when the next lease expires,
+// starting it if it isn't running. The caller must hold the write lock.
+func (i *index) wakeReaper() {
+	i.rescheduled = false
+	if !i.reaping {
+		i.reaping = true
+		i.wake = make(chan struct{}, 1)
+		go i.reaper(i.wake)
+		return
+	}
+	select {
+	case i.wake <- struct{}{}:
+	default:
+	}
+}
+
+// reaper reaps expired leases until none are left to wait for.
+func (i *index) reaper(wake <-chan struct{}) {
+	for {
+		i.l.Lock()
+		i.reap(time.Now().UnixNano())
+		if len(i.leases) == 0 {
+			i.reaping = false
+			i.l.Unlock()
+			return
+		}
+		t := time.NewTimer(time.Duration(i.leases[0].expires - time.Now().UnixNano()))
+		i.l.Unlock()
+		select {
+		case <-t.C:
+		case <-wake:
+			t.Stop()
+		}
+	}
+}
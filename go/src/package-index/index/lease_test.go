@@ -0,0 +1,135 @@
+package index
+
+import (
+	"os"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// reapAt runs the reaper as of d from now.
+func reapAt(i *index, d time.Duration) []string {
+	i.l.Lock()
+	defer i.l.Unlock()
+	return i.reap(time.Now().Add(d).UnixNano())
+}
+
+func TestLeaseReap(t *testing.T) {
+	i := newIndex()
+	// app -> base, lib -> shared; all leased except lib.
+	i.IndexLease("base", nil, time.Hour)
+	i.IndexLease("app", map[string]struct{}{"base": struct{}{}}, time.Hour)
+	i.IndexLease("shared", nil, time.Hour)
+	i.Index("lib", map[string]struct{}{"shared": struct{}{}})
+	// An index of a leased package with a lease leaves it be, and one
+	// without makes it permanent, unless the batch fails.
+	i.IndexLease("lib", nil, time.Hour)
+	i.Index("tmp", nil)
+	i.IndexLease("tmp", nil, time.Hour)
+	i.IndexLease("perm", nil, time.Hour)
+	i.Index("perm", nil)
+	i.Batch([]Op{{Package: "app"}, {Package: "X", Dependencies: map[string]struct{}{"Y": struct{}{}}}})
+	for pkg, want := range map[string]bool{"base": true, "app": true, "lib": false, "tmp": false, "perm": false} {
+		if _, leased := i.Expiry(pkg); leased != want {
+			t.Errorf("Expiry(%s) leased = %v, want %v", pkg, leased, want)
+		}
+	}
+	if removed := reapAt(i, time.Minute); len(removed) != 0 {
+		t.Fatalf("reap() removed %v before any lease expired", removed)
+	}
+	// base waits for app, and shared for lib.
+	if removed := reapAt(i, 2*time.Hour); !reflect.DeepEqual(removed, []string{"app", "base"}) {
+		t.Fatalf("reap() = %v, want [app base]", removed)
+	}
+	if !i.Query("shared") {
+		t.Fatal("reap() removed a package that is depended on")
+	}
+	i.Remove("lib")
+	if removed := reapAt(i, 2*time.Hour); !reflect.DeepEqual(removed, []string{"shared"}) {
+		t.Fatalf("reap() = %v, want [shared]", removed)
+	}
+	if len(i.blocked) != 0 {
+		t.Fatalf("blocked = %v after reaping", i.blocked)
+	}
+}
+
+func TestLeaseRenew(t *testing.T) {
+	i := newIndex()
+	i.IndexLease("A", nil, time.Hour)
+	i.Index("B", nil)
+	if i.Renew("B", time.Hour) || i.Renew("C", time.Hour) {
+		t.Fatal("Renew() succeeded for a package without a lease")
+	}
+	before, _ := i.Expiry("A")
+	if !i.Renew("A", 3*time.Hour) {
+		t.Fatal("Renew(A) failed")
+	}
+	if after, _ := i.Expiry("A"); !after.After(before.Add(time.Hour)) {
+		t.Fatalf("Expiry(A) = %v after Renew, was %v", after, before)
+	}
+	if removed := reapAt(i, 2*time.Hour); len(removed) != 0 {
+		t.Fatalf("reap() removed %v after a renewal", removed)
+	}
+	if removed := reapAt(i, 4*time.Hour); !reflect.DeepEqual(removed, []string{"A"}) {
+		t.Fatalf("reap() = %v, want [A]", removed)
+	}
+}
+
+func TestLeaseCascade(t *testing.T) {
+	i := newIndex()
+	i.IndexLease("base", nil, time.Hour)
+	i.Index("app", map[string]struct{}{"base": struct{}{}})
+	if removed := reapAt(i, 2*time.Hour); len(removed) != 0 {
+		t.Fatalf("reap() = %v without cascading", removed)
+	}
+	// Cascading applies to the packages already left for their dependents.
+	i.SetLeaseCascade(true)
+	if removed := reapAt(i, 2*time.Hour); !reflect.DeepEqual(removed, []string{"app", "base"}) {
+		t.Fatalf("reap() = %v, want [app base]", removed)
+	}
+}
+
+func TestLeaseReaper(t *testing.T) {
+	i := newIndex()
+	i.IndexLease("A", nil, time.Hour)
+	i.IndexLease("B", nil, 10*time.Millisecond)
+	for deadline := time.Now().Add(5 * time.Second); i.Query("B"); time.Sleep(time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatal("the reaper did not remove B")
+		}
+	}
+	if !i.Query("A") {
+		t.Fatal("the reaper removed A early")
+	}
+}
+
+func TestLeaseDurable(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	d := mustOpen(t, dir)
+	l := d.(Leaser)
+	l.IndexLease("A", nil, time.Hour)
+	l.IndexLease("B", nil, time.Hour)
+	if err := d.Checkpoint(); err != nil {
+		t.Fatal(err)
+	}
+	l.Renew("B", 2*time.Hour)
+	l.IndexLease("C", nil, time.Hour)
+	d.Index("A", nil)
+	want := map[string]time.Time{}
+	for _, pkg := range []string{"B", "C"} {
+		want[pkg], _ = l.Expiry(pkg)
+	}
+	d.Close()
+	d = mustOpen(t, dir)
+	defer d.Close()
+	l = d.(Leaser)
+	if _, leased := l.Expiry("A"); leased {
+		t.Error("A is leased after reopen")
+	}
+	for pkg, w := range want {
+		if got, ok := l.Expiry(pkg); !ok || !got.Equal(w) {
+			t.Errorf("Expiry(%s) = %v, %v after reopen, want %v", pkg, got, ok, w)
+		}
+	}
+}
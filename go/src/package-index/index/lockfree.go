@@ -0,0 +1,257 @@
+package index
+
+import (
+	"sync"
+	"sync/atomic"
+)
+
+// lockFreeIndex is an Index whose reads never block. Its state is an
+// immutable persistent map that writers replace wholesale: a writer builds a
+// new version of the map, sharing everything it did not change with the old
+// one, and publishes it with a single atomic store. Readers load whichever
+// version is current and never wait for, or contend with, a writer. Writers
+// serialize on a mutex, so mutations stay linearizable, and each mutation
+// becomes visible all at once.
+//
+// The cost is paid by writers: each changed entry copies O(log n) trie nodes
+// and allocates, where the locked index updates its map in place.
+//
+// Like shardedIndex it implements only the Index interface, treats package
+// names as opaque and does not support persistence.
+type lockFreeIndex struct {
+	// root holds the current *pnode.
+	root atomic.Value
+	// w serializes writers.
+	w sync.Mutex
+}
+
+// NewLockFreeIndex returns an Index whose Query never blocks. It suits
+// read-mostly workloads; see lockFreeIndex.
+func NewLockFreeIndex() Index {
+	i := &lockFreeIndex{}
+	i.root.Store(&pnode{})
+	return i
+}
+
+func (i *lockFreeIndex) Index(pkg string, deps map[string]struct{}) bool {
+	i.w.Lock()
+	defer i.w.Unlock()
+	root := i.root.Load().(*pnode)
+	if _, ok := root.get(pkg); ok {
+		return true
+	}
+	for d := range deps {
+		if _, ok := root.get(d); !ok {
+			return false
+		}
+	}
+	e := newRefEntry(deps)
+	for _, d := range e.deps {
+		depEntry, _ := root.get(d)
+		depEntry.refCount++
+		root = root.put(d, depEntry)
+	}
+	i.root.Store(root.put(pkg, e))
+	return true
+}
+
+func (i *lockFreeIndex) Remove(pkg string) bool {
+	i.w.Lock()
+	defer i.w.Unlock()
+	root := i.root.Load().(*pnode)
+	e, ok := root.get(pkg)
+	if !ok {
+		return true
+	}
+	if e.refCount > 0 {
+		return false
+	}
+	root = root.del(pkg)
+	for _, d := range e.deps {
+		depEntry, _ := root.get(d)
+		depEntry.refCount--
+		root = root.put(d, depEntry)
+	}
+	i.root.Store(root)
+	return true
+}
+
+func (i *lockFreeIndex) Query(pkg string) bool {
+	_, ok := i.root.Load().(*pnode).get(pkg)
+	return ok
+}
+
+// pnode is a node of a persistent hash array mapped trie. Each level consumes
+// 5 bits of the key's hash to pick one of 32 slots; only occupied slots are
+// stored, in slot order, and bitmap records which those are. A slot holds
+// either a *pnode or a *pleaf. Nodes are never modified once published.
+type pnode struct {
+	bitmap   uint32
+	children []interface{}
+}
+
+// pleaf holds the entries whose keys share a full hash, which is usually
+// just one.
+type pleaf struct {
+	hash uint32
+	kvs  []pkv
+}
+
+type pkv struct {
+	key string
+	e   refEntry
+}
+
+const pbits = 5
+
+// fnv32 is the 32-bit FNV-1a hash of key. Unlike hash/fnv, it does not
+// allocate.
+func fnv32(key string) uint32 {
+	h := uint32(2166136261)
+	for k := 0; k < len(key); k++ {
+		h ^= uint32(key[k])
+		h *= 16777619
+	}
+	return h
+}
+
+// slot returns the bitmap bit for hash at shift, and the index in children
+// that it maps to.
+func (n *pnode) slot(hash uint32, shift uint) (bit uint32, idx int) {
+	bit = 1 << ((hash >> shift) & (1<<pbits - 1))
+	return bit, popcount(n.bitmap & (bit - 1))
+}
+
+func (n *pnode) get(key string) (refEntry, bool) {
+	hash := fnv32(key)
+	for shift := uint(0); ; shift += pbits {
+		bit, idx := n.slot(hash, shift)
+		if n.bitmap&bit == 0 {
+			return refEntry{}, false
+		}
+		switch c := n.children[idx].(type) {
+		case *pnode:
+			n = c
+		case *pleaf:
+			if c.hash == hash {
+				for _, kv := range c.kvs {
+					if kv.key == key {
+						return kv.e, true
+					}
+				}
+			}
+			return refEntry{}, false
+		}
+	}
+}
+
+// put returns a copy of n in which key maps to e.
+func (n *pnode) put(key string, e refEntry) *pnode {
+	return n.putAt(fnv32(key), 0, key, e)
+}
+
+func (n *pnode) putAt(hash uint32, shift uint, key string, e refEntry) *pnode {
+	bit, idx := n.slot(hash, shift)
+	if n.bitmap&bit == 0 {
+		return n.with(bit, idx, &pleaf{hash, []pkv{{key, e}}}, true)
+	}
+	var child interface{}
+	switch c := n.children[idx].(type) {
+	case *pnode:
+		child = c.putAt(hash, shift+pbits, key, e)
+	case *pleaf:
+		if c.hash == hash {
+			kvs := make([]pkv, 0, len(c.kvs)+1)
+			for _, kv := range c.kvs {
+				if kv.key != key {
+					kvs = append(kvs, kv)
+				}
+			}
+			child = &pleaf{hash, append(kvs, pkv{key, e})}
+		} else {
+			// Push the existing leaf down a level; the hashes differ, so
+			// they eventually land in different slots.
+			sbit, _ := (&pnode{}).slot(c.hash, shift+pbits)
+			sub := &pnode{bitmap: sbit, children: []interface{}{c}}
+			child = sub.putAt(hash, shift+pbits, key, e)
+		}
+	}
+	return n.with(bit, idx, child, false)
+}
+
+// del returns a copy of n without key.
+func (n *pnode) del(key string) *pnode {
+	if m, ok := n.delAt(fnv32(key), 0, key); ok {
+		return m
+	}
+	return n
+}
+
+func (n *pnode) delAt(hash uint32, shift uint, key string) (*pnode, bool) {
+	bit, idx := n.slot(hash, shift)
+	if n.bitmap&bit == 0 {
+		return n, false
+	}
+	var child interface{}
+	switch c := n.children[idx].(type) {
+	case *pnode:
+		m, ok := c.delAt(hash, shift+pbits, key)
+		if !ok {
+			return n, false
+		}
+		if m.bitmap != 0 {
+			child = m
+		}
+	case *pleaf:
+		if c.hash != hash {
+			return n, false
+		}
+		kvs := make([]pkv, 0, len(c.kvs))
+		for _, kv := range c.kvs {
+			if kv.key != key {
+				kvs = append(kvs, kv)
+			}
+		}
+		if len(kvs) == len(c.kvs) {
+			return n, false
+		}
+		if len(kvs) > 0 {
+			child = &pleaf{hash, kvs}
+		}
+	}
+	if child == nil {
+		return n.without(bit, idx), true
+	}
+	return n.with(bit, idx, child, false), true
+}
+
+// with returns a copy of n with child in slot bit, at index idx of children.
+// If insert is true the slot was empty.
+func (n *pnode) with(bit uint32, idx int, child interface{}, insert bool) *pnode {
+	m := &pnode{bitmap: n.bitmap | bit}
+	if !insert {
+		m.children = append([]interface{}(nil), n.children...)
+		m.children[idx] = child
+		return m
+	}
+	m.children = make([]interface{}, len(n.children)+1)
+	copy(m.children, n.children[:idx])
+	m.children[idx] = child
+	copy(m.children[idx+1:], n.children[idx:])
+	return m
+}
+
+// without returns a copy of n with slot bit, at index idx, emptied.
+func (n *pnode) without(bit uint32, idx int) *pnode {
+	m := &pnode{bitmap: n.bitmap &^ bit, children: make([]interface{}, len(n.children)-1)}
+	copy(m.children, n.children[:idx])
+	copy(m.children[idx:], n.children[idx+1:])
+	return m
+}
+
+func popcount(x uint32) int {
+	x = x - (x>>1)&0x55555555
+	x = x&0x33333333 + (x>>2)&0x33333333
+	x = (x + x>>4) & 0x0f0f0f0f
+	return int(x * 0x01010101 >> 24)
+}
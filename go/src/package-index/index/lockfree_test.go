@@ -0,0 +1,93 @@
+package index
+
+import (
+	"fmt"
+	"math/rand"
+	"testing"
+)
+
+func TestLockFreeIndex(t *testing.T) {
+	testIndex(t, NewLockFreeIndex())
+}
+
+// TestPersistentMap checks the trie against a builtin map, and checks that
+// old versions are unaffected by later writes.
+func TestPersistentMap(t *testing.T) {
+	rand.Seed(1)
+	n := &pnode{}
+	ref := make(map[string]int64)
+	for k := 0; k < 20000; k++ {
+		key := fmt.Sprint(rand.Intn(2000))
+		old, oldRef := n, copyRef(ref)
+		if rand.Intn(3) == 0 {
+			n = n.del(key)
+			delete(ref, key)
+		} else {
+			n = n.put(key, refEntry{refCount: int64(k)})
+			ref[key] = int64(k)
+		}
+		if k%1000 == 0 {
+			checkPersistentMap(t, old, oldRef)
+			checkPersistentMap(t, n, ref)
+		}
+	}
+	checkPersistentMap(t, n, ref)
+}
+
+// TestPersistentMapCollisions exercises keys with equal hashes, which
+// share a leaf.
+func TestPersistentMapCollisions(t *testing.T) {
+	n := &pnode{}
+	const hash = 0xdeadbeef
+	n = n.putAt(hash, 0, "a", refEntry{refCount: 1})
+	n = n.putAt(hash, 0, "b", refEntry{refCount: 2})
+	n = n.putAt(hash^1<<31, 0, "c", refEntry{refCount: 3})
+	n = n.putAt(hash, 0, "a", refEntry{refCount: 4})
+	leafOf := func(n *pnode, hash uint32) *pleaf {
+		for shift := uint(0); ; shift += pbits {
+			bit, idx := n.slot(hash, shift)
+			if n.bitmap&bit == 0 {
+				return nil
+			}
+			switch c := n.children[idx].(type) {
+			case *pnode:
+				n = c
+			case *pleaf:
+				return c
+			}
+		}
+	}
+	l := leafOf(n, hash)
+	if l == nil || len(l.kvs) != 2 {
+		t.Fatalf("expected a and b to share a leaf, got %+v", l)
+	}
+	m, ok := n.delAt(hash, 0, "a")
+	if !ok {
+		t.Fatal("delete of a failed")
+	}
+	if l := leafOf(m, hash); l == nil || len(l.kvs) != 1 || l.kvs[0].key != "b" {
+		t.Fatalf("expected b alone after deleting a, got %+v", l)
+	}
+	if l := leafOf(m, hash^1<<31); l == nil || l.kvs[0].key != "c" {
+		t.Fatalf("c lost, got %+v", l)
+	}
+}
+
+func copyRef(ref map[string]int64) map[string]int64 {
+	c := make(map[string]int64, len(ref))
+	for k, v := range ref {
+		c[k] = v
+	}
+	return c
+}
+
+func checkPersistentMap(t *testing.T, n *pnode, ref map[string]int64) {
+	for k := 0; k < 2000; k++ {
+		key := fmt.Sprint(k)
+		e, ok := n.get(key)
+		want, wantOK := ref[key]
+		if ok != wantOK || e.refCount != want {
+			t.Fatalf("get(%q) = %v, %v; expected %v, %v", key, e.refCount, ok, want, wantOK)
+		}
+	}
+}
@@ -0,0 +1,106 @@
+package index
+
+import "sort"
+
+// names interns the package names of an index to dense integer IDs, in order
+// of first appearance, so that entries can refer to their dependencies by ID.
+// Each name is stored once, as the same string that keys the index's map,
+// and is found through an open-addressing hash table of IDs, which holds no
+// pointers. It is not safe for concurrent use: it is modified under the index
+// write lock and read under the read lock. The IDs are private to the index;
+// callers, including the wire parser, deal in names.
+//
+// Interned names are never forgotten, so memory grows with the number of
+// distinct names ever indexed rather than the number currently indexed; that
+// is fine for package names, which are reused. It also means an ID stays
+// valid in the past revisions and snapshots that share an entry's deps.
+// Names are only ever appended, so a copy of the struct taken under the lock
+// can still name the IDs it knew once the lock is released.
+type names struct {
+	strs []string
+	// table holds id+1 for each name, or 0 in empty slots. Its length is a
+	// power of two and it is at most half full.
+	table []uint32
+}
+
+func (n *names) name(id uint32) string {
+	return n.strs[id]
+}
+
+// slot returns the table slot that holds name, or the empty slot where it
+// belongs.
+func (n *names) slot(name string) int {
+	mask := len(n.table) - 1
+	for k := int(fnv32(name)) & mask; ; k = (k + 1) & mask {
+		id := n.table[k]
+		if id == 0 || n.strs[id-1] == name {
+			return k
+		}
+	}
+}
+
+func (n *names) lookup(name string) (uint32, bool) {
+	if len(n.table) == 0 {
+		return 0, false
+	}
+	id := n.table[n.slot(name)]
+	return id - 1, id != 0
+}
+
+// intern returns the ID of name, giving it the next one if it is new.
+func (n *names) intern(name string) uint32 {
+	if 2*(len(n.strs)+1) > len(n.table) {
+		n.grow()
+	}
+	k := n.slot(name)
+	if n.table[k] != 0 {
+		return n.table[k] - 1
+	}
+	n.strs = append(n.strs, name)
+	id := uint32(len(n.strs))
+	n.table[k] = id
+	return id - 1
+}
+
+func (n *names) grow() {
+	size := 2 * len(n.table)
+	if size == 0 {
+		size = 16
+	}
+	n.table = make([]uint32, size)
+	for id, name := range n.strs {
+		n.table[n.slot(name)] = uint32(id) + 1
+	}
+}
+
+// ids is a set of interned names, sorted by ID. Unlike a map it is a single
+// allocation that the garbage collector need not scan, and it is never
+// modified once it belongs to an entry, so past revisions and snapshots can
+// share it.
+type ids []uint32
+
+func (s ids) Len() int           { return len(s) }
+func (s ids) Less(i, j int) bool { return s[i] < s[j] }
+func (s ids) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+
+// has reports whether id is in s, in O(log len(s)).
+func (s ids) has(id uint32) bool {
+	k := sort.Search(len(s), func(k int) bool { return s[k] >= id })
+	return k < len(s) && s[k] == id
+}
+
+// makeIDs sorts s and removes duplicates from it.
+func makeIDs(s []uint32) ids {
+	if len(s) == 0 {
+		return nil
+	}
+	sort.Sort(ids(s))
+	n := 1
+	for _, id := range s[1:] {
+		if id != s[n-1] {
+			s[n] = id
+			n++
+		}
+	}
+	return ids(s[:n])
+}
@@ -0,0 +1,89 @@
+package index
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestNames(t *testing.T) {
+	var n names
+	if _, ok := n.lookup("a"); ok {
+		t.Fatal("lookup in empty names succeeded")
+	}
+	for k := 0; k < 1000; k++ {
+		if id := n.intern(fmt.Sprint(k)); id != uint32(k) {
+			t.Fatalf("intern(%d) = %d", k, id)
+		}
+	}
+	for k := 0; k < 1000; k++ {
+		name := fmt.Sprint(k)
+		if id := n.intern(name); id != uint32(k) {
+			t.Fatalf("re-intern(%d) = %d", k, id)
+		}
+		if id, ok := n.lookup(name); !ok || id != uint32(k) {
+			t.Fatalf("lookup(%d) = %d, %v", k, id, ok)
+		}
+		if n.name(uint32(k)) != name {
+			t.Fatalf("name(%d) = %q", k, n.name(uint32(k)))
+		}
+	}
+	if _, ok := n.lookup("1000"); ok {
+		t.Fatal("lookup of un-interned name succeeded")
+	}
+	if id := n.intern(""); n.name(id) != "" {
+		t.Fatal("empty string not interned")
+	}
+}
+
+func TestMakeIDs(t *testing.T) {
+	s := makeIDs([]uint32{5, 1, 3, 1, 5, 2})
+	want := ids{1, 2, 3, 5}
+	if fmt.Sprint(s) != fmt.Sprint(want) {
+		t.Fatalf("makeIDs = %v, want %v", s, want)
+	}
+	for _, id := range want {
+		if !s.has(id) {
+			t.Fatalf("%v does not have %d", s, id)
+		}
+	}
+	if s.has(4) || s.has(0) || s.has(6) {
+		t.Fatalf("%v has an ID it should not", s)
+	}
+	if makeIDs(nil) != nil {
+		t.Fatal("makeIDs(nil) != nil")
+	}
+}
+
+// The index keeps one copy of each name, however many packages depend on it
+// and however many times it is removed and indexed again.
+func TestIndexInternsNames(t *testing.T) {
+	i := newIndex()
+	// Names built at run time, so that each is a distinct string, as the
+	// parser's are.
+	name := func(k int) string { return fmt.Sprint("pkg", k) }
+	i.Index(name(0), nil)
+	for k := 1; k <= 100; k++ {
+		if !i.Index(name(k), map[string]struct{}{name(0): struct{}{}, name(k - 1): struct{}{}}) {
+			t.Fatalf("index %s failed", name(k))
+		}
+	}
+	for round := 0; round < 3; round++ {
+		if !i.Remove(name(100)) || !i.Index(name(100), map[string]struct{}{name(0): struct{}{}}) {
+			t.Fatalf("reindex %s failed", name(100))
+		}
+	}
+	if len(i.names.strs) != 101 {
+		t.Fatalf("%d names interned, want 101", len(i.names.strs))
+	}
+	for pkg, e := range i.m {
+		if i.names.name(e.id) != pkg {
+			t.Fatalf("%s has ID of %s", pkg, i.names.name(e.id))
+		}
+	}
+	if deps, _ := i.Deps(name(2)); fmt.Sprint(deps) != "[pkg0 pkg1]" {
+		t.Fatalf("Deps(pkg2) = %v", deps)
+	}
+	if rdeps, _ := i.Dependents(name(0), false); len(rdeps) != 100 {
+		t.Fatalf("pkg0 has %d dependents, want 100", len(rdeps))
+	}
+}
@@ -0,0 +1,83 @@
+package index
+
+// Purger is implemented by indexes that support cascading removal.
+type Purger interface {
+	// Purge removes pkg along with every package that transitively depends
+	// on it, atomically with respect to other mutations, and returns the
+	// removed packages in the order they were removed (dependents first).
+	// Like Remove, a bare name refers to every indexed version of the
+	// package. Purging a package that isn't indexed, or that would remove a
+	// held package, removes nothing.
+	Purge(pkg string) (removed []string)
+}
+
+// Purge implements Purger in O(n + e) for the n packages and e edges being
+// removed.
+func (i *index) Purge(pkg string) []string {
+	i.l.Lock()
+	defer i.l.Unlock()
+	roots := []string{pkg}
+	if _, ok := i.m[pkg]; !ok {
+		roots = i.lookup(pkg)
+	}
+	if len(roots) == 0 {
+		return nil
+	}
+	removed := i.removalOrder(roots...)
+	if i.anyHeld(removed) {
+		return nil
+	}
+	for _, p := range removed {
+		i.delete(p, i.m[p])
+	}
+	i.commit()
+	return removed
+}
+
+// anyHeld reports whether any of pkgs, which must be indexed, is held. The
+// caller must hold the lock.
+func (i *index) anyHeld(pkgs []string) bool {
+	for _, p := range pkgs {
+		if i.m[p].held {
+			return true
+		}
+	}
+	return false
+}
+
+// removalOrder returns roots and their transitive dependents in an order in
+// which they can be removed one by one: every package comes after all of its
+// dependents. The caller must hold the lock.
+func (i *index) removalOrder(roots ...string) []string {
+	// Iterative post-order DFS over reverse edges, so that a long dependency
+	// chain cannot overflow the stack.
+	type frame struct {
+		pkg   string
+		rdeps []string
+	}
+	var order []string
+	seen := make(map[string]struct{})
+	for _, pkg := range roots {
+		// A root may be a dependent of one visited before it.
+		if _, ok := seen[pkg]; ok {
+			continue
+		}
+		seen[pkg] = struct{}{}
+		stack := []frame{{pkg, i.rdepNames(i.m[pkg])}}
+		for len(stack) > 0 {
+			top := &stack[len(stack)-1]
+			if len(top.rdeps) == 0 {
+				order = append(order, top.pkg)
+				stack = stack[:len(stack)-1]
+				continue
+			}
+			r := top.rdeps[len(top.rdeps)-1]
+			top.rdeps = top.rdeps[:len(top.rdeps)-1]
+			if _, ok := seen[r]; !ok {
+				seen[r] = struct{}{}
+				stack = append(stack, frame{r, i.rdepNames(i.m[r])})
+			}
+		}
+	}
+	return order
+}
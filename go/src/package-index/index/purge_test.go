@@ -0,0 +1,70 @@
+package index
+
+import "testing"
+
+func TestPurge(t *testing.T) {
+	i := newTestGraph(t)
+	if removed := i.Purge("F"); len(removed) != 0 {
+		t.Fatalf("purge of un-indexed pkg removed %v", removed)
+	}
+	removed := i.Purge("D")
+	if len(removed) != 4 {
+		t.Fatalf("purge D removed %v, expected A, B, C, D", removed)
+	}
+	// Dependents must come before their deps.
+	pos := make(map[string]int)
+	for n, p := range removed {
+		pos[p] = n
+	}
+	if pos["A"] > pos["B"] || pos["A"] > pos["C"] || pos["B"] > pos["D"] || pos["C"] > pos["D"] {
+		t.Fatalf("purge D removed in order %v", removed)
+	}
+	for _, p := range []string{"A", "B", "C", "D"} {
+		if i.Query(p) {
+			t.Fatalf("%s present after purge", p)
+		}
+	}
+	if !i.Query("E") {
+		t.Fatal("E missing after purging unrelated D")
+	}
+	// Refcounts must be consistent: E can be removed and D re-indexed.
+	if !i.Remove("E") || !i.Index("D", nil) || !i.Remove("D") {
+		t.Fatal("index inconsistent after purge")
+	}
+}
+
+func TestPurgeBareName(t *testing.T) {
+	i := newIndex()
+	i.Index("ssl@1.1", nil)
+	i.Index("ssl@3.0", nil)
+	i.Index("curl", map[string]struct{}{"ssl@1.1": struct{}{}})
+	i.Index("wget", map[string]struct{}{"ssl@>=3": struct{}{}})
+	i.Index("git", map[string]struct{}{"curl": struct{}{}, "wget": struct{}{}})
+	i.Index("zlib", nil)
+	removed := i.Purge("ssl")
+	if len(removed) != 5 {
+		t.Fatalf("purge ssl removed %v, expected both versions and their dependents", removed)
+	}
+	pos := make(map[string]int)
+	for n, p := range removed {
+		pos[p] = n
+	}
+	if pos["git"] > pos["curl"] || pos["git"] > pos["wget"] || pos["curl"] > pos["ssl@1.1"] || pos["wget"] > pos["ssl@3.0"] {
+		t.Fatalf("purge ssl removed in order %v", removed)
+	}
+	if i.Query("ssl") || !i.Query("zlib") {
+		t.Fatal("purge ssl left the wrong packages")
+	}
+	// A version equal to an indexed one refers to it, as it does for Remove.
+	i.Index("ssl@1.1", nil)
+	if removed := i.Purge("ssl@1.1.0"); len(removed) != 1 || removed[0] != "ssl@1.1" {
+		t.Fatalf("purge ssl@1.1.0 removed %v", removed)
+	}
+	// A held version stops the whole purge.
+	i.Index("ssl@1.1", nil)
+	i.Index("ssl@3.0", nil)
+	i.Hold("ssl@3.0", true)
+	if removed := i.Purge("ssl"); len(removed) != 0 || !i.Query("ssl@1.1") {
+		t.Fatalf("purge ssl with a held version removed %v", removed)
+	}
+}
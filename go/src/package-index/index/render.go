@@ -0,0 +1,152 @@
+package index
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// Graph is a copy of (part of) the dependency graph, for rendering.
+type Graph struct {
+	// Nodes are sorted by package.
+	Nodes []Node `json:"nodes"`
+	// Edges point from a package to a dependency, sorted by From then To.
+	Edges []Edge `json:"edges"`
+	// Stats describes the whole index. It is set only for a whole graph.
+	Stats *Stats `json:"stats,omitempty"`
+}
+
+// Node is a package in a Graph.
+type Node struct {
+	Package string `json:"package"`
+	// RefCount is the number of packages in the index that depend on this
+	// one, whether or not they are in the Graph.
+	RefCount int `json:"refcount"`
+}
+
+// Edge records that package From depends on package To.
+type Edge struct {
+	From string `json:"from"`
+	To   string `json:"to"`
+}
+
+// GraphExporter is implemented by indexes that can copy out their graph for
+// rendering with Graph.WriteDOT or Graph.WriteJSON.
+type GraphExporter interface {
+	// Graph returns the whole graph, with Stats.
+	Graph() Graph
+	// Subgraph returns root and the packages it transitively depends on
+	// through at most depth edges (any number if depth is negative), with
+	// the edges between them. Returns false if root isn't indexed.
+	Subgraph(root string, depth int) (g Graph, ok bool)
+}
+
+// Graph implements GraphExporter in O((n + e) log n) for the n packages and
+// e edges of the index.
+func (i *index) Graph() Graph {
+	i.l.RLock()
+	defer i.l.RUnlock()
+	pkgs := make(map[string]struct{}, len(i.m))
+	for pkg := range i.m {
+		pkgs[pkg] = struct{}{}
+	}
+	g := i.graph(pkgs)
+	s := i.stats()
+	g.Stats = &s
+	return g
+}
+
+// Subgraph implements GraphExporter in O((n + e) log n) for the n packages
+// and e edges of the subgraph.
+func (i *index) Subgraph(root string, depth int) (Graph, bool) {
+	i.l.RLock()
+	defer i.l.RUnlock()
+	root, ok := i.find(root)
+	if !ok {
+		return Graph{}, false
+	}
+	// Breadth-first, so that each package is reached by its shortest path
+	// and the depth limit cuts at the same packages however they are
+	// reached.
+	pkgs := map[string]struct{}{root: struct{}{}}
+	frontier := []string{root}
+	for d := 0; len(frontier) > 0 && (depth < 0 || d < depth); d++ {
+		var next []string
+		for _, p := range frontier {
+			for _, dep := range i.depNames(i.m[p]) {
+				if _, ok := pkgs[dep]; !ok {
+					pkgs[dep] = struct{}{}
+					next = append(next, dep)
+				}
+			}
+		}
+		frontier = next
+	}
+	return i.graph(pkgs), true
+}
+
+// graph returns the Graph of pkgs and the edges between them. The caller must
+// hold the read lock.
+func (i *index) graph(pkgs map[string]struct{}) Graph {
+	var g Graph
+	g.Nodes = make([]Node, 0, len(pkgs))
+	g.Edges = []Edge{}
+	for _, p := range sortedKeys(pkgs) {
+		e := i.m[p]
+		g.Nodes = append(g.Nodes, Node{Package: p, RefCount: int(e.refCount)})
+		for _, d := range i.sortedDeps(e) {
+			if _, ok := pkgs[d]; ok {
+				g.Edges = append(g.Edges, Edge{From: p, To: d})
+			}
+		}
+	}
+	return g
+}
+
+// WriteDOT renders g in the Graphviz DOT language, labelling each package
+// with its reference count:
+//
+//	digraph index {
+//		"curl" [label="curl\nrefcount 0"];
+//		"openssl" [label="openssl\nrefcount 1"];
+//		"curl" -> "openssl";
+//	}
+func (g Graph) WriteDOT(w io.Writer) error {
+	b := bufio.NewWriter(w)
+	fmt.Fprintln(b, "digraph index {")
+	for _, n := range g.Nodes {
+		fmt.Fprintf(b, "\t%s [label=%s];\n", dotQuote(n.Package), dotQuote(fmt.Sprintf("%s\nrefcount %d", n.Package, n.RefCount)))
+	}
+	for _, e := range g.Edges {
+		fmt.Fprintf(b, "\t%s -> %s;\n", dotQuote(e.From), dotQuote(e.To))
+	}
+	fmt.Fprintln(b, "}")
+	if err := b.Flush(); err != nil {
+		return fmt.Errorf("WriteDOT: %v", err)
+	}
+	return nil
+}
+
+// dotQuote returns s as a DOT double-quoted string.
+func dotQuote(s string) string {
+	s = strings.Replace(s, `\`, `\\`, -1)
+	s = strings.Replace(s, `"`, `\"`, -1)
+	s = strings.Replace(s, "\n", `\n`, -1)
+	return `"` + s + `"`
+}
+
+// WriteJSON renders g as a JSON document on a single line:
+//
+//	{"nodes":[{"package":"curl","refcount":0},...],"edges":[{"from":"curl","to":"openssl"},...],"stats":{...}}
+func (g Graph) WriteJSON(w io.Writer) error {
+	b, err := json.Marshal(g)
+	if err != nil {
+		return fmt.Errorf("WriteJSON: %v", err)
+	}
+	if _, err := w.Write(append(b, '\n')); err != nil {
+		return fmt.Errorf("WriteJSON: %v", err)
+	}
+	return nil
+}
@@ -0,0 +1,69 @@
+package index
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+)
+
+func TestSubgraph(t *testing.T) {
+	i := newTestGraph(t)
+	g, ok := i.Subgraph("A", 1)
+	if !ok {
+		t.Fatal("Subgraph(A) failed")
+	}
+	want := Graph{
+		Nodes: []Node{{"A", 0}, {"B", 1}, {"C", 1}},
+		Edges: []Edge{{"A", "B"}, {"A", "C"}},
+	}
+	if !reflect.DeepEqual(g, want) {
+		t.Fatalf("Subgraph(A, 1) = %+v, want %+v", g, want)
+	}
+	g, _ = i.Subgraph("A", -1)
+	want = Graph{
+		Nodes: []Node{{"A", 0}, {"B", 1}, {"C", 1}, {"D", 2}},
+		Edges: []Edge{{"A", "B"}, {"A", "C"}, {"B", "D"}, {"C", "D"}},
+	}
+	if !reflect.DeepEqual(g, want) {
+		t.Fatalf("Subgraph(A, -1) = %+v, want %+v", g, want)
+	}
+	g, _ = i.Subgraph("D", 0)
+	if want := []Node{{"D", 2}}; !reflect.DeepEqual(g.Nodes, want) || len(g.Edges) != 0 {
+		t.Fatalf("Subgraph(D, 0) = %+v", g)
+	}
+	if _, ok := i.Subgraph("Z", -1); ok {
+		t.Fatal("Subgraph(Z) succeeded")
+	}
+	g = i.Graph()
+	if len(g.Nodes) != 5 || len(g.Edges) != 4 || g.Stats == nil || *g.Stats != i.Stats() {
+		t.Fatalf("Graph() = %+v", g)
+	}
+}
+
+func TestWriteGraph(t *testing.T) {
+	i := newIndex()
+	i.Index("openssl", nil)
+	i.Index(`c"url`, map[string]struct{}{"openssl": struct{}{}})
+	g, _ := i.Subgraph(`c"url`, -1)
+	var b bytes.Buffer
+	if err := g.WriteDOT(&b); err != nil {
+		t.Fatal(err)
+	}
+	want := `digraph index {
+	"c\"url" [label="c\"url\nrefcount 0"];
+	"openssl" [label="openssl\nrefcount 1"];
+	"c\"url" -> "openssl";
+}
+`
+	if b.String() != want {
+		t.Fatalf("WriteDOT wrote\n%s\nwant\n%s", b.String(), want)
+	}
+	b.Reset()
+	if err := g.WriteJSON(&b); err != nil {
+		t.Fatal(err)
+	}
+	want = `{"nodes":[{"package":"c\"url","refcount":0},{"package":"openssl","refcount":1}],"edges":[{"from":"c\"url","to":"openssl"}]}` + "\n"
+	if b.String() != want {
+		t.Fatalf("WriteJSON wrote %s, want %s", b.String(), want)
+	}
+}
@@ -0,0 +1,296 @@
+package index
+
+import (
+	"errors"
+	"sort"
+	"time"
+)
+
+// Every committed mutation that changes the indexed packages advances the
+// index's revision by one, so the revision names a state of the index. The
+// states of recent revisions are retained so that a client can make a series
+// of reads against one of them while writers carry on.
+//
+// Rather than copying the index, the index keeps, for each package changed
+// since the oldest retained revision, its history: the states (indexed or
+// not, and with which dependencies) it has had, each with the revision from
+// which it held. A package without history has been in its current state
+// throughout. A revision stays readable for the retention period after it
+// is superseded; the histories are then pruned to what the revisions still
+// readable need.
+//
+// Keeping history costs every mutation, so the default retention is a short
+// one, long enough for a client to make a series of reads against a revision
+// it has just been given. With a retention of 0 no history is kept and only
+// the current revision can be read.
+//
+// Revisions survive restarts of a durable index: replaying a log record
+// advances the revision just as committing it did, and snapshots record the
+// revision they were taken at. History does not; a reopened index can only
+// be read as of its current revision.
+
+// DefaultRetention is how long a superseded revision stays readable unless
+// changed with SetRetention.
+const DefaultRetention = time.Minute
+
+var (
+	// ErrRevisionCompacted is returned for a revision that is no longer
+	// retained.
+	ErrRevisionCompacted = errors.New("revision is no longer retained")
+	// ErrFutureRevision is returned for a revision that has not happened yet.
+	ErrFutureRevision = errors.New("revision is in the future")
+)
+
+// Historian is implemented by indexes that can be read as of a past
+// revision.
+type Historian interface {
+	// Revision returns the current revision, which is 0 for an index that
+	// has never been changed.
+	Revision() uint64
+	// QueryAt is Query as of revision rev.
+	QueryAt(pkg string, rev uint64) (ok bool, err error)
+	// DepsAt is Grapher.Deps as of revision rev.
+	DepsAt(pkg string, rev uint64) (deps []string, ok bool, err error)
+	// SetRetention sets how long a superseded revision stays readable. It
+	// takes effect from the next mutation.
+	SetRetention(d time.Duration)
+}
+
+// version is the state of a package from revision rev on.
+type version struct {
+	rev     uint64
+	present bool
+	// deps are shared with the entry, whose deps are never modified.
+	deps ids
+}
+
+// pkgRev names a package whose history may be prunable once rev is no longer
+// readable.
+type pkgRev struct {
+	rev uint64
+	pkg string
+}
+
+// supersession records that revision rev stopped being current at time at.
+type supersession struct {
+	rev uint64
+	at  time.Time
+}
+
+// Revision implements Historian.
+func (i *index) Revision() uint64 {
+	i.l.RLock()
+	defer i.l.RUnlock()
+	return i.rev
+}
+
+// SetRetention implements Historian.
+func (i *index) SetRetention(d time.Duration) {
+	i.l.Lock()
+	defer i.l.Unlock()
+	i.retention = d
+}
+
+// QueryAt implements Historian. It costs O(log h) for a package with h
+// retained states, times the number of versions of a bare name or partial
+// version.
+func (i *index) QueryAt(pkg string, rev uint64) (bool, error) {
+	i.l.RLock()
+	defer i.l.RUnlock()
+	if err := i.checkRevision(rev); err != nil {
+		return false, err
+	}
+	return len(i.lookupAt(pkg, rev)) > 0, nil
+}
+
+// lookupAt is lookup as of the readable revision rev, except that it returns
+// only pkg if pkg itself was indexed. The caller must hold the lock.
+func (i *index) lookupAt(pkg string, rev uint64) []string {
+	if i.at(pkg, rev).present {
+		return []string{pkg}
+	}
+	name, v, versioned, err := ParsePackage(pkg)
+	if err != nil {
+		return nil
+	}
+	var matches []string
+	if !versioned && i.at(name, rev).present {
+		matches = append(matches, name)
+	}
+	// The versions of name indexed as of rev are indexed now or have
+	// history.
+	for p, w := range i.versions[name] {
+		if (!versioned || v.Compare(w) == 0) && i.at(p, rev).present {
+			matches = append(matches, p)
+		}
+	}
+	for p, w := range i.histNames[name] {
+		if _, now := i.versions[name][p]; !now && (!versioned || v.Compare(w) == 0) && i.at(p, rev).present {
+			matches = append(matches, p)
+		}
+	}
+	return matches
+}
+
+// DepsAt implements Historian in O((n + e) log h) for the n packages and e
+// edges in the closure and at most h retained states of each. A bare name
+// refers to the only version indexed as of rev.
+func (i *index) DepsAt(pkg string, rev uint64) ([]string, bool, error) {
+	i.l.RLock()
+	defer i.l.RUnlock()
+	if err := i.checkRevision(rev); err != nil {
+		return nil, false, err
+	}
+	matches := i.lookupAt(pkg, rev)
+	if len(matches) != 1 {
+		return nil, false, nil
+	}
+	pkg = matches[0]
+	seen := make(map[string]struct{})
+	stack := []string{pkg}
+	for len(stack) > 0 {
+		p := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+		for _, id := range i.at(p, rev).deps {
+			d := i.names.name(id)
+			if _, ok := seen[d]; !ok {
+				seen[d] = struct{}{}
+				stack = append(stack, d)
+			}
+		}
+	}
+	return sortedKeys(seen), true, nil
+}
+
+// checkRevision returns an error if rev cannot be read. The caller must hold
+// the lock.
+func (i *index) checkRevision(rev uint64) error {
+	if rev > i.rev {
+		return ErrFutureRevision
+	}
+	if rev < i.horizon {
+		return ErrRevisionCompacted
+	}
+	return nil
+}
+
+// at returns the state of pkg as of the readable revision rev. The caller
+// must hold the lock.
+func (i *index) at(pkg string, rev uint64) version {
+	h := i.history[pkg]
+	if len(h) == 0 {
+		e, ok := i.m[pkg]
+		return version{rev: i.rev, present: ok, deps: e.deps}
+	}
+	// The last state from a revision no later than rev. There is one, as
+	// pruning keeps the state that the oldest readable revision sees.
+	k := sort.Search(len(h), func(k int) bool { return h[k].rev > rev })
+	if k == 0 {
+		return version{}
+	}
+	return h[k-1]
+}
+
+// remember is called before pkg is changed. If pkg has no history, its
+// current state is the state it has had throughout, which becomes the first
+// state of its history. Nothing is remembered while history is off. The
+// caller must hold the write lock.
+func (i *index) remember(pkg string) {
+	if i.retention == 0 {
+		return
+	}
+	if _, ok := i.history[pkg]; ok {
+		return
+	}
+	e, ok := i.m[pkg]
+	i.history[pkg] = []version{{rev: 0, present: ok, deps: e.deps}}
+	if name, v, versioned, err := ParsePackage(pkg); versioned && err == nil {
+		if i.histNames[name] == nil {
+			i.histNames[name] = make(map[string]Version)
+		}
+		i.histNames[name][pkg] = v
+	}
+	// The history may be discarded once the changes about to be made are
+	// the oldest readable state, or straight away if they are undone.
+	i.pruneQ = append(i.pruneQ, pkgRev{i.rev + 1, pkg})
+}
+
+// advance makes the changes recorded in unpublished a new revision,
+// recording the new states of the changed packages, and then discards the
+// revisions that have outlived the retention period. The caller must hold
+// the write lock.
+func (i *index) advance() {
+	i.rev++
+	i.stamp()
+	if i.retention == 0 {
+		if len(i.history) > 0 || len(i.superseded) > 0 {
+			// Left from before history was turned off.
+			i.forget()
+		}
+		i.horizon = i.rev
+		return
+	}
+	for _, ev := range i.unpublished {
+		h := i.history[ev.Package]
+		if h[len(h)-1].rev == i.rev {
+			continue
+		}
+		e, ok := i.m[ev.Package]
+		i.history[ev.Package] = append(h, version{rev: i.rev, present: ok, deps: e.deps})
+		i.pruneQ = append(i.pruneQ, pkgRev{i.rev, ev.Package})
+	}
+	now := time.Now()
+	i.superseded = append(i.superseded, supersession{i.rev - 1, now})
+	for len(i.superseded) > 0 && now.Sub(i.superseded[0].at) >= i.retention {
+		i.horizon = i.superseded[0].rev + 1
+		i.superseded = i.superseded[1:]
+	}
+	for len(i.pruneQ) > 0 && i.pruneQ[0].rev <= i.horizon {
+		i.prune(i.pruneQ[0].pkg)
+		i.pruneQ = i.pruneQ[1:]
+	}
+}
+
+// stamp sets the revision of the packages changed by the mutations in
+// unpublished to the current revision. The caller must hold the write lock.
+func (i *index) stamp() {
+	for _, ev := range i.unpublished {
+		if e, ok := i.m[ev.Package]; ok && e.rev != i.rev {
+			e.rev = i.rev
+			i.m[ev.Package] = e
+		}
+	}
+}
+
+// prune discards the states of pkg that no readable revision sees, and its
+// history altogether if all readable revisions see its current state. The
+// caller must hold the write lock.
+func (i *index) prune(pkg string) {
+	h := i.history[pkg]
+	if len(h) == 0 {
+		return
+	}
+	k := sort.Search(len(h), func(k int) bool { return h[k].rev > i.horizon })
+	if k == len(h) {
+		delete(i.history, pkg)
+		if name, _, versioned, err := ParsePackage(pkg); versioned && err == nil {
+			delete(i.histNames[name], pkg)
+			if len(i.histNames[name]) == 0 {
+				delete(i.histNames, name)
+			}
+		}
+		return
+	}
+	if k > 1 {
+		i.history[pkg] = append([]version(nil), h[k-1:]...)
+	}
+}
+
+// forget discards all history, leaving only the current revision readable.
+// The caller must hold the write lock.
+func (i *index) forget() {
+	i.history = make(map[string][]version)
+	i.histNames = make(map[string]map[string]Version)
+	i.pruneQ, i.superseded = nil, nil
+	i.horizon = i.rev
+}
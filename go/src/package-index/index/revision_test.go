@@ -0,0 +1,195 @@
+package index
+
+import (
+	"fmt"
+	"math/rand"
+	"os"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestRevisions(t *testing.T) {
+	i := newIndex()
+	i.SetRetention(time.Hour)
+	if i.Revision() != 0 {
+		t.Fatalf("Revision() = %d for a new index", i.Revision())
+	}
+	i.Index("B", nil)                                  // 1
+	i.Index("A", map[string]struct{}{"B": struct{}{}}) // 2
+	// Neither a no-op nor a failed mutation makes a revision.
+	i.Index("A", nil)
+	i.Remove("B")
+	i.Remove("Z")
+	i.Batch([]Op{{Package: "C"}, {Remove: true, Package: "B"}})
+	if i.Revision() != 2 {
+		t.Fatalf("Revision() = %d, want 2", i.Revision())
+	}
+	i.Index("C", nil)                                                 // 3
+	i.Update("A", map[string]struct{}{"C": struct{}{}})               // 4
+	i.Batch([]Op{{Remove: true, Package: "B"}, {Package: "ssl@1.1"}}) // 5
+	i.Remove("ssl@1.1")                                               // 6
+	for _, tc := range []struct {
+		pkg  string
+		rev  uint64
+		want bool
+	}{
+		{"A", 0, false},
+		{"A", 1, false},
+		{"A", 2, true},
+		{"B", 1, true},
+		{"B", 4, true},
+		{"B", 5, false},
+		{"C", 6, true},
+		{"ssl", 5, true},
+		{"ssl@1.1.0", 5, true},
+		{"ssl@2", 5, false},
+		{"ssl", 6, false},
+	} {
+		got, err := i.QueryAt(tc.pkg, tc.rev)
+		if err != nil || got != tc.want {
+			t.Errorf("QueryAt(%s, %d) = %v, %v, want %v", tc.pkg, tc.rev, got, err, tc.want)
+		}
+	}
+	if deps, ok, err := i.DepsAt("A", 3); err != nil || !ok || !reflect.DeepEqual(deps, []string{"B"}) {
+		t.Errorf("DepsAt(A, 3) = %v, %v, %v", deps, ok, err)
+	}
+	if deps, ok, err := i.DepsAt("A", 4); err != nil || !ok || !reflect.DeepEqual(deps, []string{"C"}) {
+		t.Errorf("DepsAt(A, 4) = %v, %v, %v", deps, ok, err)
+	}
+	if _, ok, err := i.DepsAt("C", 2); err != nil || ok {
+		t.Errorf("DepsAt(C, 2) = %v, %v", ok, err)
+	}
+	// A bare name refers to the only version indexed as of the revision.
+	if deps, ok, err := i.DepsAt("ssl", 5); err != nil || !ok || !reflect.DeepEqual(deps, []string{}) {
+		t.Errorf("DepsAt(ssl, 5) = %v, %v, %v", deps, ok, err)
+	}
+	if _, ok, err := i.DepsAt("ssl", 6); err != nil || ok {
+		t.Errorf("DepsAt(ssl, 6) = %v, %v", ok, err)
+	}
+	if _, err := i.QueryAt("A", 7); err != ErrFutureRevision {
+		t.Errorf("QueryAt(A, 7) err = %v, want %v", err, ErrFutureRevision)
+	}
+}
+
+func TestRevisionRetention(t *testing.T) {
+	i := newIndex()
+	// History is kept by default.
+	i.Index("A", nil)
+	i.Remove("A")
+	if ok, err := i.QueryAt("A", 1); !ok || err != nil {
+		t.Fatalf("QueryAt(A, 1) = %v, %v by default", ok, err)
+	}
+	// A retention of 0 keeps none.
+	i = newIndex()
+	i.SetRetention(0)
+	i.Index("A", nil)
+	i.Remove("A")
+	if _, err := i.QueryAt("A", 1); err != ErrRevisionCompacted {
+		t.Fatalf("QueryAt(A, 1) err = %v with no retention, want %v", err, ErrRevisionCompacted)
+	}
+	if len(i.history) != 0 || len(i.pruneQ) != 0 || len(i.superseded) != 0 {
+		t.Fatalf("history kept with no retention: %v %v %v", i.history, i.pruneQ, i.superseded)
+	}
+	i.SetRetention(time.Hour)
+	i.Index("A", nil)
+	i.Index("B", nil)
+	if ok, err := i.QueryAt("A", 3); !ok || err != nil {
+		t.Fatalf("QueryAt(A, 3) = %v, %v with history on", ok, err)
+	}
+	i.SetRetention(0)
+	i.Remove("A")
+	if _, err := i.QueryAt("A", 4); err != ErrRevisionCompacted {
+		t.Fatalf("QueryAt(A, 4) err = %v, want %v", err, ErrRevisionCompacted)
+	}
+	if ok, err := i.QueryAt("B", 5); !ok || err != nil {
+		t.Fatalf("QueryAt(B, 5) = %v, %v", ok, err)
+	}
+	if len(i.history) != 0 || len(i.histNames) != 0 || len(i.pruneQ) != 0 {
+		t.Fatalf("history not pruned: %v %v %v", i.history, i.histNames, i.pruneQ)
+	}
+}
+
+// TestRevisionHistory checks reads as of every retained revision of a random
+// sequence of mutations against copies of the index taken at the time.
+func TestRevisionHistory(t *testing.T) {
+	i := newIndex()
+	i.SetRetention(time.Hour)
+	r := rand.New(rand.NewSource(1))
+	pkg := func() string { return fmt.Sprint(r.Intn(20)) }
+	copies := map[uint64]map[string]map[string]struct{}{0: {}}
+	for k := 0; k < 1000; k++ {
+		deps := make(map[string]struct{})
+		for n := r.Intn(3); n > 0; n-- {
+			deps[pkg()] = struct{}{}
+		}
+		switch r.Intn(3) {
+		case 0:
+			i.Index(pkg(), deps)
+		case 1:
+			i.Remove(pkg())
+		case 2:
+			i.Update(pkg(), deps)
+		}
+		c := make(map[string]map[string]struct{}, len(i.m))
+		for p, e := range i.m {
+			names := make(map[string]struct{}, len(e.deps))
+			for _, d := range i.depNames(e) {
+				names[d] = struct{}{}
+			}
+			c[p] = names
+		}
+		copies[i.Revision()] = c
+	}
+	for rev, c := range copies {
+		for k := 0; k < 20; k++ {
+			p := fmt.Sprint(k)
+			deps, want := c[p]
+			if got, err := i.QueryAt(p, rev); err != nil || got != want {
+				t.Fatalf("QueryAt(%s, %d) = %v, %v, want %v", p, rev, got, err, want)
+			}
+			if !want {
+				continue
+			}
+			got, _, _ := i.DepsAt(p, rev)
+			direct := map[string]struct{}{}
+			for _, d := range got {
+				if _, ok := deps[d]; ok {
+					direct[d] = struct{}{}
+				}
+			}
+			if len(direct) != len(deps) {
+				t.Fatalf("DepsAt(%s, %d) = %v, missing some of %v", p, rev, got, deps)
+			}
+		}
+	}
+}
+
+func TestRevisionsDurable(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	d := mustOpen(t, dir)
+	d.Index("A", nil)
+	d.(Deferrer).IndexOrDefer("C", map[string]struct{}{"B": struct{}{}})
+	d.Index("B", nil)
+	d.Close()
+	d = mustOpen(t, dir)
+	h := d.(Historian)
+	if h.Revision() != 2 {
+		t.Fatalf("Revision() = %d after reopen, want 2", h.Revision())
+	}
+	// History does not survive.
+	if _, err := h.QueryAt("A", 1); err != ErrRevisionCompacted {
+		t.Fatalf("QueryAt(A, 1) err = %v after reopen", err)
+	}
+	if err := d.Checkpoint(); err != nil {
+		t.Fatal(err)
+	}
+	d.Remove("C")
+	d.Close()
+	d = mustOpen(t, dir)
+	defer d.Close()
+	if rev := d.(Historian).Revision(); rev != 3 {
+		t.Fatalf("Revision() = %d after snapshot and reopen, want 3", rev)
+	}
+}
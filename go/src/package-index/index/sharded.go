@@ -0,0 +1,180 @@
+package index
+
+import "sync"
+
+// shardedIndex is an Index that partitions packages across independently
+// locked shards, so that mutations of unrelated packages do not serialize.
+// A mutation locks the shards holding the package and its dependencies, in
+// ascending shard order so that concurrent mutations cannot deadlock.
+//
+// It implements only the Index interface: package names are opaque (no
+// versions), and it supports neither persistence nor any of the optional
+// interfaces, each of which needs a consistent view of the whole graph.
+type shardedIndex struct {
+	shards []shard
+}
+
+type shard struct {
+	l sync.RWMutex
+	m map[string]refEntry
+	// Pad shards onto separate cache lines so that locking one does not
+	// contend with its neighbours.
+	_ [64]byte
+}
+
+// refEntry is the entry of the alternatives to index, which keep only a
+// package's references and dependencies.
+type refEntry struct {
+	refCount int64
+	deps     []string
+}
+
+// newRefEntry returns the entry of a package with deps, which it copies, as
+// an Index must not retain them.
+func newRefEntry(deps map[string]struct{}) refEntry {
+	var e refEntry
+	if len(deps) > 0 {
+		e.deps = make([]string, 0, len(deps))
+		for d := range deps {
+			e.deps = append(e.deps, d)
+		}
+	}
+	return e
+}
+
+// NewShardedIndex returns an Index that spreads packages across n shards. It
+// scales better than NewIndex under concurrent writers, at the cost of the
+// features described on shardedIndex.
+func NewShardedIndex(n int) Index {
+	if n < 1 {
+		n = 1
+	}
+	s := &shardedIndex{shards: make([]shard, n)}
+	for k := range s.shards {
+		s.shards[k].m = make(map[string]refEntry)
+	}
+	return s
+}
+
+func (s *shardedIndex) Index(pkg string, deps map[string]struct{}) bool {
+	locked := s.newShardSet()
+	locked.add(s.shardOf(pkg))
+	for d := range deps {
+		locked.add(s.shardOf(d))
+	}
+	s.lock(locked)
+	defer s.unlock(locked)
+	sh := &s.shards[s.shardOf(pkg)]
+	if _, ok := sh.m[pkg]; ok {
+		return true
+	}
+	for d := range deps {
+		if _, ok := s.shards[s.shardOf(d)].m[d]; !ok {
+			return false
+		}
+	}
+	e := newRefEntry(deps)
+	for _, d := range e.deps {
+		dsh := &s.shards[s.shardOf(d)]
+		depEntry := dsh.m[d]
+		depEntry.refCount++
+		dsh.m[d] = depEntry
+	}
+	sh.m[pkg] = e
+	return true
+}
+
+func (s *shardedIndex) Remove(pkg string) bool {
+	home := s.shardOf(pkg)
+	for {
+		// Find out which shards the package's deps live in, then lock them
+		// all in order. The package may have been removed and re-indexed
+		// with other deps in between, in which case try again.
+		sh := &s.shards[home]
+		sh.l.RLock()
+		e, ok := sh.m[pkg]
+		sh.l.RUnlock()
+		if !ok {
+			return true
+		}
+		locked := s.newShardSet()
+		locked.add(home)
+		for _, d := range e.deps {
+			locked.add(s.shardOf(d))
+		}
+		s.lock(locked)
+		e, ok = sh.m[pkg]
+		if !ok {
+			s.unlock(locked)
+			return true
+		}
+		covered := true
+		for _, d := range e.deps {
+			if !locked.has(s.shardOf(d)) {
+				covered = false
+				break
+			}
+		}
+		if !covered {
+			s.unlock(locked)
+			continue
+		}
+		if e.refCount > 0 {
+			s.unlock(locked)
+			return false
+		}
+		delete(sh.m, pkg)
+		for _, d := range e.deps {
+			dsh := &s.shards[s.shardOf(d)]
+			depEntry := dsh.m[d]
+			depEntry.refCount--
+			dsh.m[d] = depEntry
+		}
+		s.unlock(locked)
+		return true
+	}
+}
+
+func (s *shardedIndex) Query(pkg string) bool {
+	sh := &s.shards[s.shardOf(pkg)]
+	sh.l.RLock()
+	defer sh.l.RUnlock()
+	_, ok := sh.m[pkg]
+	return ok
+}
+
+// shardOf returns the shard that holds pkg.
+func (s *shardedIndex) shardOf(pkg string) int {
+	return int(fnv32(pkg) % uint32(len(s.shards)))
+}
+
+// shardSet is a bitmap of shard numbers. Iterating over it yields shards in
+// ascending order, which is the lock order.
+type shardSet []uint64
+
+func (s *shardedIndex) newShardSet() shardSet {
+	return make(shardSet, (len(s.shards)+63)/64)
+}
+
+func (set shardSet) add(k int)      { set[k/64] |= 1 << uint(k%64) }
+func (set shardSet) has(k int) bool { return set[k/64]&(1<<uint(k%64)) != 0 }
+
+// each calls fn for each shard in set, in ascending order.
+func (set shardSet) each(fn func(k int)) {
+	for w, word := range set {
+		for b := 0; word != 0; b++ {
+			if word&1 != 0 {
+				fn(w*64 + b)
+			}
+			word >>= 1
+		}
+	}
+}
+
+func (s *shardedIndex) lock(set shardSet) {
+	set.each(func(k int) { s.shards[k].l.Lock() })
+}
+
+func (s *shardedIndex) unlock(set shardSet) {
+	set.each(func(k int) { s.shards[k].l.Unlock() })
+}
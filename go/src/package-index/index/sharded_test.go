@@ -0,0 +1,67 @@
+package index
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+)
+
+// TestShardedIndexConcurrent hammers a sharded index from several goroutines
+// and then checks that the refcounts add up, which they would not if two
+// mutations had raced on an entry.
+func TestShardedIndexConcurrent(t *testing.T) {
+	s := NewShardedIndex(8).(*shardedIndex)
+	const base = 16
+	for b := 0; b < base; b++ {
+		s.Index(fmt.Sprint("base", b), nil)
+	}
+	var wg sync.WaitGroup
+	for g := 0; g < 8; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			for n := 0; n < 1000; n++ {
+				pkg := fmt.Sprint("pkg", n%32)
+				deps := map[string]struct{}{
+					fmt.Sprint("base", (n+g)%base):   struct{}{},
+					fmt.Sprint("base", (n*g+1)%base): struct{}{},
+				}
+				if n%3 == 0 {
+					s.Remove(pkg)
+				} else {
+					s.Index(pkg, deps)
+				}
+				// Some removals of base packages, which only succeed
+				// when nothing depends on them.
+				if n%7 == 0 {
+					b := fmt.Sprint("base", n%base)
+					if s.Remove(b) {
+						s.Index(b, nil)
+					}
+				}
+			}
+		}(g)
+	}
+	wg.Wait()
+
+	refs := make(map[string]int64)
+	for k := range s.shards {
+		for _, e := range s.shards[k].m {
+			for _, d := range e.deps {
+				refs[d]++
+			}
+		}
+	}
+	for k := range s.shards {
+		for pkg, e := range s.shards[k].m {
+			if e.refCount != refs[pkg] {
+				t.Fatalf("%s: refCount %d, but %d packages depend on it", pkg, e.refCount, refs[pkg])
+			}
+			for _, d := range e.deps {
+				if !s.Query(d) {
+					t.Fatalf("%s depends on missing %s", pkg, d)
+				}
+			}
+		}
+	}
+}
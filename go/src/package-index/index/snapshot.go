@@ -0,0 +1,319 @@
+package index
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// The data directory holds numbered generations of log segments and
+// snapshots. Snapshot generation g holds the state produced by every segment
+// before g, so recovery loads the newest snapshot g and replays segments g,
+// g+1, ... in order. Taking a snapshot starts a new segment and, once the
+// snapshot is durable, deletes the segments and snapshots it supersedes.
+//
+// A snapshot file is an opRevision op with an empty package, holding the
+// revision of the index, then a sequence of opPut ops (each followed by an
+// opMark if the entry has flags, an opLease if it is leased, an opConflicts
+// if it declares conflicts, and an opRevision with the revision at which the
+// package was last changed) in the log payload encoding, then an opDefer
+// op for each parked request, followed by the little-endian Castagnoli CRC
+// of everything before it. The opRevision of the index is followed by an
+// opSequence with the sequence number of the last event published to
+// watchers. Snapshots written before revisions existed lack the opRevision
+// ops and load at revision 0. The ops are in no particular order, so
+// dependency references are resolved after all of them have been read.
+
+const firstGen uint64 = 1
+
+var errSnapshotChecksum = errors.New("checksum mismatch")
+
+func segmentName(gen uint64) string  { return fmt.Sprintf("wal-%016x.log", gen) }
+func snapshotName(gen uint64) string { return fmt.Sprintf("snapshot-%016x", gen) }
+
+// listGenerations returns the generations of the snapshots and log segments
+// in dir, in ascending order. If clean is set, it removes snapshots that were
+// abandoned part way through being written.
+func listGenerations(dir string, clean bool) (snaps, segs []uint64, err error) {
+	fis, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, nil, err
+	}
+	for _, fi := range fis {
+		name := fi.Name()
+		var gen uint64
+		switch {
+		case strings.HasSuffix(name, ".tmp"):
+			if !clean {
+				continue
+			}
+			if err := os.Remove(filepath.Join(dir, name)); err != nil {
+				return nil, nil, err
+			}
+		case matchName(name, segmentName, &gen):
+			segs = append(segs, gen)
+		case matchName(name, snapshotName, &gen):
+			snaps = append(snaps, gen)
+		}
+	}
+	sort.Sort(gens(snaps))
+	sort.Sort(gens(segs))
+	return snaps, segs, nil
+}
+
+// matchName reports whether name is format(gen) for some gen, and if so
+// stores it in *gen.
+func matchName(name string, format func(uint64) string, gen *uint64) bool {
+	prefix := format(0)
+	prefix = prefix[:strings.Index(prefix, "0")]
+	if !strings.HasPrefix(name, prefix) {
+		return false
+	}
+	_, err := fmt.Sscanf(name[len(prefix):], "%x", gen)
+	return err == nil && format(*gen) == name
+}
+
+type gens []uint64
+
+func (g gens) Len() int           { return len(g) }
+func (g gens) Less(i, j int) bool { return g[i] < g[j] }
+func (g gens) Swap(i, j int)      { g[i], g[j] = g[j], g[i] }
+
+// Checkpoint writes the current state of the index to disk and discards the
+// log that it supersedes. It is a no-op for an in-memory index. It is not the
+// SNAPSHOT command, which names a revision to read as of; see revision.go.
+//
+// Readers and writers are blocked only while the index is copied in memory,
+// not while the copy is written out. The copy must be taken under the write
+// lock, at the revision at which the log is rotated, and is O(n) for the n
+// packages: BenchmarkSnapshotCopy puts it at a few milliseconds per 100,000
+// packages, paid once per snapshot. If that pause becomes a problem, entries
+// could be marked copy-on-write for the duration of the snapshot instead.
+func (i *index) Checkpoint() error {
+	i.snapshotL.Lock()
+	defer i.snapshotL.Unlock()
+
+	i.l.Lock()
+	if i.wal == nil {
+		i.l.Unlock()
+		return nil
+	}
+	dir := i.wal.dir
+	gen, err := i.wal.rotate()
+	if err != nil {
+		i.l.Unlock()
+		return fmt.Errorf("Checkpoint: %v", err)
+	}
+	pkgs, deferred, names := i.copyState()
+	rev, seq := i.rev, i.feed.seq
+	i.l.Unlock()
+
+	if err := writeSnapshot(dir, gen, rev, seq, pkgs, deferred, &names); err != nil {
+		return fmt.Errorf("Checkpoint: %v", err)
+	}
+	snaps, segs, err := listGenerations(dir, true)
+	if err != nil {
+		return fmt.Errorf("Checkpoint: %v", err)
+	}
+	for _, g := range snaps {
+		if g < gen {
+			if err := os.Remove(filepath.Join(dir, snapshotName(g))); err != nil {
+				return fmt.Errorf("Checkpoint: %v", err)
+			}
+		}
+	}
+	for _, g := range segs {
+		if g < gen {
+			if err := os.Remove(filepath.Join(dir, segmentName(g))); err != nil {
+				return fmt.Errorf("Checkpoint: %v", err)
+			}
+		}
+	}
+	return nil
+}
+
+type snapshotEntry struct {
+	pkg string
+	e   entry
+}
+
+// copyState copies what a snapshot writes: the indexed packages, the parked
+// requests and the names of the packages' deps. The caller must hold the
+// lock.
+func (i *index) copyState() ([]snapshotEntry, map[string]map[string]struct{}, names) {
+	// Entries are copied by value. Their deps are never modified once
+	// indexed, so the copy can share them. rdeps is modified in place, but
+	// it is derived from deps and not written. Names are only appended, so
+	// a copy of names can be read once the lock is released.
+	pkgs := make([]snapshotEntry, 0, len(i.m))
+	for pkg, e := range i.m {
+		pkgs = append(pkgs, snapshotEntry{pkg, e})
+	}
+	// Parked deps sets are likewise never modified.
+	deferred := make(map[string]map[string]struct{}, len(i.deferred))
+	for pkg, deps := range i.deferred {
+		deferred[pkg] = deps
+	}
+	return pkgs, deferred, i.names
+}
+
+// writeSnapshot atomically writes revision rev, made of pkgs and the parked
+// requests in deferred and reached at event sequence number seq, as snapshot
+// generation gen. n holds the names of the deps of pkgs.
+func writeSnapshot(dir string, gen, rev, seq uint64, pkgs []snapshotEntry, deferred map[string]map[string]struct{}, n *names) error {
+	path := filepath.Join(dir, snapshotName(gen))
+	f, err := os.Create(path + ".tmp")
+	if err != nil {
+		return err
+	}
+	crc := crc32.New(crcTable)
+	w := bufio.NewWriter(f)
+	buf := appendRevision(nil, "", rev)
+	buf = appendSequence(buf, seq)
+	crc.Write(buf)
+	_, err = w.Write(buf)
+	for _, p := range pkgs {
+		if err != nil {
+			break
+		}
+		buf = appendPut(buf[:0], p.pkg, p.e, n)
+		buf = appendRevision(buf, p.pkg, p.e.rev)
+		crc.Write(buf)
+		_, err = w.Write(buf)
+	}
+	for pkg, deps := range deferred {
+		if err != nil {
+			break
+		}
+		buf = appendDefer(buf[:0], pkg, deps)
+		crc.Write(buf)
+		_, err = w.Write(buf)
+	}
+	if err == nil {
+		var footer [4]byte
+		binary.LittleEndian.PutUint32(footer[:], crc.Sum32())
+		_, err = w.Write(footer[:])
+	}
+	if err == nil {
+		err = w.Flush()
+	}
+	if err == nil {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(path+".tmp", path)
+	}
+	if err == nil {
+		err = syncDir(dir)
+	}
+	if err != nil {
+		os.Remove(path + ".tmp")
+	}
+	return err
+}
+
+// loadSnapshot reads the snapshot at path into a new index.
+func loadSnapshot(path string) (*index, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	if len(b) < 4 {
+		return nil, errSnapshotChecksum
+	}
+	body, footer := b[:len(b)-4], b[len(b)-4:]
+	if crc32.Checksum(body, crcTable) != binary.LittleEndian.Uint32(footer) {
+		return nil, errSnapshotChecksum
+	}
+	i := newIndex()
+	err = decodeWALRecord(body, func(o walOp) error {
+		switch o.kind {
+		case opPut:
+		case opMark:
+			e, ok := i.m[o.pkg]
+			if !ok {
+				return errCorruptRecord
+			}
+			e.auto, e.held, e.owner = o.e.auto, o.e.held, o.e.owner
+			i.m[o.pkg] = e
+			return nil
+		case opConflicts:
+			e, ok := i.m[o.pkg]
+			if !ok {
+				return errCorruptRecord
+			}
+			e.conflicts = o.e.conflicts
+			i.m[o.pkg] = e
+			i.declare(o.pkg, e)
+			return nil
+		case opLease:
+			e, ok := i.m[o.pkg]
+			if !ok {
+				return errCorruptRecord
+			}
+			e.expires = o.e.expires
+			i.m[o.pkg] = e
+			i.schedule(o.pkg, e.expires)
+			return nil
+		case opDefer:
+			i.park(o.pkg, o.deps)
+			return nil
+		case opSequence:
+			i.feed.seq = o.rev
+			return nil
+		case opRevision:
+			if o.pkg == "" {
+				i.rev, i.horizon = o.rev, o.rev
+				return nil
+			}
+			e, ok := i.m[o.pkg]
+			if !ok {
+				return errCorruptRecord
+			}
+			e.rev = o.rev
+			i.m[o.pkg] = e
+			return nil
+		default:
+			return errCorruptRecord
+		}
+		if _, ok := i.m[o.pkg]; ok {
+			return fmt.Errorf("package %q appears twice", o.pkg)
+		}
+		// A dependency may not have been read yet, so intern it now and
+		// check that it is indexed at the end.
+		deps := make([]uint32, 0, len(o.deps))
+		for d := range o.deps {
+			deps = append(deps, i.names.intern(d))
+		}
+		o.e.deps = makeIDs(deps)
+		o.e.id = i.names.intern(o.pkg)
+		o.pkg = i.names.name(o.e.id)
+		i.m[o.pkg] = o.e
+		i.countPackage(o.e, 1)
+		i.addVersion(o.pkg)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	for pkg, e := range i.m {
+		for _, id := range e.deps {
+			d := i.names.name(id)
+			if _, ok := i.m[d]; !ok {
+				return nil, fmt.Errorf("package %q depends on missing package %q", pkg, d)
+			}
+			i.link(e.id, d)
+		}
+	}
+	return i, nil
+}
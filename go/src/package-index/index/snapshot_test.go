@@ -0,0 +1,80 @@
+package index
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestSnapshot(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	i := mustOpen(t, dir)
+	i.Index("A", nil)
+	i.Index("B", map[string]struct{}{"A": struct{}{}})
+	i.Index("C", nil)
+	if err := i.Checkpoint(); err != nil {
+		t.Fatal(err)
+	}
+	// These land in the log tail after the snapshot.
+	i.Remove("C")
+	i.Index("D", map[string]struct{}{"B": struct{}{}})
+	if err := i.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// The snapshot must have superseded the first segment.
+	if _, err := os.Stat(filepath.Join(dir, segmentName(firstGen))); !os.IsNotExist(err) {
+		t.Fatalf("first segment not discarded: %v", err)
+	}
+
+	i = mustOpen(t, dir)
+	for _, pkg := range []string{"A", "B", "D"} {
+		if !i.Query(pkg) {
+			t.Fatalf("%s missing after reopen", pkg)
+		}
+	}
+	if i.Query("C") {
+		t.Fatal("C present after reopen")
+	}
+	// Refcounts must be rebuilt from the snapshot.
+	if i.Remove("A") {
+		t.Fatal("remove A succeeded (B depends on it)")
+	}
+	if i.Remove("B") {
+		t.Fatal("remove B succeeded (D depends on it)")
+	}
+	for _, pkg := range []string{"D", "B", "A"} {
+		if !i.Remove(pkg) {
+			t.Fatalf("remove %s failed", pkg)
+		}
+	}
+	if err := i.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSnapshotCorruptFallsBack(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	i := mustOpen(t, dir)
+	i.Index("A", nil)
+	if err := i.Checkpoint(); err != nil {
+		t.Fatal(err)
+	}
+	i.Index("B", nil)
+	if err := i.Close(); err != nil {
+		t.Fatal(err)
+	}
+	// A corrupt newest snapshot is skipped. Here there is no older one and
+	// the log it superseded is gone, so open must fail rather than come up
+	// missing A.
+	path := filepath.Join(dir, snapshotName(firstGen+1))
+	if err := ioutil.WriteFile(path, []byte("garbage"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := OpenIndex(dir, Options{}); err == nil {
+		t.Fatal("open with corrupt snapshot and missing log succeeded")
+	}
+}
@@ -0,0 +1,146 @@
+package index
+
+// Stats describes the shape of the dependency graph. Fan-out is the number
+// of dependencies of a package and fan-in the number of packages that
+// depend on it.
+type Stats struct {
+	Packages int `json:"packages"`
+	// Edges is the number of dependencies, summed over all packages.
+	Edges      int     `json:"edges"`
+	MaxFanIn   int     `json:"max_fan_in"`
+	MaxFanOut  int     `json:"max_fan_out"`
+	MeanFanIn  float64 `json:"mean_fan_in"`
+	MeanFanOut float64 `json:"mean_fan_out"`
+	// LongestChain is the number of packages on the longest path of
+	// dependencies, so 1 for a graph without edges.
+	LongestChain int `json:"longest_chain"`
+	// Roots are the packages nothing depends on, and Leaves the packages
+	// that depend on nothing.
+	Roots  int `json:"roots"`
+	Leaves int `json:"leaves"`
+}
+
+// Statser is implemented by indexes that can describe their graph.
+type Statser interface {
+	Stats() Stats
+}
+
+// Stats implements Statser. Everything but LongestChain is maintained as the
+// index changes, so costs O(1); LongestChain costs O(n + e) for the first
+// call after a mutation and O(1) after that.
+func (i *index) Stats() Stats {
+	i.l.RLock()
+	defer i.l.RUnlock()
+	return i.stats()
+}
+
+// stats computes Stats. The caller must hold the read lock.
+func (i *index) stats() Stats {
+	s := Stats{
+		Packages:     len(i.m),
+		Edges:        i.edges,
+		MaxFanIn:     i.fanIn.max(),
+		MaxFanOut:    i.fanOut.max(),
+		LongestChain: i.longestChain(),
+		Roots:        i.fanIn.count(0),
+		Leaves:       i.fanOut.count(0),
+	}
+	if s.Packages > 0 {
+		// Every edge is one package's fan-out and another's fan-in.
+		s.MeanFanIn = float64(s.Edges) / float64(s.Packages)
+		s.MeanFanOut = s.MeanFanIn
+	}
+	return s
+}
+
+// degrees counts the packages that have each degree. It has no trailing
+// zeros, so the highest degree is its length less one.
+type degrees []int
+
+func (d *degrees) add(degree, n int) {
+	for len(*d) <= degree {
+		*d = append(*d, 0)
+	}
+	(*d)[degree] += n
+	for len(*d) > 0 && (*d)[len(*d)-1] == 0 {
+		*d = (*d)[:len(*d)-1]
+	}
+}
+
+// move records that a package's degree changed from `from` to `to`.
+func (d *degrees) move(from, to int) {
+	d.add(from, -1)
+	d.add(to, 1)
+}
+
+func (d degrees) count(degree int) int {
+	if degree >= len(d) {
+		return 0
+	}
+	return d[degree]
+}
+
+func (d degrees) max() int {
+	if len(d) == 0 {
+		return 0
+	}
+	return len(d) - 1
+}
+
+// countPackage adds (n = 1) or removes (n = -1) the degrees of a package with
+// entry e to the statistics. The caller must hold the write lock.
+func (i *index) countPackage(e entry, n int) {
+	i.fanIn.add(int(e.refCount), n)
+	i.fanOut.add(len(e.deps), n)
+	i.chain = -1
+}
+
+// longestChain returns the length of the longest dependency chain, computing
+// it if a mutation has invalidated the cached value. The caller must hold the
+// read lock.
+func (i *index) longestChain() int {
+	i.chainL.Lock()
+	defer i.chainL.Unlock()
+	if i.chain >= 0 {
+		return i.chain
+	}
+	// depth[p] is the length of the longest chain starting at p. Computed
+	// by an iterative post-order DFS, so that a long chain cannot overflow
+	// the stack.
+	type frame struct {
+		pkg  string
+		deps []string
+	}
+	depth := make(map[string]int, len(i.m))
+	longest := 0
+	for pkg := range i.m {
+		if _, ok := depth[pkg]; ok {
+			continue
+		}
+		stack := []frame{{pkg, i.depNames(i.m[pkg])}}
+		for len(stack) > 0 {
+			top := &stack[len(stack)-1]
+			if len(top.deps) > 0 {
+				d := top.deps[len(top.deps)-1]
+				top.deps = top.deps[:len(top.deps)-1]
+				if _, ok := depth[d]; !ok {
+					stack = append(stack, frame{d, i.depNames(i.m[d])})
+				}
+				continue
+			}
+			n := 1
+			for _, d := range i.m[top.pkg].deps {
+				if k := depth[i.names.name(d)] + 1; k > n {
+					n = k
+				}
+			}
+			depth[top.pkg] = n
+			if n > longest {
+				longest = n
+			}
+			stack = stack[:len(stack)-1]
+		}
+	}
+	i.chain = longest
+	return longest
+}
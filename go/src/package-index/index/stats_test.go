@@ -0,0 +1,131 @@
+package index
+
+import (
+	"fmt"
+	"math/rand"
+	"os"
+	"testing"
+)
+
+func TestStats(t *testing.T) {
+	i := newTestGraph(t)
+	want := Stats{
+		Packages:     5,
+		Edges:        4,
+		MaxFanIn:     2,
+		MaxFanOut:    2,
+		MeanFanIn:    0.8,
+		MeanFanOut:   0.8,
+		LongestChain: 3,
+		Roots:        2,
+		Leaves:       2,
+	}
+	if got := i.Stats(); got != want {
+		t.Fatalf("Stats() = %+v, want %+v", got, want)
+	}
+	i.Remove("A")
+	i.Update("C", map[string]struct{}{"E": struct{}{}})
+	want = Stats{
+		Packages:     4,
+		Edges:        2,
+		MaxFanIn:     1,
+		MaxFanOut:    1,
+		MeanFanIn:    0.5,
+		MeanFanOut:   0.5,
+		LongestChain: 2,
+		Roots:        2,
+		Leaves:       2,
+	}
+	if got := i.Stats(); got != want {
+		t.Fatalf("Stats() = %+v, want %+v", got, want)
+	}
+	if got := newIndex().Stats(); got != (Stats{}) {
+		t.Fatalf("Stats() of empty index = %+v", got)
+	}
+}
+
+// TestStatsIncremental checks the maintained statistics against ones
+// computed from scratch after a random sequence of mutations.
+func TestStatsIncremental(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	d := mustOpen(t, dir)
+	i := d.(*index)
+	r := rand.New(rand.NewSource(1))
+	pkg := func() string { return fmt.Sprint(r.Intn(30)) }
+	deps := func() map[string]struct{} {
+		m := make(map[string]struct{})
+		for n := r.Intn(4); n > 0; n-- {
+			m[pkg()] = struct{}{}
+		}
+		return m
+	}
+	for k := 0; k < 2000; k++ {
+		switch r.Intn(5) {
+		case 0, 1:
+			i.Index(pkg(), deps())
+		case 2:
+			i.Remove(pkg())
+		case 3:
+			i.Update(pkg(), deps())
+		case 4:
+			i.Batch([]Op{{Package: pkg(), Dependencies: deps()}, {Remove: true, Package: pkg()}})
+		}
+		if k%100 == 0 {
+			i.Purge(pkg())
+		}
+	}
+	if got, want := i.Stats(), recountStats(i); got != want {
+		t.Fatalf("Stats() = %+v, recounted %+v", got, want)
+	}
+	if err := d.Checkpoint(); err != nil {
+		t.Fatal(err)
+	}
+	want := i.Stats()
+	d.Close()
+	d = mustOpen(t, dir)
+	defer d.Close()
+	if got := d.(Statser).Stats(); got != want {
+		t.Fatalf("Stats() = %+v after reopen, want %+v", got, want)
+	}
+}
+
+func recountStats(i *index) Stats {
+	var s Stats
+	s.Packages = len(i.m)
+	for _, e := range i.m {
+		s.Edges += len(e.deps)
+		if len(e.rdeps) > s.MaxFanIn {
+			s.MaxFanIn = len(e.rdeps)
+		}
+		if len(e.deps) > s.MaxFanOut {
+			s.MaxFanOut = len(e.deps)
+		}
+		if len(e.rdeps) == 0 {
+			s.Roots++
+		}
+		if len(e.deps) == 0 {
+			s.Leaves++
+		}
+	}
+	if s.Packages > 0 {
+		s.MeanFanIn = float64(s.Edges) / float64(s.Packages)
+		s.MeanFanOut = s.MeanFanIn
+	}
+	var depth func(string) int
+	depth = func(p string) int {
+		n := 1
+		for _, d := range i.depNames(i.m[p]) {
+			if x := depth(d) + 1; x > n {
+				n = x
+			}
+		}
+		return n
+	}
+	for p := range i.m {
+		if n := depth(p); n > s.LongestChain {
+			s.LongestChain = n
+		}
+	}
+	return s
+}
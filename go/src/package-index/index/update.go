@@ -0,0 +1,86 @@
+package index
+
+// Updater is implemented by indexes that can change the dependencies of an
+// indexed package in place.
+type Updater interface {
+	// Update atomically replaces the dependencies of pkg with deps, leaving
+	// the packages that depend on pkg untouched. Returns false, changing
+	// nothing, if pkg isn't indexed, if some of deps aren't indexed, or if
+	// pkg would come to depend on itself. A bare name must refer to a single
+	// indexed version.
+	Update(pkg string, deps map[string]struct{}) (ok bool)
+}
+
+// Update implements Updater. Besides resolving deps, it costs O(n + e) for
+// the n transitive dependents of pkg and their e edges when deps adds a
+// dependency, which must be checked for cycles.
+func (i *index) Update(pkg string, deps map[string]struct{}) bool {
+	i.l.Lock()
+	defer i.l.Unlock()
+	ok := i.update(pkg, deps)
+	i.commit()
+	return ok
+}
+
+// update is Update without the locking and commit.
+func (i *index) update(pkg string, deps map[string]struct{}) bool {
+	pkg, ok := i.find(pkg)
+	if !ok {
+		return false
+	}
+	resolved, ok := i.resolve(deps)
+	if !ok {
+		return false
+	}
+	e := i.m[pkg]
+	var dependents map[string]struct{}
+	for _, d := range resolved {
+		if e.deps.has(d) {
+			continue
+		}
+		if d == e.id {
+			return false
+		}
+		if dependents == nil {
+			dependents = i.closure(pkg, i.rdepNames)
+		}
+		if _, ok := dependents[i.names.name(d)]; ok {
+			return false
+		}
+	}
+	i.replace(pkg, e, resolved)
+	return true
+}
+
+// replace swaps the deps of pkg, whose current entry is e, for deps, moving
+// references from the deps it drops to the ones it adds. The caller must hold
+// the write lock and must have checked that deps are indexed and do not
+// depend on pkg.
+func (i *index) replace(pkg string, e entry, deps ids) {
+	i.remember(pkg)
+	if len(deps) == 0 {
+		deps = nil
+	}
+	for _, d := range e.deps {
+		if !deps.has(d) {
+			i.unlink(e.id, i.names.name(d))
+		}
+	}
+	for _, d := range deps {
+		if !e.deps.has(d) {
+			i.link(e.id, i.names.name(d))
+		}
+	}
+	i.fanOut.move(len(e.deps), len(deps))
+	i.chain = -1
+	updated := i.m[pkg]
+	updated.deps = deps
+	i.m[pkg] = updated
+	i.record(Updated, pkg)
+	if i.journal != nil {
+		*i.journal = append(*i.journal, change{pkg: pkg, updated: true, e: e})
+	}
+	if i.wal != nil {
+		i.wal.update(pkg, updated, &i.names)
+	}
+}
@@ -0,0 +1,67 @@
+package index
+
+import (
+	"os"
+	"reflect"
+	"testing"
+)
+
+func TestUpdate(t *testing.T) {
+	i := newTestGraph(t)
+	// B -> D becomes B -> E.
+	if !i.Update("B", map[string]struct{}{"E": struct{}{}}) {
+		t.Fatal("update B failed")
+	}
+	if deps, _ := i.Deps("A"); !reflect.DeepEqual(deps, []string{"B", "C", "D", "E"}) {
+		t.Fatalf("Deps(A) = %v", deps)
+	}
+	if rdeps, _ := i.Dependents("D", false); !reflect.DeepEqual(rdeps, []string{"C"}) {
+		t.Fatalf("Dependents(D) = %v", rdeps)
+	}
+	if i.Remove("E") {
+		t.Fatal("remove E succeeded (B depends on it)")
+	}
+	if rdeps, _ := i.Dependents("B", false); !reflect.DeepEqual(rdeps, []string{"A"}) {
+		t.Fatalf("update of B lost its dependent: %v", rdeps)
+	}
+	for _, c := range []struct {
+		pkg string
+		dep string
+	}{
+		{"F", "E"}, // not indexed
+		{"B", "F"}, // dep not indexed
+		{"B", "B"}, // self
+		{"D", "A"}, // cycle
+	} {
+		if i.Update(c.pkg, map[string]struct{}{c.dep: struct{}{}}) {
+			t.Errorf("update %s -> %s succeeded", c.pkg, c.dep)
+		}
+	}
+	if !i.Update("B", nil) || !i.Remove("E") {
+		t.Fatal("dropping B's deps did not release E")
+	}
+}
+
+func TestUpdateDurable(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	i := mustOpen(t, dir)
+	i.Index("B", nil)
+	i.Index("C", nil)
+	i.Index("A", map[string]struct{}{"B": struct{}{}})
+	i.Index("X", map[string]struct{}{"A": struct{}{}})
+	if !i.(Updater).Update("A", map[string]struct{}{"C": struct{}{}}) {
+		t.Fatal("update A failed")
+	}
+	if err := i.Close(); err != nil {
+		t.Fatal(err)
+	}
+	i = mustOpen(t, dir)
+	defer i.Close()
+	if !i.Remove("B") {
+		t.Fatal("remove B failed after replaying update")
+	}
+	if i.Remove("C") || i.Remove("A") {
+		t.Fatal("replayed update lost references")
+	}
+}
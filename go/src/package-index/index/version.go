@@ -0,0 +1,286 @@
+package index
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Packages may be versioned. A versioned package is named "<name>@<version>",
+// and several versions of a package may be indexed side by side. A
+// dependency may be a plain package name or "<name>@<constraint>", and is
+// satisfied by the highest indexed version of name that matches the
+// constraint. The entry of the dependent records which version that was, so
+// that version cannot be removed out from under it. An '@' followed by
+// anything other than a constraint, as in "foo@bar", is part of the name.
+//
+// Versions follow semver, except that minor and patch may be omitted:
+// "1.1" is 1.1.0. A constraint is a space-separated list of clauses, all of
+// which must match (',' is taken by the message format). A clause is a
+// version preceded by one of the operators =, !=, >, >=, <, <=, ~ or ^. With
+// no operator, or with =, a partial version matches every version that it is
+// a prefix of, so "openssl@1" matches openssl@1.1.1; ~ allows patch updates
+// and ^ allows updates that do not change the leftmost non-zero component.
+
+// Version is a parsed semantic version.
+type Version struct {
+	Major, Minor, Patch uint64
+	// Pre holds the dot-separated pre-release identifiers, if any.
+	Pre []string
+	// parts is the number of numeric components that were given.
+	parts int
+}
+
+var (
+	errEmptyVersion    = errors.New("empty version")
+	errEmptyConstraint = errors.New("empty constraint")
+)
+
+// ParseVersion parses a version such as "1", "1.2", "1.2.3" or
+// "1.2.3-rc.1+build.5". Build metadata is accepted but ignored.
+func ParseVersion(s string) (Version, error) {
+	var v Version
+	if s == "" {
+		return v, errEmptyVersion
+	}
+	if k := strings.IndexByte(s, '+'); k >= 0 {
+		s = s[:k]
+	}
+	if k := strings.IndexByte(s, '-'); k >= 0 {
+		if k == len(s)-1 {
+			return v, fmt.Errorf("version %q: empty pre-release", s)
+		}
+		v.Pre = strings.Split(s[k+1:], ".")
+		for _, id := range v.Pre {
+			if id == "" {
+				return v, fmt.Errorf("version %q: empty pre-release identifier", s)
+			}
+		}
+		s = s[:k]
+	}
+	nums := strings.Split(s, ".")
+	if len(nums) > 3 {
+		return v, fmt.Errorf("version %q: too many components", s)
+	}
+	if v.Pre != nil && len(nums) < 3 {
+		return v, fmt.Errorf("version %q: pre-release of partial version", s)
+	}
+	dst := []*uint64{&v.Major, &v.Minor, &v.Patch}
+	for k, n := range nums {
+		x, err := strconv.ParseUint(n, 10, 64)
+		if err != nil {
+			return v, fmt.Errorf("version %q: bad component %q", s, n)
+		}
+		*dst[k] = x
+	}
+	v.parts = len(nums)
+	return v, nil
+}
+
+func (v Version) String() string {
+	s := fmt.Sprintf("%d.%d.%d", v.Major, v.Minor, v.Patch)
+	if v.Pre != nil {
+		s += "-" + strings.Join(v.Pre, ".")
+	}
+	return s
+}
+
+// Compare returns -1, 0 or 1 as v is less than, equal to or greater than w,
+// in semver precedence order. Omitted components compare as 0.
+func (v Version) Compare(w Version) int {
+	if c := compareUint(v.Major, w.Major); c != 0 {
+		return c
+	}
+	if c := compareUint(v.Minor, w.Minor); c != 0 {
+		return c
+	}
+	if c := compareUint(v.Patch, w.Patch); c != 0 {
+		return c
+	}
+	// A pre-release precedes the release.
+	switch {
+	case v.Pre == nil && w.Pre == nil:
+		return 0
+	case v.Pre == nil:
+		return 1
+	case w.Pre == nil:
+		return -1
+	}
+	for k := 0; k < len(v.Pre) && k < len(w.Pre); k++ {
+		if c := comparePreID(v.Pre[k], w.Pre[k]); c != 0 {
+			return c
+		}
+	}
+	return compareUint(uint64(len(v.Pre)), uint64(len(w.Pre)))
+}
+
+func compareUint(a, b uint64) int {
+	switch {
+	case a < b:
+		return -1
+	case a > b:
+		return 1
+	}
+	return 0
+}
+
+// comparePreID compares pre-release identifiers: numeric ones numerically,
+// others lexically, and numeric before non-numeric.
+func comparePreID(a, b string) int {
+	an, aErr := strconv.ParseUint(a, 10, 64)
+	bn, bErr := strconv.ParseUint(b, 10, 64)
+	switch {
+	case aErr == nil && bErr == nil:
+		return compareUint(an, bn)
+	case aErr == nil:
+		return -1
+	case bErr == nil:
+		return 1
+	}
+	return strings.Compare(a, b)
+}
+
+// Constraint is a parsed version constraint.
+type Constraint []clause
+
+// clause is a single comparison against a version. The operators ~, ^ and
+// partial versions are expanded into pairs of clauses at parse time.
+type clause struct {
+	op string
+	v  Version
+}
+
+// ParseConstraint parses a constraint such as ">=1.2 <2" or "^1.4".
+func ParseConstraint(s string) (Constraint, error) {
+	var c Constraint
+	for _, f := range strings.Fields(s) {
+		rest := strings.TrimLeft(f, "=!<>~^")
+		op := f[:len(f)-len(rest)]
+		v, err := ParseVersion(rest)
+		if err != nil {
+			return nil, fmt.Errorf("constraint %q: %v", s, err)
+		}
+		switch op {
+		case "", "=", "==":
+			if v.parts == 3 {
+				c = append(c, clause{"=", v})
+			} else {
+				c = append(c, clause{">=", v}, clause{"<", v.bump(v.parts - 1)})
+			}
+		case "!=", ">", ">=", "<", "<=":
+			c = append(c, clause{op, v})
+		case "~":
+			c = append(c, clause{">=", v}, clause{"<", v.bump(minInt(v.parts-1, 1))})
+		case "^":
+			k := 0
+			for k < v.parts-1 && v.component(k) == 0 {
+				k++
+			}
+			c = append(c, clause{">=", v}, clause{"<", v.bump(k)})
+		default:
+			return nil, fmt.Errorf("constraint %q: unknown operator %q", s, op)
+		}
+	}
+	if c == nil {
+		return nil, errEmptyConstraint
+	}
+	return c, nil
+}
+
+// Match reports whether v satisfies every clause of c.
+func (c Constraint) Match(v Version) bool {
+	for _, cl := range c {
+		cmp := v.Compare(cl.v)
+		var ok bool
+		switch cl.op {
+		case "=":
+			ok = cmp == 0
+		case "!=":
+			ok = cmp != 0
+		case ">":
+			ok = cmp > 0
+		case ">=":
+			ok = cmp >= 0
+		case "<":
+			ok = cmp < 0
+		case "<=":
+			ok = cmp <= 0
+		}
+		if !ok {
+			return false
+		}
+	}
+	return true
+}
+
+func (v Version) component(k int) uint64 {
+	switch k {
+	case 0:
+		return v.Major
+	case 1:
+		return v.Minor
+	}
+	return v.Patch
+}
+
+// bump returns the lowest release that is greater than every version with
+// the same first k+1 components as v.
+func (v Version) bump(k int) Version {
+	w := Version{parts: 3}
+	switch k {
+	case 0:
+		w.Major = v.Major + 1
+	case 1:
+		w.Major, w.Minor = v.Major, v.Minor+1
+	default:
+		w.Major, w.Minor, w.Patch = v.Major, v.Minor, v.Patch+1
+	}
+	return w
+}
+
+func minInt(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+// splitVersion splits "<name>@<rest>" at the last '@' if rest parses as a
+// constraint, as every version does. Otherwise the '@' is part of an
+// unversioned name, so that "foo@bar" and "@scope/pkg" can be indexed.
+func splitVersion(s string) (name, rest string, versioned bool) {
+	name, rest, _, versioned = parseVersioned(s)
+	return name, rest, versioned
+}
+
+// parseVersioned is splitVersion that also returns the parsed constraint.
+func parseVersioned(s string) (name, rest string, c Constraint, versioned bool) {
+	k := strings.LastIndexByte(s, '@')
+	if k <= 0 {
+		return s, "", nil, false
+	}
+	c, err := ParseConstraint(s[k+1:])
+	if err != nil {
+		return s, "", nil, false
+	}
+	return s[:k], s[k+1:], c, true
+}
+
+// ParsePackage parses a package name, which may be versioned. It fails for
+// a name whose suffix is a constraint but not a version, e.g. "foo@>=1".
+func ParsePackage(pkg string) (name string, v Version, versioned bool, err error) {
+	name, rest, versioned := splitVersion(pkg)
+	if versioned {
+		v, err = ParseVersion(rest)
+	}
+	return name, v, versioned, err
+}
+
+// ParseDependency parses a dependency, which may carry a constraint. c is nil
+// for a plain package name. Since a suffix that is not a constraint is part
+// of the name, every dependency parses, and err is always nil.
+func ParseDependency(dep string) (name string, c Constraint, err error) {
+	name, _, c, _ = parseVersioned(dep)
+	return name, c, nil
+}
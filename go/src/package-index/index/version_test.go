@@ -0,0 +1,157 @@
+package index
+
+import "testing"
+
+func TestVersionCompare(t *testing.T) {
+	// In ascending order.
+	ordered := []string{
+		"0.0.1", "0.1", "1.0.0-alpha", "1.0.0-alpha.1", "1.0.0-alpha.beta",
+		"1.0.0-beta", "1.0.0-beta.2", "1.0.0-beta.11", "1.0.0-rc.1", "1",
+		"1.1", "1.1.1", "1.10", "3.0",
+	}
+	for a := range ordered {
+		for b := range ordered {
+			va, err := ParseVersion(ordered[a])
+			if err != nil {
+				t.Fatal(err)
+			}
+			vb, err := ParseVersion(ordered[b])
+			if err != nil {
+				t.Fatal(err)
+			}
+			if c := va.Compare(vb); c != compareInt(a, b) {
+				t.Fatalf("Compare(%s, %s) = %d", ordered[a], ordered[b], c)
+			}
+		}
+	}
+	if v, _ := ParseVersion("1.2.3+build"); v.Compare(Version{Major: 1, Minor: 2, Patch: 3}) != 0 {
+		t.Fatal("build metadata not ignored")
+	}
+	for _, bad := range []string{"", "a", "1.2.3.4", "1.-2", "1.2-rc", "1.2.3-", "1.2.3-a..b"} {
+		if _, err := ParseVersion(bad); err == nil {
+			t.Fatalf("ParseVersion(%q) succeeded", bad)
+		}
+	}
+}
+
+func compareInt(a, b int) int {
+	return compareUint(uint64(a), uint64(b))
+}
+
+func TestConstraintMatch(t *testing.T) {
+	tcs := []struct {
+		constraint string
+		match      []string
+		noMatch    []string
+	}{
+		{"1.2.3", []string{"1.2.3"}, []string{"1.2.4", "1.2.3-rc.1"}},
+		{"1.1", []string{"1.1.0", "1.1.9"}, []string{"1.0.9", "1.2.0"}},
+		{"=1", []string{"1.0.0", "1.9.9"}, []string{"2.0.0", "0.9.9"}},
+		{">=1.2 <2", []string{"1.2.0", "1.9.0"}, []string{"1.1.9", "2.0.0"}},
+		{">1.2.3 <=1.2.5", []string{"1.2.4", "1.2.5"}, []string{"1.2.3", "1.2.6"}},
+		{"!=1.2.3", []string{"1.2.4"}, []string{"1.2.3"}},
+		{"~1.2.3", []string{"1.2.3", "1.2.9"}, []string{"1.3.0", "1.2.2"}},
+		{"~1", []string{"1.0.0", "1.9.0"}, []string{"2.0.0"}},
+		{"^1.2.3", []string{"1.2.3", "1.9.0"}, []string{"2.0.0", "1.2.2"}},
+		{"^0.2.3", []string{"0.2.3", "0.2.9"}, []string{"0.3.0"}},
+		{"^0.0.3", []string{"0.0.3"}, []string{"0.0.4"}},
+	}
+	for _, tc := range tcs {
+		c, err := ParseConstraint(tc.constraint)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, s := range tc.match {
+			v, _ := ParseVersion(s)
+			if !c.Match(v) {
+				t.Fatalf("%q does not match %s", tc.constraint, s)
+			}
+		}
+		for _, s := range tc.noMatch {
+			v, _ := ParseVersion(s)
+			if c.Match(v) {
+				t.Fatalf("%q matches %s", tc.constraint, s)
+			}
+		}
+	}
+	for _, bad := range []string{"", " ", ">>1", "1.x", "%1"} {
+		if _, err := ParseConstraint(bad); err == nil {
+			t.Fatalf("ParseConstraint(%q) succeeded", bad)
+		}
+	}
+}
+
+func TestIndexAtInName(t *testing.T) {
+	i := NewIndex()
+	// Only a constraint after the '@' makes a version.
+	for _, pkg := range []string{"foo@bar", "foo@1.x", "@scope/pkg"} {
+		if !i.Index(pkg, nil) {
+			t.Fatalf("Index(%q) failed", pkg)
+		}
+	}
+	if !i.Index("app", map[string]struct{}{"foo@bar": struct{}{}}) {
+		t.Fatal("index with a dependency on foo@bar failed")
+	}
+	if i.Query("foo") {
+		t.Fatal("foo@bar was taken for a version of foo")
+	}
+	if !i.Remove("app") || !i.Remove("foo@bar") || i.Query("foo@bar") {
+		t.Fatal("remove of foo@bar failed")
+	}
+	if i.Index("foo@>1", nil) {
+		t.Fatal("index of a package versioned with a constraint succeeded")
+	}
+}
+
+func TestIndexVersions(t *testing.T) {
+	i := NewIndex()
+	if !i.Index("openssl@1.1", nil) || !i.Index("openssl@3.0", nil) {
+		t.Fatal("index of side-by-side versions failed")
+	}
+	// Equivalent versions are the same package.
+	if !i.Index("openssl@1.1.0", nil) {
+		t.Fatal("index of equivalent version failed")
+	}
+	if !i.Query("openssl") || !i.Query("openssl@1.1.0") || i.Query("openssl@2") {
+		t.Fatal("versioned queries wrong")
+	}
+	if i.Index("curl@8.0", map[string]struct{}{"openssl@>=3.1": struct{}{}}) {
+		t.Fatal("index with unsatisfied constraint succeeded")
+	}
+	if !i.Index("curl@8.0", map[string]struct{}{"openssl@>=1.0 <3": struct{}{}}) {
+		t.Fatal("index with satisfied constraint failed")
+	}
+	// curl holds 1.1, not 3.0.
+	if !i.Remove("openssl@3.0") {
+		t.Fatal("remove of unreferenced version failed")
+	}
+	if i.Remove("openssl@1.1") {
+		t.Fatal("remove of referenced version succeeded")
+	}
+	if !i.Index("openssl@3.0", nil) {
+		t.Fatal("re-index of 3.0 failed")
+	}
+	// A bare dependency takes the highest version.
+	if !i.Index("wget", map[string]struct{}{"openssl": struct{}{}}) {
+		t.Fatal("index with bare versioned dependency failed")
+	}
+	if deps, _ := i.(Grapher).Deps("wget"); len(deps) != 1 || deps[0] != "openssl@3.0" {
+		t.Fatalf("wget deps %v, expected openssl@3.0", deps)
+	}
+	// A bare remove is all or nothing.
+	if !i.Remove("wget") {
+		t.Fatal("remove wget failed")
+	}
+	if i.Remove("openssl") {
+		t.Fatal("bare remove succeeded while a version is referenced")
+	}
+	if !i.Query("openssl@3.0") {
+		t.Fatal("failed bare remove was partially applied")
+	}
+	if !i.Remove("curl@8") || !i.Remove("openssl") {
+		t.Fatal("bare remove failed")
+	}
+	if i.Query("openssl") {
+		t.Fatal("openssl present after bare remove")
+	}
+}
@@ -0,0 +1,773 @@
+package index
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// The write-ahead log is a sequence of records. Each record holds the effects
+// of one committed mutation, so that a mutation is either replayed in full or
+// not at all:
+//
+//	record  = length crc payload
+//	payload = op...
+//	op      = opPut pkg ndeps dep... | opDel pkg |
+//	          opDefer pkg ndeps dep... | opCancel pkg |
+//	          opUpdate pkg ndeps dep... | opMark pkg flags |
+//	          opRevision pkg rev | opLease pkg expires |
+//	          opConflicts pkg nconflicts conflict... | opSequence pkg seq
+//
+// An opPut of an entry with flags set is followed by an opMark that sets
+// them, one of a leased entry by an opLease, and one of an entry that
+// declares conflicts by an opConflicts. flags is a uvarint bitmask of
+// flagAuto, flagHeld and flagEphemeral. expires is a uvarint time in Unix
+// nanoseconds, or 0 for a permanent package. opRevision only appears in
+// snapshots; see snapshot.go. The revisions of the packages a record changes
+// are not logged, as replay assigns the same ones.
+//
+// A record that changed any package ends with an opSequence, with an empty
+// pkg, holding the sequence number of the last event it published, so that
+// watchers can resume across a restart; see watch.go.
+//
+// length and crc are little-endian uint32s. crc is the Castagnoli CRC of the
+// payload. Within the payload, counts are uvarints and strings are uvarint
+// length-prefixed.
+//
+// The log records what a mutation did (the resulting entry) rather than what
+// the client asked for, so replay never has to re-run validation that depends
+// on the order in which concurrent requests happened to be serialized.
+
+const (
+	walHeaderLen = 8
+
+	opPut       byte = 1
+	opDel       byte = 2
+	opDefer     byte = 3
+	opCancel    byte = 4
+	opUpdate    byte = 5
+	opMark      byte = 6
+	opRevision  byte = 7
+	opLease     byte = 8
+	opConflicts byte = 9
+	opSequence  byte = 10
+
+	flagAuto      = 1 << 0
+	flagHeld      = 1 << 1
+	flagEphemeral = 1 << 2
+)
+
+var (
+	crcTable = crc32.MakeTable(crc32.Castagnoli)
+
+	errCorruptRecord = errors.New("corrupt record")
+)
+
+// SyncPolicy controls when the write-ahead log is flushed to stable storage.
+type SyncPolicy int
+
+const (
+	// SyncAlways fsyncs the log before acknowledging each mutation. This is
+	// the only policy under which an OK response guarantees durability.
+	SyncAlways SyncPolicy = iota
+	// SyncPeriodic fsyncs the log every Options.SyncInterval. A machine crash
+	// may lose the mutations acknowledged during the last interval; a process
+	// crash loses nothing, as every record has been handed to the OS.
+	SyncPeriodic
+	// SyncNever leaves flushing to the operating system.
+	SyncNever
+)
+
+// ParseSyncPolicy parses the flag representation of a SyncPolicy: "always",
+// "periodic", or "never".
+func ParseSyncPolicy(s string) (SyncPolicy, error) {
+	switch s {
+	case "always":
+		return SyncAlways, nil
+	case "periodic":
+		return SyncPeriodic, nil
+	case "never":
+		return SyncNever, nil
+	}
+	return 0, fmt.Errorf("unknown sync policy %q", s)
+}
+
+// Options configures a DurableIndex.
+type Options struct {
+	Sync SyncPolicy
+	// SyncInterval is the fsync period under SyncPeriodic.
+	SyncInterval time.Duration
+}
+
+// DurableIndex is an Index whose state survives restarts.
+type DurableIndex interface {
+	Index
+	// Checkpoint writes a point-in-time copy of the index to disk, a
+	// snapshot, and discards the log that it supersedes, bounding the work
+	// done by the next open.
+	Checkpoint() error
+	// Close flushes and closes the write-ahead log. The index must not be
+	// used after Close.
+	Close() error
+}
+
+// OpenIndex opens the index stored in dir, creating dir if it does not
+// exist. Every successful mutation is appended to a write-ahead log in dir
+// before it is acknowledged. On open, the newest valid snapshot is loaded and
+// the log written since it was taken is replayed. A torn record at the end of
+// the log, as left by a crash mid-write, is discarded. Then the ephemeral
+// packages of the previous run are removed; see EphemeralIndexer.
+func OpenIndex(dir string, opts Options) (DurableIndex, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, fmt.Errorf("OpenIndex: %v", err)
+	}
+	i, gen, err := recoverIndex(dir, false)
+	if err != nil {
+		return nil, fmt.Errorf("OpenIndex: %v", err)
+	}
+	f, err := openSegment(dir, gen)
+	if err != nil {
+		return nil, fmt.Errorf("OpenIndex: %v", err)
+	}
+	i.wal = newWAL(dir, gen, f, opts)
+	i.l.Lock()
+	i.dropEphemeral()
+	// This also starts the reaper if anything is leased.
+	i.commit()
+	i.l.Unlock()
+	return i, nil
+}
+
+// LoadIndex reads the index stored in dir as OpenIndex would, removing
+// ephemeral packages, but without modifying dir, so that it can be used on
+// the data of a stopped server, e.g. to export it. The index it returns is
+// in-memory: its mutations are not logged, and the reaper does not start
+// until one is made.
+func LoadIndex(dir string) (Index, error) {
+	i, _, err := recoverIndex(dir, true)
+	if err != nil {
+		return nil, fmt.Errorf("LoadIndex: %v", err)
+	}
+	i.l.Lock()
+	defer i.l.Unlock()
+	i.dropEphemeral()
+	// Like a replayed record, the removals make a revision but are not
+	// published.
+	i.applied()
+	return i, nil
+}
+
+// recoverIndex rebuilds the index from the newest valid snapshot in dir and
+// the log segments that follow it, and returns it along with the generation
+// of the last segment, which is where new records belong. If readOnly is set
+// it leaves dir as it is, including a torn record at the end of the log.
+func recoverIndex(dir string, readOnly bool) (*index, uint64, error) {
+	snaps, segs, err := listGenerations(dir, !readOnly)
+	if err != nil {
+		return nil, 0, err
+	}
+	var i *index
+	base := firstGen
+	for k := len(snaps) - 1; k >= 0 && i == nil; k-- {
+		i, err = loadSnapshot(filepath.Join(dir, snapshotName(snaps[k])))
+		if err != nil {
+			log.Printf("index: skipping snapshot %d: %v", snaps[k], err)
+			continue
+		}
+		base = snaps[k]
+	}
+	if i == nil {
+		i = newIndex()
+	}
+	// Segments older than the snapshot are left over from a crash between
+	// writing the snapshot and cleaning up after it.
+	for len(segs) > 0 && segs[0] < base {
+		segs = segs[1:]
+	}
+	if len(segs) == 0 {
+		return i, base, nil
+	}
+	if segs[0] != base {
+		return nil, 0, fmt.Errorf("log segments %d through %d are missing", base, segs[0]-1)
+	}
+	for k, gen := range segs {
+		if gen != base+uint64(k) {
+			return nil, 0, fmt.Errorf("log segment %d is missing", base+uint64(k))
+		}
+		last := k == len(segs)-1
+		if err := replaySegment(dir, gen, last, readOnly, i.apply, i.applied); err != nil {
+			return nil, 0, fmt.Errorf("log segment %d: %v", gen, err)
+		}
+	}
+	// Replay neither promotes nor publishes; see apply.
+	i.arrived, i.unpublished = nil, nil
+	i.forget()
+	return i, segs[len(segs)-1], nil
+}
+
+// replaySegment replays the log segment of generation gen. Only the last
+// segment may end in a torn record, which is truncated away unless readOnly
+// is set; earlier segments were complete when the log moved past them.
+func replaySegment(dir string, gen uint64, last, readOnly bool, fn func(walOp) error, endRecord func()) error {
+	mode := os.O_RDWR
+	if readOnly {
+		mode = os.O_RDONLY
+	}
+	f, err := os.OpenFile(filepath.Join(dir, segmentName(gen)), mode, 0)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	end, err := replayWAL(f, fn, endRecord)
+	if err != nil {
+		return err
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	if end == fi.Size() {
+		return nil
+	}
+	if !last {
+		return fmt.Errorf("record at offset %d is torn", end)
+	}
+	if readOnly {
+		return nil
+	}
+	if err := f.Truncate(end); err != nil {
+		return err
+	}
+	return f.Sync()
+}
+
+// openSegment opens the log segment of generation gen for appending,
+// creating it if necessary.
+func openSegment(dir string, gen uint64) (*os.File, error) {
+	f, err := os.OpenFile(filepath.Join(dir, segmentName(gen)), os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, err
+	}
+	if err := syncDir(dir); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return f, nil
+}
+
+// Close implements DurableIndex. It is a no-op for an in-memory index. The
+// reaper of a durable index is stopped, leaving its leases to be reaped once
+// it is reopened.
+func (i *index) Close() error {
+	i.l.Lock()
+	defer i.l.Unlock()
+	if i.wal == nil {
+		return nil
+	}
+	i.leases, i.blocked = nil, nil
+	if i.reaping {
+		i.wakeReaper()
+	}
+	err := i.wal.close()
+	i.wal = nil
+	return err
+}
+
+// apply replays a logged op. Unlike Index and Remove it does not tolerate
+// no-ops: the log only records mutations that happened, so an op that does
+// not apply cleanly means the log does not describe this index.
+//
+// Promotions of deferred packages are logged as the puts they made, so replay
+// does not promote anything itself. Nor are replayed mutations published to
+// watchers, but the sequence number of the last event is restored, so that a
+// watcher of a previous run that has seen every event can resume.
+func (i *index) apply(o walOp) error {
+	switch o.kind {
+	case opDel:
+		e, ok := i.m[o.pkg]
+		if !ok {
+			return fmt.Errorf("remove of unindexed package %q", o.pkg)
+		}
+		i.delete(o.pkg, e)
+	case opPut:
+		if _, ok := i.m[o.pkg]; ok {
+			return fmt.Errorf("index of indexed package %q", o.pkg)
+		}
+		for d := range o.deps {
+			if _, ok := i.m[d]; !ok {
+				return fmt.Errorf("index of %q with unindexed dependency %q", o.pkg, d)
+			}
+		}
+		o.e.deps, _ = i.resolve(o.deps)
+		i.insert(o.pkg, o.e)
+		if _, ok := i.deferred[o.pkg]; ok {
+			i.undefer(o.pkg)
+		}
+	case opUpdate:
+		e, ok := i.m[o.pkg]
+		if !ok {
+			return fmt.Errorf("update of unindexed package %q", o.pkg)
+		}
+		for d := range o.deps {
+			if _, ok := i.m[d]; !ok {
+				return fmt.Errorf("update of %q with unindexed dependency %q", o.pkg, d)
+			}
+		}
+		deps, _ := i.resolve(o.deps)
+		i.replace(o.pkg, e, deps)
+	case opMark:
+		if _, ok := i.m[o.pkg]; !ok {
+			return fmt.Errorf("mark of unindexed package %q", o.pkg)
+		}
+		i.mark(o.pkg, o.e.auto)
+		i.hold(o.pkg, o.e.held)
+		// A package is ephemeral from the start, so only the opMark
+		// following its opPut sets this.
+		e := i.m[o.pkg]
+		e.owner = o.e.owner
+		i.m[o.pkg] = e
+	case opLease:
+		if _, ok := i.m[o.pkg]; !ok {
+			return fmt.Errorf("lease of unindexed package %q", o.pkg)
+		}
+		i.lease(o.pkg, o.e.expires)
+	case opConflicts:
+		e, ok := i.m[o.pkg]
+		if !ok || len(e.conflicts) > 0 {
+			return fmt.Errorf("conflicts of package %q that was not just indexed", o.pkg)
+		}
+		e.conflicts = o.e.conflicts
+		i.m[o.pkg] = e
+		i.declare(o.pkg, e)
+	case opSequence:
+		i.feed.seq = o.rev
+	case opDefer:
+		i.park(o.pkg, o.deps)
+	case opCancel:
+		if _, ok := i.deferred[o.pkg]; !ok {
+			return fmt.Errorf("cancel of package %q that is not deferred", o.pkg)
+		}
+		i.undefer(o.pkg)
+	}
+	return nil
+}
+
+// applied is called after the ops of each replayed record have been applied.
+// Like commit, it makes a new revision of a record that changed any package.
+func (i *index) applied() {
+	if len(i.unpublished) > 0 {
+		i.rev++
+		i.stamp()
+		i.unpublished = i.unpublished[:0]
+	}
+}
+
+type walOp struct {
+	kind byte
+	pkg  string
+	// e holds the flags of the entry for an opMark, its expiry for an
+	// opLease and its conflicts for an opConflicts.
+	e entry
+	// deps holds the dependencies of an opPut or opUpdate, or the requested
+	// ones of an opDefer. Unlike those of an entry they are names, which
+	// the index interns as it applies the op.
+	deps map[string]struct{}
+	// rev is the revision of an opRevision, or the sequence number of an
+	// opSequence.
+	rev uint64
+}
+
+// wal appends records to the current log segment. put, del, commit and
+// rotate are called with the index write lock held, which serializes them; mu
+// only guards f against the background syncer.
+type wal struct {
+	dir    string
+	policy SyncPolicy
+	// buf holds the header and payload of the record being built.
+	buf []byte
+
+	mu sync.Mutex
+	// gen is the generation of the segment f.
+	gen    uint64
+	f      *os.File
+	closed chan struct{}
+	done   chan struct{}
+}
+
+func newWAL(dir string, gen uint64, f *os.File, opts Options) *wal {
+	w := &wal{
+		dir:    dir,
+		policy: opts.Sync,
+		buf:    make([]byte, walHeaderLen, 512),
+		gen:    gen,
+		f:      f,
+	}
+	if w.policy == SyncPeriodic {
+		w.closed = make(chan struct{})
+		w.done = make(chan struct{})
+		go w.syncPeriodically(opts.SyncInterval)
+	}
+	return w
+}
+
+func (w *wal) put(pkg string, e entry, n *names) {
+	w.buf = appendPut(w.buf, pkg, e, n)
+}
+
+// appendPut encodes an opPut op, and an opMark if e has flags set. Only the
+// fields of e that are not derived from other entries are recorded. n holds
+// the names of e's deps.
+func appendPut(b []byte, pkg string, e entry, n *names) []byte {
+	b = appendIDs(append(b, opPut), pkg, e.deps, n)
+	if flags(e) != 0 {
+		b = appendMark(b, pkg, e)
+	}
+	if e.expires != 0 {
+		b = appendLease(b, pkg, e)
+	}
+	if len(e.conflicts) > 0 {
+		b = appendDeps(append(b, opConflicts), pkg, e.conflicts)
+	}
+	return b
+}
+
+// appendMark encodes an opMark op.
+func appendMark(b []byte, pkg string, e entry) []byte {
+	b = append(b, opMark)
+	b = appendString(b, pkg)
+	return appendUvarint(b, flags(e))
+}
+
+// appendLease encodes an opLease op.
+func appendLease(b []byte, pkg string, e entry) []byte {
+	b = append(b, opLease)
+	b = appendString(b, pkg)
+	return appendUvarint(b, uint64(e.expires))
+}
+
+func flags(e entry) uint64 {
+	var f uint64
+	if e.auto {
+		f |= flagAuto
+	}
+	if e.held {
+		f |= flagHeld
+	}
+	if e.owner != 0 {
+		f |= flagEphemeral
+	}
+	return f
+}
+
+// appendRevision encodes an opRevision op.
+func appendRevision(b []byte, pkg string, rev uint64) []byte {
+	b = append(b, opRevision)
+	b = appendString(b, pkg)
+	return appendUvarint(b, rev)
+}
+
+// appendSequence encodes an opSequence op.
+func appendSequence(b []byte, seq uint64) []byte {
+	b = append(b, opSequence)
+	b = appendString(b, "")
+	return appendUvarint(b, seq)
+}
+
+// appendDefer encodes an opDefer op.
+func appendDefer(b []byte, pkg string, deps map[string]struct{}) []byte {
+	return appendDeps(append(b, opDefer), pkg, deps)
+}
+
+func appendDeps(b []byte, pkg string, deps map[string]struct{}) []byte {
+	b = appendString(b, pkg)
+	b = appendUvarint(b, uint64(len(deps)))
+	for d := range deps {
+		b = appendString(b, d)
+	}
+	return b
+}
+
+// appendIDs is appendDeps for the deps of an entry, whose names are in n.
+func appendIDs(b []byte, pkg string, deps ids, n *names) []byte {
+	b = appendString(b, pkg)
+	b = appendUvarint(b, uint64(len(deps)))
+	for _, d := range deps {
+		b = appendString(b, n.name(d))
+	}
+	return b
+}
+
+func (w *wal) del(pkg string) {
+	w.buf = append(w.buf, opDel)
+	w.buf = appendString(w.buf, pkg)
+}
+
+func (w *wal) update(pkg string, e entry, n *names) {
+	w.buf = appendIDs(append(w.buf, opUpdate), pkg, e.deps, n)
+}
+
+func (w *wal) mark(pkg string, e entry) {
+	w.buf = appendMark(w.buf, pkg, e)
+}
+
+func (w *wal) lease(pkg string, e entry) {
+	w.buf = appendLease(w.buf, pkg, e)
+}
+
+func (w *wal) sequence(seq uint64) {
+	w.buf = appendSequence(w.buf, seq)
+}
+
+func (w *wal) deferIndex(pkg string, deps map[string]struct{}) {
+	w.buf = appendDefer(w.buf, pkg, deps)
+}
+
+func (w *wal) cancel(pkg string) {
+	w.buf = append(w.buf, opCancel)
+	w.buf = appendString(w.buf, pkg)
+}
+
+// abort discards the ops added since the last commit.
+func (w *wal) abort() {
+	w.buf = w.buf[:walHeaderLen]
+}
+
+// commit writes the ops added since the last commit as a single record.
+//
+// TODO: under SyncAlways every writer waits for its own fsync while holding
+// the index lock. Group commit (sync once for all records written while the
+// previous sync was in flight) would amortize this across concurrent
+// writers, at the cost of acknowledging outside the lock.
+func (w *wal) commit() error {
+	if len(w.buf) == walHeaderLen {
+		return nil
+	}
+	payload := w.buf[walHeaderLen:]
+	binary.LittleEndian.PutUint32(w.buf[0:4], uint32(len(payload)))
+	binary.LittleEndian.PutUint32(w.buf[4:8], crc32.Checksum(payload, crcTable))
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	_, err := w.f.Write(w.buf)
+	w.buf = w.buf[:walHeaderLen]
+	if err != nil {
+		return err
+	}
+	if w.policy == SyncAlways {
+		return w.f.Sync()
+	}
+	return nil
+}
+
+// rotate starts a new log segment and returns its generation. Everything
+// committed before rotate is in earlier segments.
+func (w *wal) rotate() (uint64, error) {
+	f, err := openSegment(w.dir, w.gen+1)
+	if err != nil {
+		return 0, err
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	err = w.f.Sync()
+	if closeErr := w.f.Close(); err == nil {
+		err = closeErr
+	}
+	// Even if the old segment could not be closed cleanly, its records were
+	// written, so carry on with the new one.
+	w.f = f
+	w.gen++
+	return w.gen, err
+}
+
+func (w *wal) syncPeriodically(interval time.Duration) {
+	defer close(w.done)
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-t.C:
+			w.mu.Lock()
+			err := w.f.Sync()
+			w.mu.Unlock()
+			if err != nil {
+				log.Fatalf("index: write-ahead log: %v", err)
+			}
+		case <-w.closed:
+			return
+		}
+	}
+}
+
+func (w *wal) close() error {
+	if w.closed != nil {
+		close(w.closed)
+		<-w.done
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	err := w.f.Sync()
+	if closeErr := w.f.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// replayWAL calls fn for each op in the log held by f, in order, and
+// endRecord after the ops of each record, and returns the offset just past
+// the last intact record. A torn record is only tolerated at the end of f; a
+// bad record followed by more data means the log is corrupt, and we refuse to
+// guess which parts of it to believe.
+func replayWAL(f *os.File, fn func(walOp) error, endRecord func()) (int64, error) {
+	fi, err := f.Stat()
+	if err != nil {
+		return 0, err
+	}
+	size := fi.Size()
+	r := bufio.NewReader(f)
+	var off int64
+	var header [walHeaderLen]byte
+	var payload []byte
+	for {
+		_, err := io.ReadFull(r, header[:])
+		if err == io.EOF {
+			return off, nil
+		}
+		if err == io.ErrUnexpectedEOF {
+			log.Printf("index: discarding torn record at offset %d", off)
+			return off, nil
+		}
+		if err != nil {
+			return 0, err
+		}
+		n := int64(binary.LittleEndian.Uint32(header[0:4]))
+		end := off + walHeaderLen + n
+		if end > size {
+			log.Printf("index: discarding torn record at offset %d", off)
+			return off, nil
+		}
+		if int64(cap(payload)) < n {
+			payload = make([]byte, n)
+		}
+		payload = payload[:n]
+		if _, err := io.ReadFull(r, payload); err != nil {
+			return 0, err
+		}
+		if crc32.Checksum(payload, crcTable) != binary.LittleEndian.Uint32(header[4:8]) {
+			if end == size {
+				log.Printf("index: discarding torn record at offset %d", off)
+				return off, nil
+			}
+			return 0, fmt.Errorf("record at offset %d: checksum mismatch", off)
+		}
+		if err := decodeWALRecord(payload, fn); err != nil {
+			return 0, fmt.Errorf("record at offset %d: %v", off, err)
+		}
+		endRecord()
+		off = end
+	}
+}
+
+func decodeWALRecord(b []byte, fn func(walOp) error) error {
+	for len(b) > 0 {
+		o := walOp{kind: b[0]}
+		b = b[1:]
+		var ok bool
+		if o.pkg, b, ok = readString(b); !ok {
+			return errCorruptRecord
+		}
+		switch o.kind {
+		case opDel, opCancel:
+		case opMark:
+			f, m := binary.Uvarint(b)
+			if m <= 0 {
+				return errCorruptRecord
+			}
+			b = b[m:]
+			o.e.auto = f&flagAuto != 0
+			o.e.held = f&flagHeld != 0
+			if f&flagEphemeral != 0 {
+				// The sessions that owned it did not survive.
+				o.e.owner = previousRun
+			}
+		case opLease:
+			x, m := binary.Uvarint(b)
+			if m <= 0 {
+				return errCorruptRecord
+			}
+			b = b[m:]
+			o.e.expires = int64(x)
+		case opRevision, opSequence:
+			r, m := binary.Uvarint(b)
+			if m <= 0 {
+				return errCorruptRecord
+			}
+			b = b[m:]
+			o.rev = r
+		case opPut, opDefer, opUpdate, opConflicts:
+			n, m := binary.Uvarint(b)
+			if m <= 0 || n > uint64(len(b)) {
+				return errCorruptRecord
+			}
+			b = b[m:]
+			if n > 0 {
+				o.deps = make(map[string]struct{}, n)
+			}
+			for ; n > 0; n-- {
+				var d string
+				if d, b, ok = readString(b); !ok {
+					return errCorruptRecord
+				}
+				o.deps[d] = struct{}{}
+			}
+			if o.kind == opConflicts {
+				o.e.conflicts, o.deps = o.deps, nil
+			}
+		default:
+			return errCorruptRecord
+		}
+		if err := fn(o); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// syncDir makes the creation of files in dir durable.
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	err = d.Sync()
+	if closeErr := d.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+func appendUvarint(b []byte, x uint64) []byte {
+	var scratch [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(scratch[:], x)
+	return append(b, scratch[:n]...)
+}
+
+func appendString(b []byte, s string) []byte {
+	b = appendUvarint(b, uint64(len(s)))
+	return append(b, s...)
+}
+
+func readString(b []byte) (string, []byte, bool) {
+	n, m := binary.Uvarint(b)
+	if m <= 0 || n > uint64(len(b)-m) {
+		return "", nil, false
+	}
+	b = b[m:]
+	return string(b[:n]), b[n:], true
+}
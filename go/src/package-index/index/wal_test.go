@@ -0,0 +1,169 @@
+package index
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func tempDir(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "index")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return dir
+}
+
+func mustOpen(t *testing.T, dir string) DurableIndex {
+	i, err := OpenIndex(dir, Options{Sync: SyncAlways})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return i
+}
+
+func TestOpenIndexReplay(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	i := mustOpen(t, dir)
+	if !i.Index("B", nil) {
+		t.Fatal("index B failed")
+	}
+	if !i.Index("A", map[string]struct{}{"B": struct{}{}}) {
+		t.Fatal("index A failed")
+	}
+	if !i.Index("C", nil) {
+		t.Fatal("index C failed")
+	}
+	if !i.Remove("C") {
+		t.Fatal("remove C failed")
+	}
+	if err := i.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	i = mustOpen(t, dir)
+	defer i.Close()
+	if !i.Query("A") || !i.Query("B") {
+		t.Fatal("A or B missing after replay")
+	}
+	if i.Query("C") {
+		t.Fatal("C present after replay")
+	}
+	if i.Remove("B") {
+		t.Fatal("remove B succeeded after replay (A depends on it)")
+	}
+}
+
+func TestOpenIndexTornRecord(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	i := mustOpen(t, dir)
+	i.Index("A", nil)
+	i.Index("B", map[string]struct{}{"A": struct{}{}})
+	if err := i.Close(); err != nil {
+		t.Fatal(err)
+	}
+	// Simulate a crash part way through writing the record for B.
+	path := filepath.Join(dir, segmentName(firstGen))
+	fi, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Truncate(path, fi.Size()-1); err != nil {
+		t.Fatal(err)
+	}
+
+	i = mustOpen(t, dir)
+	if !i.Query("A") {
+		t.Fatal("A missing after torn record")
+	}
+	if i.Query("B") {
+		t.Fatal("torn record for B was replayed")
+	}
+	// The torn record must be gone, not merely skipped, or records written
+	// after it would be unreachable.
+	i.Index("C", nil)
+	if err := i.Close(); err != nil {
+		t.Fatal(err)
+	}
+	i = mustOpen(t, dir)
+	defer i.Close()
+	if !i.Query("C") {
+		t.Fatal("C missing after reopen")
+	}
+}
+
+func TestOpenIndexCorrupt(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	i := mustOpen(t, dir)
+	i.Index("A", nil)
+	i.Index("B", nil)
+	if err := i.Close(); err != nil {
+		t.Fatal(err)
+	}
+	// Flip a byte in the payload of the first record.
+	path := filepath.Join(dir, segmentName(firstGen))
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b[walHeaderLen+1] ^= 0xff
+	if err := ioutil.WriteFile(path, b, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := OpenIndex(dir, Options{}); err == nil {
+		t.Fatal("open of corrupt log succeeded")
+	}
+}
+
+func TestLoadIndex(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	i := mustOpen(t, dir)
+	i.Index("A", nil)
+	i.(EphemeralIndexer).IndexEphemeral("E", nil, 1)
+	i.Index("B", map[string]struct{}{"A": struct{}{}})
+	if err := i.Close(); err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(dir, segmentName(firstGen))
+	fi, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Truncate(path, fi.Size()-1); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, snapshotName(2)+".tmp"), nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	before, err := ioutil.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	l, err := LoadIndex(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !l.Query("A") || l.Query("B") || l.Query("E") {
+		t.Fatal("LoadIndex did not load A alone")
+	}
+	after, err := ioutil.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(after) != len(before) {
+		t.Fatalf("LoadIndex changed the files in dir from %d to %d", len(before), len(after))
+	}
+	for k := range before {
+		if after[k].Name() != before[k].Name() || after[k].Size() != before[k].Size() {
+			t.Fatalf("LoadIndex changed %s", before[k].Name())
+		}
+	}
+	if _, err := LoadIndex(filepath.Join(dir, "missing")); err == nil {
+		t.Fatal("LoadIndex of a missing directory succeeded")
+	}
+}
@@ -0,0 +1,139 @@
+package index
+
+import (
+	"errors"
+	"sync"
+)
+
+// Watcher is implemented by indexes that publish a feed of the changes made
+// by committed mutations.
+type Watcher interface {
+	// Events returns the events after sequence number since, oldest first.
+	// If there are none yet it waits until there are, or until cancel is
+	// closed, in which case it returns nil. It returns ErrEventsLost if some
+	// of the events after since are no longer retained, in which case the
+	// caller has to find out the state of the index some other way.
+	Events(since uint64, cancel <-chan struct{}) ([]Event, error)
+	// LastSeq returns the sequence number of the latest event, or 0 if there
+	// have been none.
+	LastSeq() uint64
+}
+
+// Event records a change to a single package. The events of a mutation
+// are published together, once it has been committed, in the order the
+// changes were made.
+type Event struct {
+	// Seq numbers events from 1, without gaps.
+	Seq     uint64
+	Kind    EventKind
+	Package string
+}
+
+type EventKind int
+
+const (
+	Indexed EventKind = iota + 1
+	Removed
+	Updated
+)
+
+func (k EventKind) String() string {
+	switch k {
+	case Indexed:
+		return "INDEXED"
+	case Removed:
+		return "REMOVED"
+	case Updated:
+		return "UPDATED"
+	}
+	return "UNKNOWN"
+}
+
+// ErrEventsLost is returned by Events when asked for events that have been
+// discarded.
+var ErrEventsLost = errors.New("events lost")
+
+// eventRetention is the number of past events kept for watchers that fall
+// behind or reconnect.
+const eventRetention = 4096
+
+// Events implements Watcher.
+func (i *index) Events(since uint64, cancel <-chan struct{}) ([]Event, error) {
+	return i.feed.wait(since, cancel)
+}
+
+// LastSeq implements Watcher.
+func (i *index) LastSeq() uint64 {
+	i.feed.mu.Lock()
+	defer i.feed.mu.Unlock()
+	return i.feed.seq
+}
+
+// record notes a change, to be published by the next commit. The caller must
+// hold the write lock.
+func (i *index) record(kind EventKind, pkg string) {
+	i.unpublished = append(i.unpublished, Event{Kind: kind, Package: pkg})
+}
+
+// feed retains the most recent events in a ring. Publishing never waits for
+// watchers: they copy events out at their own pace, and one that falls more
+// than eventRetention events behind loses its place.
+type feed struct {
+	mu sync.Mutex
+	// ring holds the retained events, the oldest at ring[start].
+	ring  []Event
+	start int
+	// seq is the sequence number of the latest event.
+	seq uint64
+	// wake is closed, and replaced, when events are published.
+	wake chan struct{}
+}
+
+// publish numbers and retains evs and wakes the waiting watchers.
+func (f *feed) publish(evs []Event) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for _, ev := range evs {
+		f.seq++
+		ev.Seq = f.seq
+		if len(f.ring) < eventRetention {
+			f.ring = append(f.ring, ev)
+			continue
+		}
+		f.ring[f.start] = ev
+		f.start = (f.start + 1) % len(f.ring)
+	}
+	if f.wake != nil {
+		close(f.wake)
+		f.wake = nil
+	}
+}
+
+func (f *feed) wait(since uint64, cancel <-chan struct{}) ([]Event, error) {
+	f.mu.Lock()
+	for since == f.seq {
+		if f.wake == nil {
+			f.wake = make(chan struct{})
+		}
+		wake := f.wake
+		f.mu.Unlock()
+		select {
+		case <-wake:
+		case <-cancel:
+			return nil, nil
+		}
+		f.mu.Lock()
+	}
+	defer f.mu.Unlock()
+	// The events after base are retained; after a restart, none are. A
+	// since ahead of seq comes from records lost in a crash.
+	base := f.seq - uint64(len(f.ring))
+	if since > f.seq || since < base {
+		return nil, ErrEventsLost
+	}
+	evs := make([]Event, 0, f.seq-since)
+	for k := int(since - base); k < len(f.ring); k++ {
+		evs = append(evs, f.ring[(f.start+k)%len(f.ring)])
+	}
+	return evs, nil
+}
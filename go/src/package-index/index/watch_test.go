@@ -0,0 +1,108 @@
+package index
+
+import (
+	"os"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestEvents(t *testing.T) {
+	i := newIndex()
+	i.Index("B", nil)
+	i.Index("A", map[string]struct{}{"B": struct{}{}})
+	i.Index("A", nil) // no-op
+	i.Update("A", nil)
+	i.Purge("B")
+	i.IndexOrDefer("D", map[string]struct{}{"C": struct{}{}})
+	i.Index("C", nil)
+	if i.LastSeq() != 6 {
+		t.Fatalf("LastSeq() = %d, want 6", i.LastSeq())
+	}
+	evs, err := i.Events(2, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []Event{
+		{3, Updated, "A"},
+		{4, Removed, "B"},
+		{5, Indexed, "C"},
+		{6, Indexed, "D"},
+	}
+	if !reflect.DeepEqual(evs, want) {
+		t.Fatalf("Events(2) = %v, want %v", evs, want)
+	}
+	// A failed batch publishes nothing.
+	i.Batch([]Op{{Package: "E"}, {Package: "F", Dependencies: map[string]struct{}{"G": struct{}{}}}})
+	if i.LastSeq() != 6 {
+		t.Fatal("failed batch published events")
+	}
+}
+
+func TestEventsWait(t *testing.T) {
+	i := newIndex()
+	cancel := make(chan struct{})
+	close(cancel)
+	if evs, err := i.Events(0, cancel); evs != nil || err != nil {
+		t.Fatalf("Events with cancel closed = %v, %v", evs, err)
+	}
+	got := make(chan []Event)
+	go func() {
+		evs, _ := i.Events(0, nil)
+		got <- evs
+	}()
+	time.Sleep(10 * time.Millisecond)
+	i.Index("A", nil)
+	if evs := <-got; len(evs) != 1 || evs[0].Package != "A" {
+		t.Fatalf("waiting Events = %v", evs)
+	}
+}
+
+func TestEventsLost(t *testing.T) {
+	i := newIndex()
+	for k := 0; k < eventRetention+1; k++ {
+		i.Index("A", nil)
+		i.Remove("A")
+	}
+	if _, err := i.Events(1, nil); err != ErrEventsLost {
+		t.Fatalf("Events(1) error = %v, want ErrEventsLost", err)
+	}
+	if _, err := i.Events(i.LastSeq()+1, nil); err != ErrEventsLost {
+		t.Fatalf("Events from the future error = %v, want ErrEventsLost", err)
+	}
+	evs, err := i.Events(i.LastSeq()-eventRetention, nil)
+	if err != nil || len(evs) != eventRetention {
+		t.Fatalf("Events of whole ring = %d events, %v", len(evs), err)
+	}
+	if evs[len(evs)-1].Seq != i.LastSeq() {
+		t.Fatal("ring out of order")
+	}
+}
+
+func TestEventsDurable(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	d := mustOpen(t, dir)
+	d.Index("A", nil)
+	d.Index("B", nil)
+	if err := d.Checkpoint(); err != nil {
+		t.Fatal(err)
+	}
+	d.Index("C", nil)
+	d.Close()
+	d = mustOpen(t, dir)
+	defer d.Close()
+	w := d.(Watcher)
+	if w.LastSeq() != 3 {
+		t.Fatalf("LastSeq() = %d after reopen, want 3", w.LastSeq())
+	}
+	// A watcher that saw every event resumes; one that missed some fails.
+	if _, err := w.Events(2, nil); err != ErrEventsLost {
+		t.Fatalf("Events(2) error = %v after reopen, want ErrEventsLost", err)
+	}
+	d.Index("D", nil)
+	evs, err := w.Events(3, nil)
+	if err != nil || !reflect.DeepEqual(evs, []Event{{4, Indexed, "D"}}) {
+		t.Fatalf("Events(3) = %v, %v after reopen", evs, err)
+	}
+}
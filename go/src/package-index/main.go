@@ -1,11 +1,15 @@
 package main
 
 import (
+	"bufio"
 	"flag"
+	"io/ioutil"
 	"log"
 	"os"
+	"package-index/catalog"
 	"package-index/index"
 	"package-index/server"
+	"path/filepath"
 	"time"
 )
 
@@ -14,17 +18,160 @@ func main() {
 	flag.StringVar(&srv.Addr, "addr", ":8080", "TCP address to listen on")
 	flag.IntVar(&srv.MaxConns, "max-conns", 300, "Maximum number of concurrent connections")
 	flag.IntVar(&srv.MaxMessageSize, "max-message-size", 2048, "Maximum message size; server will respond with ERROR when exceeded")
+	flag.IntVar(&srv.MaxBatchSize, "max-batch-size", 1000, "Maximum number of INDEX and REMOVE messages in a BEGIN/COMMIT batch")
 	flag.DurationVar(&srv.ConnReadTimeout, "conn-read-timeout", 30*time.Second, "If the client does not send a message for longer than this the server will close the connection")
 	flag.DurationVar(&srv.ConnWriteTimeout, "conn-write-timeout", 5*time.Second, "If the client does not accept a response for longer than this the server will close the connection")
 	flag.DurationVar(&srv.AcceptDelay, "accept-delay", time.Second, "Time to wait before retrying Accept after a temporary network error.")
 	flag.DurationVar(&srv.ConnReadDelay, "conn-read-delay", time.Second, "Time to wait before retrying Read after a temporary network error.")
+	dataDir := flag.String("data-dir", "", "Directory in which to persist the index; if empty the index is held in memory only")
+	syncPolicy := flag.String("fsync", "always", "When to fsync the write-ahead log: always, periodic, or never")
+	syncInterval := flag.Duration("fsync-interval", time.Second, "fsync period when -fsync=periodic")
+	impl := flag.String("index", "locked", "Index implementation: locked (supports everything), or one of the in-memory alternatives sharded (scales with concurrent writers) or lockfree (QUERY never blocks), which support only INDEX, REMOVE and QUERY of unversioned packages")
+	shards := flag.Int("shards", 64, "Number of shards for -index=sharded")
+	snapshotInterval := flag.Duration("snapshot-interval", 10*time.Minute, "How often to snapshot the index and compact the write-ahead log; 0 disables snapshots")
+	autoCreate := flag.Bool("auto-create-namespaces", false, "Create namespaces on first use rather than only with CREATE")
+	catalogPath := flag.String("catalog", "", "File of available packages and their dependencies, in the format of brew-dependencies.txt, for PLAN")
+	retention := flag.Duration("revision-retention", index.DefaultRetention, "How long a superseded revision stays readable by QUERY and DEPS; keeping history slows every mutation, and 0 keeps none")
+	leaseCascade := flag.Bool("lease-cascade", false, "When the lease of a package that others depend on expires, remove them too rather than waiting for them to be removed")
+	export := flag.Bool("export", false, "Write the index in -data-dir to stdout as INDEX and AUTOINDEX messages, each after those of its dependencies, and exit, leaving -data-dir unmodified; the server must not be running")
 	flag.Parse()
-	srv.Index = index.NewIndex()
+	if *export && *dataDir == "" {
+		log.Printf("-export requires -data-dir")
+		os.Exit(2)
+	}
+	if *impl != "locked" && *dataDir != "" {
+		log.Printf("-data-dir requires -index=locked")
+		os.Exit(2)
+	}
+	switch *impl {
+	case "locked", "sharded", "lockfree":
+	default:
+		log.Printf("-index: unknown implementation %q", *impl)
+		os.Exit(2)
+	}
+	policy, err := index.ParseSyncPolicy(*syncPolicy)
+	if err != nil {
+		log.Printf("-fsync: %v", err)
+		os.Exit(2)
+	}
+	// newIndex creates an index of the selected implementation, persisted
+	// in dir unless dir is empty.
+	newIndex := func(dir string) (index.Index, error) {
+		var idx index.Index
+		switch {
+		case *impl == "sharded":
+			return index.NewShardedIndex(*shards), nil
+		case *impl == "lockfree":
+			return index.NewLockFreeIndex(), nil
+		case dir == "":
+			idx = index.NewIndex()
+		default:
+			var err error
+			idx, err = index.OpenIndex(dir, index.Options{Sync: policy, SyncInterval: *syncInterval})
+			if err != nil {
+				return nil, err
+			}
+		}
+		idx.(index.Historian).SetRetention(*retention)
+		idx.(index.Leaser).SetLeaseCascade(*leaseCascade)
+		return idx, nil
+	}
+	if *export {
+		idx, err := index.LoadIndex(*dataDir)
+		if err == nil {
+			w := bufio.NewWriter(os.Stdout)
+			err = server.WriteExport(w, idx)
+			if err == nil {
+				err = w.Flush()
+			}
+		}
+		if err != nil {
+			log.Printf("-export: %v", err)
+			os.Exit(1)
+		}
+		return
+	}
+	srv.Index, err = newIndex(*dataDir)
+	if err != nil {
+		log.Printf("OpenIndex: %v", err)
+		os.Exit(1)
+	}
+	// Namespaces other than the default one live in subdirectories of the
+	// data directory.
+	nsDir := ""
+	if *dataDir != "" {
+		nsDir = filepath.Join(*dataDir, "namespaces")
+	}
+	srv.Namespaces = &server.Namespaces{
+		New: func(name string) (index.Index, error) {
+			if nsDir == "" {
+				return newIndex("")
+			}
+			return newIndex(filepath.Join(nsDir, name))
+		},
+		AutoCreate: *autoCreate,
+	}
+	if nsDir != "" {
+		if err := openNamespaces(srv.Namespaces, nsDir); err != nil {
+			log.Printf("opening namespaces: %v", err)
+			os.Exit(1)
+		}
+	}
+	if *catalogPath != "" {
+		srv.Catalog, err = catalog.Load(*catalogPath)
+		if err != nil {
+			log.Printf("-catalog: %v", err)
+			os.Exit(1)
+		}
+	}
+	if *dataDir != "" && *snapshotInterval > 0 {
+		go checkpointPeriodically(&srv, *snapshotInterval)
+	}
 	// TODO: gracefully shut down (close listener and wait for outstanding
 	// operations to complete) on os.Interrupt signal.
-	err := srv.ListenAndServe()
+	err = srv.ListenAndServe()
 	if err != nil {
 		log.Printf("ListenAndServe: %v", err)
 		os.Exit(1)
 	}
 }
+
+// openNamespaces opens the namespaces persisted in dir.
+func openNamespaces(ns *server.Namespaces, dir string) error {
+	fis, err := ioutil.ReadDir(dir)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	for _, fi := range fis {
+		if !fi.IsDir() {
+			continue
+		}
+		if _, _, err := ns.Create(fi.Name()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// checkpointPeriodically checkpoints the durable indexes of every namespace.
+func checkpointPeriodically(srv *server.Server, interval time.Duration) {
+	for range time.Tick(interval) {
+		checkpoint("", srv.Index)
+		for _, name := range srv.Namespaces.Names() {
+			if idx, ok := srv.Namespaces.Get(name); ok {
+				checkpoint(name, idx)
+			}
+		}
+	}
+}
+
+func checkpoint(namespace string, idx index.Index) {
+	if d, ok := idx.(index.DurableIndex); ok {
+		if err := d.Checkpoint(); err != nil {
+			log.Printf("Checkpoint %q: %v", namespace, err)
+		}
+	}
+}
@@ -0,0 +1,29 @@
+package server
+
+import "package-index/index"
+
+// conditionalMutation handles INDEX@<rev>, REMOVE@<rev> and UPDATE@<rev>,
+// which apply only if the revision of the package, as returned by
+// REVISION, is still rev, and otherwise answer CONFLICT. A package that isn't
+// indexed has revision 0.
+func conditionalMutation(idx index.Index, message Message, expected uint64) []byte {
+	c, ok := idx.(index.Conditional)
+	if !ok {
+		return ErrorResponse
+	}
+	var conflict bool
+	switch message.Command {
+	case "INDEX":
+		ok, conflict = c.IndexIf(message.Package, message.Dependencies, expected)
+	case "REMOVE":
+		ok, conflict = c.RemoveIf(message.Package, expected)
+	case "UPDATE":
+		ok, conflict = c.UpdateIf(message.Package, message.Dependencies, expected)
+	default:
+		return ErrorResponse
+	}
+	if conflict {
+		return ConflictResponse
+	}
+	return okOrFail(ok)
+}
@@ -0,0 +1,70 @@
+package server
+
+import (
+	"log"
+	"net"
+	"sync/atomic"
+
+	"package-index/index"
+)
+
+// Like ZooKeeper's ephemeral nodes, a package indexed with EPHEMERAL belongs
+// to the connection that indexed it and is removed when the connection ends,
+// however it ends. The index records the owner of each ephemeral package, a
+// token that the session takes the first time it indexes one, and removes a
+// package for its owner only, so a package that another client has since
+// removed, or removed and indexed again, is left alone. Changes that leave
+// the package indexed, such as HOLD and UNHOLD, MARK, RENEW and UPDATE, do
+// not change its owner. A durable index also removes the ephemeral packages
+// whose connections ended with a restart.
+
+// owners is the last owner token handed out to a session.
+var owners uint64
+
+// ephemeralPackage is a package a session indexed with EPHEMERAL.
+type ephemeralPackage struct {
+	idx index.EphemeralIndexer
+	pkg string
+}
+
+// indexEphemeral handles an EPHEMERAL message. A package that is already
+// indexed is left as it is, and does not become the session's.
+func (sess *session) indexEphemeral(idx index.Index, message Message) []byte {
+	e, ok := idx.(index.EphemeralIndexer)
+	if !ok {
+		return ErrorResponse
+	}
+	if sess.owner == 0 {
+		sess.owner = atomic.AddUint64(&owners, 1)
+	}
+	ok, conflict := e.IndexEphemeral(message.Package, message.Dependencies, sess.owner)
+	if conflict {
+		return OKResponse
+	}
+	if !ok {
+		return FailResponse
+	}
+	sess.ephemeral = append(sess.ephemeral, ephemeralPackage{e, message.Package})
+	return OKResponse
+}
+
+// releaseEphemeral removes the ephemeral packages of a session that has
+// ended, newest first. A package can only depend on packages indexed before
+// it, so each goes before its dependencies. Packages that are held, or that
+// others have come to depend on, are kept, and those that are no longer the
+// session's are skipped, and all of these are logged.
+func (sess *session) releaseEphemeral(addr net.Addr) {
+	for k := len(sess.ephemeral) - 1; k >= 0; k-- {
+		p := sess.ephemeral[k]
+		ok, disowned, held := p.idx.RemoveEphemeral(p.pkg, sess.owner)
+		switch {
+		case disowned:
+			log.Printf("skipping ephemeral package %q of closed connection %v: another client has removed it", p.pkg, addr)
+		case held:
+			log.Printf("keeping ephemeral package %q of closed connection %v: it is held", p.pkg, addr)
+		case !ok:
+			log.Printf("keeping ephemeral package %q of closed connection %v: other packages depend on it", p.pkg, addr)
+		}
+	}
+	sess.ephemeral = nil
+}
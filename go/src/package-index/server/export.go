@@ -0,0 +1,126 @@
+package server
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"sort"
+	"strconv"
+
+	"package-index/index"
+)
+
+var errNoExport = errors.New("index does not support export")
+
+// WriteExport writes the contents of idx to w as INDEX messages, or
+// AUTOINDEX for auto-installed packages, one per line, each after those of
+// its dependencies, so that sending them in order to another server clones
+// idx; see index.Exporter.
+func WriteExport(w io.Writer, idx index.Index) error {
+	x, ok := idx.(index.Exporter)
+	if !ok {
+		return fmt.Errorf("WriteExport: %v", errNoExport)
+	}
+	var b []byte
+	for _, op := range x.Export() {
+		b = appendIndexMessage(b[:0], op)
+		if _, err := w.Write(b); err != nil {
+			return fmt.Errorf("WriteExport: %v", err)
+		}
+	}
+	return nil
+}
+
+// exportResponse answers EXPORT|| with the number of packages followed by
+// their INDEX or AUTOINDEX messages:
+//
+//	OK|<n>\n
+//	INDEX|<package>|<dependencies>[|<conflicts>]\n
+//	AUTOINDEX|<package>|<dependencies>[|<conflicts>]\n
+//	...
+func exportResponse(ops []index.Op) []byte {
+	b := []byte("OK|")
+	b = strconv.AppendInt(b, int64(len(ops)), 10)
+	b = append(b, '\n')
+	for _, op := range ops {
+		b = appendIndexMessage(b, op)
+	}
+	return b
+}
+
+// appendIndexMessage appends the INDEX message for op, or the AUTOINDEX
+// message if op.Auto is set, with its dependencies and conflicts sorted.
+func appendIndexMessage(b []byte, op index.Op) []byte {
+	deps := make([]string, 0, len(op.Dependencies))
+	for d := range op.Dependencies {
+		deps = append(deps, d)
+	}
+	sort.Strings(deps)
+	if op.Auto {
+		b = append(b, "AUTO"...)
+	}
+	b = append(b, "INDEX|"...)
+	b = append(b, op.Package...)
+	b = append(b, '|')
+	for k, d := range deps {
+		if k > 0 {
+			b = append(b, ',')
+		}
+		b = append(b, d...)
+	}
+	conflicts := make([]string, 0, len(op.Conflicts))
+	for c := range op.Conflicts {
+		conflicts = append(conflicts, c)
+	}
+	sort.Strings(conflicts)
+	for k, c := range conflicts {
+		if k > 0 {
+			b = append(b, ',')
+		} else {
+			b = append(b, '|')
+		}
+		b = append(b, c...)
+	}
+	return append(b, '\n')
+}
+
+// graph handles GRAPH||<format> and SUBGRAPH|<package>|<format>[,<depth>],
+// which render the whole graph or the one rooted at package, to the depth if
+// given, in format dot or json. The response is framed like EXPORT's, with
+// the number of lines of the rendering.
+func graph(idx index.Index, message Message) []byte {
+	x, ok := idx.(index.GraphExporter)
+	if !ok {
+		return ErrorResponse
+	}
+	format, depth, ok := parseGraphOptions(message.Dependencies)
+	if !ok {
+		return ErrorResponse
+	}
+	var g index.Graph
+	if message.Command == "GRAPH" {
+		if depth >= 0 {
+			return ErrorResponse
+		}
+		g = x.Graph()
+	} else if g, ok = x.Subgraph(message.Package, depth); !ok {
+		return FailResponse
+	}
+	var buf bytes.Buffer
+	var err error
+	if format == "dot" {
+		err = g.WriteDOT(&buf)
+	} else {
+		err = g.WriteJSON(&buf)
+	}
+	if err != nil {
+		log.Printf("graph: %v", err)
+		return ErrorResponse
+	}
+	b := []byte("OK|")
+	b = strconv.AppendInt(b, int64(bytes.Count(buf.Bytes(), []byte{'\n'})), 10)
+	b = append(b, '\n')
+	return append(b, buf.Bytes()...)
+}
@@ -0,0 +1,165 @@
+package server
+
+import (
+	"errors"
+	"sort"
+	"sync"
+
+	"package-index/index"
+)
+
+// Namespaces holds the named indexes of a multi-tenant server. Each namespace
+// is a separate index, so dependencies resolve only within a namespace. The
+// default namespace, "", is Server.Index and is not held here.
+//
+// A connection starts out in the default namespace and switches with
+// USE|<namespace>|; a single message can be directed at another namespace by
+// prefixing its command, as in "staging:INDEX|curl|openssl".
+type Namespaces struct {
+	// New creates the index of a new namespace. If it is nil, no namespace
+	// can be created.
+	New func(name string) (index.Index, error)
+	// AutoCreate makes the first use of a namespace create it. Otherwise
+	// namespaces must be created with CREATE|<namespace>| first.
+	AutoCreate bool
+
+	mu sync.RWMutex
+	m  map[string]index.Index
+}
+
+var (
+	errBadNamespace     = errors.New("namespace names are made of letters, digits, '.', '_' and '-', and start with a letter or digit")
+	errCannotCreate     = errors.New("namespaces cannot be created")
+	errNoSuchNamespace  = errors.New("no such namespace")
+	errNamespacesAbsent = errors.New("server has no namespaces")
+)
+
+// Get returns the index of namespace name, if it exists.
+func (n *Namespaces) Get(name string) (index.Index, bool) {
+	n.mu.RLock()
+	defer n.mu.RUnlock()
+	idx, ok := n.m[name]
+	return idx, ok
+}
+
+// Create returns the index of namespace name, creating it with New if it
+// does not exist yet.
+func (n *Namespaces) Create(name string) (idx index.Index, created bool, err error) {
+	if !validNamespace(name) {
+		return nil, false, errBadNamespace
+	}
+	if idx, ok := n.Get(name); ok {
+		return idx, false, nil
+	}
+	if n.New == nil {
+		return nil, false, errCannotCreate
+	}
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if idx, ok := n.m[name]; ok {
+		return idx, false, nil
+	}
+	// New runs under the lock so that a namespace is created only once.
+	// That stalls lookups of other namespaces only while one is created.
+	idx, err = n.New(name)
+	if err != nil {
+		return nil, false, err
+	}
+	if n.m == nil {
+		n.m = make(map[string]index.Index)
+	}
+	n.m[name] = idx
+	return idx, true, nil
+}
+
+// Names returns the names of the namespaces, sorted.
+func (n *Namespaces) Names() []string {
+	n.mu.RLock()
+	defer n.mu.RUnlock()
+	names := make([]string, 0, len(n.m))
+	for name := range n.m {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// validNamespace reports whether name may name a namespace. The restriction
+// lets namespaces map to directory names, and leaves "-" free to name the
+// default namespace in USE.
+func validNamespace(name string) bool {
+	if name == "" {
+		return false
+	}
+	for k := 0; k < len(name); k++ {
+		c := name[k]
+		switch {
+		case 'a' <= c && c <= 'z', 'A' <= c && c <= 'Z', '0' <= c && c <= '9':
+		case k > 0 && (c == '.' || c == '_' || c == '-'):
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// namespace returns the index of namespace name, where "" is the default
+// namespace, creating it if the server is configured to.
+func (s *Server) namespace(name string) (index.Index, error) {
+	if name == "" {
+		return s.Index, nil
+	}
+	if s.Namespaces == nil {
+		return nil, errNamespacesAbsent
+	}
+	if !s.Namespaces.AutoCreate {
+		if idx, ok := s.Namespaces.Get(name); ok {
+			return idx, nil
+		}
+		return nil, errNoSuchNamespace
+	}
+	idx, _, err := s.Namespaces.Create(name)
+	return idx, err
+}
+
+// handleNamespaceCommand handles the commands that manage namespaces:
+//
+//	USE|<namespace>|        switches the connection to a namespace, or back
+//	                        to the default one with USE|-|
+//	CREATE|<namespace>|     creates a namespace; FAIL if it already exists
+//	NAMESPACES||            lists the namespaces
+//
+// USE of a namespace that does not exist is a FAIL unless the server creates
+// namespaces on demand.
+func (s *Server) handleNamespaceCommand(sess *session, message Message) []byte {
+	if s.Namespaces == nil {
+		return ErrorResponse
+	}
+	switch message.Command {
+	case "USE":
+		if message.Package == "-" {
+			sess.namespace = ""
+			return OKResponse
+		}
+		if !validNamespace(message.Package) {
+			return ErrorResponse
+		}
+		if _, err := s.namespace(message.Package); err != nil {
+			return FailResponse
+		}
+		sess.namespace = message.Package
+		return OKResponse
+	case "CREATE":
+		_, created, err := s.Namespaces.Create(message.Package)
+		switch {
+		case err == errBadNamespace || err == errCannotCreate:
+			return ErrorResponse
+		case err != nil:
+			return FailResponse
+		}
+		return okOrFail(created)
+	case "NAMESPACES":
+		return listResponse(s.Namespaces.Names())
+	}
+	return ErrorResponse
+}
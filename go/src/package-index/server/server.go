@@ -8,12 +8,22 @@ import (
 	"net"
 	"time"
 
+	"package-index/catalog"
 	"package-index/index"
 )
 
 type Server struct {
+	// Index is the default namespace.
 	Index index.Index
 
+	// Namespaces, if non-nil, holds the other namespaces that clients may
+	// use; see namespace.go.
+	Namespaces *Namespaces
+
+	// Catalog, if non-nil, holds the packages available to be indexed, which
+	// PLAN plans the installation of.
+	Catalog *catalog.Catalog
+
 	// TCP address to listen on.
 	Addr string
 
@@ -43,6 +53,10 @@ type Server struct {
 	// server will close the connection.
 	ConnWriteTimeout time.Duration
 
+	// Maximum number of INDEX and REMOVE messages a client may queue between
+	// BEGIN and COMMIT.
+	MaxBatchSize int
+
 	// Time to wait before retrying Accept after a temporary network error.
 	AcceptDelay time.Duration
 	// Time to wait before retrying Read after a temporary network error.
@@ -91,7 +105,9 @@ func (s *Server) Serve(l *net.TCPListener) error {
 }
 
 func (s *Server) serve(conn *net.TCPConn, outstanding <-chan struct{}, bufPool *bufioReaderPool) {
+	sess := &session{}
 	defer func() {
+		sess.releaseEphemeral(conn.RemoteAddr())
 		err := conn.Close()
 		if err != nil {
 			log.Printf("Conn.Close: %v", err)
@@ -104,7 +120,7 @@ func (s *Server) serve(conn *net.TCPConn, outstanding <-chan struct{}, bufPool *
 			log.Printf("Conn.Read deadline set err, closing: %v", err)
 			return
 		}
-		message, err := readMessage(conn, bufPool)
+		message, err := readMessage(conn, bufPool, sess.deps)
 		if err != nil {
 			if err == io.EOF {
 				// The client closed the connection gracefully.
@@ -126,28 +142,336 @@ func (s *Server) serve(conn *net.TCPConn, outstanding <-chan struct{}, bufPool *
 			respond(ErrorResponse, conn, s.ConnWriteTimeout)
 			continue
 		}
-		var ok bool
-		switch message.Command {
-		case "INDEX":
-			ok = s.Index.Index(message.Package, message.Dependencies)
-		case "REMOVE":
-			ok = s.Index.Remove(message.Package)
-		case "QUERY":
-			ok = s.Index.Query(message.Package)
-		default:
-			// Command not recognized
-			respond(ErrorResponse, conn, s.ConnWriteTimeout)
-			continue
+		if message.Dependencies != nil {
+			// Reuse the map for the next message, unless handle gives it
+			// away.
+			sess.deps = message.Dependencies
+		}
+		respond(s.handle(sess, message), conn, s.ConnWriteTimeout)
+		if sess.watching {
+			s.stream(conn, sess)
+			return
+		}
+	}
+}
+
+// handle executes message against the index of the namespace it is directed
+// at and returns the response.
+func (s *Server) handle(sess *session, message Message) []byte {
+	ns, cmd, prefixed := splitNamespace(message.Command)
+	cmd, expected, conditional, ok := splitExpected(cmd)
+	if !ok {
+		return ErrorResponse
+	}
+	cmd, ttl, leased, ok := splitTTL(cmd)
+	if !ok {
+		return ErrorResponse
+	}
+	message.Command = cmd
+	if !prefixed {
+		ns = sess.namespace
+	}
+	// WATCH takes a pattern rather than a package.
+	if message.Command != "WATCH" {
+		if err := validateVersions(message); err != nil {
+			return ErrorResponse
+		}
+	}
+	conflicts := message.Conflicts
+	if len(conflicts) > 0 && (message.Command != "INDEX" && message.Command != "AUTOINDEX" || conditional || leased) {
+		return ErrorResponse
+	}
+	switch message.Command {
+	case "USE", "CREATE", "NAMESPACES":
+		if prefixed || sess.inBatch {
+			return ErrorResponse
+		}
+		return s.handleNamespaceCommand(sess, message)
+	}
+	idx, err := s.namespace(ns)
+	if err != nil {
+		return ErrorResponse
+	}
+	if conditional {
+		if sess.inBatch || leased {
+			return ErrorResponse
+		}
+		return conditionalMutation(idx, message, expected)
+	}
+	if leased {
+		l, ok := idx.(index.Leaser)
+		if !ok || sess.inBatch || message.Command != "INDEX" {
+			return ErrorResponse
+		}
+		return okOrFail(l.IndexLease(message.Package, message.Dependencies, ttl))
+	}
+	if sess.inBatch {
+		return s.handleBatch(sess, idx, message, conflicts)
+	}
+	switch message.Command {
+	case "INDEX":
+		if len(conflicts) > 0 {
+			c, ok := idx.(index.Conflicter)
+			if !ok {
+				return ErrorResponse
+			}
+			return okOrFail(c.IndexConflicting(message.Package, message.Dependencies, conflicts))
+		}
+		return okOrFail(idx.Index(message.Package, message.Dependencies))
+	case "REMOVE":
+		if h, ok := idx.(index.Holder); ok {
+			ok, held := h.RemoveUnheld(message.Package)
+			if held {
+				return HeldResponse
+			}
+			return okOrFail(ok)
+		}
+		return okOrFail(idx.Remove(message.Package))
+	case "QUERY":
+		rev, asOf, ok := parseOptionalUint(message.Dependencies)
+		if !ok {
+			return ErrorResponse
+		}
+		if !asOf {
+			return okOrFail(idx.Query(message.Package))
 		}
-		if ok {
-			respond(OKResponse, conn, s.ConnWriteTimeout)
+		h, ok := idx.(index.Historian)
+		if !ok {
+			return ErrorResponse
+		}
+		ok, err := h.QueryAt(message.Package, rev)
+		if err != nil {
+			return revisionErrorResponse(err)
+		}
+		return okOrFail(ok)
+	case "UPDATE":
+		u, ok := idx.(index.Updater)
+		if !ok {
+			return ErrorResponse
+		}
+		return okOrFail(u.Update(message.Package, message.Dependencies))
+	case "DEPS":
+		rev, asOf, ok := parseOptionalUint(message.Dependencies)
+		if !ok {
+			return ErrorResponse
+		}
+		var deps []string
+		var found bool
+		if !asOf {
+			g, ok := idx.(index.Grapher)
+			if !ok {
+				return ErrorResponse
+			}
+			deps, found = g.Deps(message.Package)
 		} else {
-			respond(FailResponse, conn, s.ConnWriteTimeout)
+			h, ok := idx.(index.Historian)
+			if !ok {
+				return ErrorResponse
+			}
+			var err error
+			deps, found, err = h.DepsAt(message.Package, rev)
+			if err != nil {
+				return revisionErrorResponse(err)
+			}
+		}
+		if !found {
+			return FailResponse
+		}
+		return listResponse(deps)
+	case "RDEPS":
+		g, ok := idx.(index.Grapher)
+		if !ok {
+			return ErrorResponse
 		}
+		transitive, ok := parseTransitive(message.Dependencies)
+		if !ok {
+			return ErrorResponse
+		}
+		dependents, ok := g.Dependents(message.Package, transitive)
+		if !ok {
+			return FailResponse
+		}
+		return listResponse(dependents)
+	case "PURGE":
+		p, ok := idx.(index.Purger)
+		if !ok {
+			return ErrorResponse
+		}
+		return countResponse(len(p.Purge(message.Package)))
+	case "DEFER":
+		d, ok := idx.(index.Deferrer)
+		if !ok {
+			return ErrorResponse
+		}
+		ok, deferred := d.IndexOrDefer(message.Package, message.Dependencies)
+		if deferred {
+			return PendingResponse
+		}
+		return okOrFail(ok)
+	case "PENDING":
+		d, ok := idx.(index.Deferrer)
+		if !ok {
+			return ErrorResponse
+		}
+		return listResponse(d.Pending())
+	case "CANCEL":
+		d, ok := idx.(index.Deferrer)
+		if !ok {
+			return ErrorResponse
+		}
+		return okOrFail(d.Cancel(message.Package))
+	case "EPHEMERAL":
+		return sess.indexEphemeral(idx, message)
+	case "AUTOINDEX":
+		if len(conflicts) > 0 {
+			// There is no IndexAuto for a conflicting package, but a
+			// batch of one does the same.
+			b, ok := idx.(index.Batcher)
+			if !ok {
+				return ErrorResponse
+			}
+			return okOrFail(b.Batch([]index.Op{{Auto: true, Package: message.Package, Dependencies: message.Dependencies, Conflicts: conflicts}}))
+		}
+		a, ok := idx.(index.AutoRemover)
+		if !ok {
+			return ErrorResponse
+		}
+		return okOrFail(a.IndexAuto(message.Package, message.Dependencies))
+	case "MARK":
+		a, ok := idx.(index.AutoRemover)
+		if !ok {
+			return ErrorResponse
+		}
+		auto, set, ok := parseMark(message.Dependencies)
+		if !ok {
+			return ErrorResponse
+		}
+		if set {
+			return okOrFail(a.MarkAuto(message.Package, auto))
+		}
+		auto, ok = a.Auto(message.Package)
+		if !ok {
+			return FailResponse
+		}
+		return markResponse(auto)
+	case "AUTOREMOVE":
+		a, ok := idx.(index.AutoRemover)
+		if !ok {
+			return ErrorResponse
+		}
+		return listResponse(a.AutoRemove())
+	case "RENEW":
+		l, ok := idx.(index.Leaser)
+		if !ok {
+			return ErrorResponse
+		}
+		ttl, ok := parseRenew(message.Dependencies)
+		if !ok {
+			return ErrorResponse
+		}
+		return okOrFail(l.Renew(message.Package, ttl))
+	case "CONFLICTS":
+		c, ok := idx.(index.Conflicter)
+		if !ok {
+			return ErrorResponse
+		}
+		conflicts, ok := c.Conflicts(message.Package)
+		if !ok {
+			return FailResponse
+		}
+		return listResponse(conflicts)
+	case "HOLD", "UNHOLD":
+		h, ok := idx.(index.Holder)
+		if !ok {
+			return ErrorResponse
+		}
+		return okOrFail(h.Hold(message.Package, message.Command == "HOLD"))
+	case "HOLDS":
+		h, ok := idx.(index.Holder)
+		if !ok {
+			return ErrorResponse
+		}
+		return listResponse(h.Holds())
+	case "REVISION":
+		c, ok := idx.(index.Conditional)
+		if !ok {
+			return ErrorResponse
+		}
+		rev, ok := c.ModRevision(message.Package)
+		if !ok {
+			return FailResponse
+		}
+		return uintResponse(rev)
+	case "SNAPSHOT":
+		h, ok := idx.(index.Historian)
+		if !ok {
+			return ErrorResponse
+		}
+		return uintResponse(h.Revision())
+	case "STATS":
+		st, ok := idx.(index.Statser)
+		if !ok {
+			return ErrorResponse
+		}
+		return statsResponse(st.Stats())
+	case "EXPORT":
+		x, ok := idx.(index.Exporter)
+		if !ok {
+			return ErrorResponse
+		}
+		return exportResponse(x.Export())
+	case "GRAPH", "SUBGRAPH":
+		return graph(idx, message)
+	case "PLAN":
+		if s.Catalog == nil {
+			return ErrorResponse
+		}
+		// Each package is queried separately, so a plan computed while
+		// other clients mutate the index may be out of date as soon as it
+		// is returned.
+		plan, err := s.Catalog.Plan(message.Package, idx.Query)
+		if err != nil {
+			return FailResponse
+		}
+		return listResponse(plan)
+	case "WATCH":
+		return s.watch(sess, idx, message)
+	case "BEGIN":
+		if _, ok := idx.(index.Batcher); !ok {
+			return ErrorResponse
+		}
+		sess.inBatch = true
+		sess.batchIndex = idx
+		return OKResponse
+	}
+	// Command not recognized
+	return ErrorResponse
+}
+
+// validateVersions checks the syntax of any versions and version constraints
+// in message; see index/version.go.
+func validateVersions(message Message) error {
+	if _, _, _, err := index.ParsePackage(message.Package); err != nil {
+		return err
+	}
+	for d := range message.Dependencies {
+		if _, _, err := index.ParseDependency(d); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func okOrFail(ok bool) []byte {
+	if ok {
+		return OKResponse
 	}
+	return FailResponse
 }
 
-func readMessage(conn *net.TCPConn, bufPool *bufioReaderPool) (Message, error) {
+// readMessage reads and parses the next message from conn, reusing deps as
+// parseMessage does.
+func readMessage(conn *net.TCPConn, bufPool *bufioReaderPool, deps map[string]struct{}) (Message, error) {
 	// Maintainability note: do not let messageBytes or buf escape this scope.
 	buf := bufPool.Get(conn)
 	defer bufPool.Put(buf)
@@ -167,15 +491,36 @@ func readMessage(conn *net.TCPConn, bufPool *bufioReaderPool) (Message, error) {
 	if err != nil {
 		return Message{}, err
 	}
-	return parseMessage(messageBytes)
+	return parseMessage(messageBytes, deps)
 }
 
 var (
 	ErrorResponse = []byte("ERROR\n")
 	OKResponse    = []byte("OK\n")
 	FailResponse  = []byte("FAIL\n")
+	// PendingResponse answers a DEFER whose package has been parked until
+	// its dependencies are indexed.
+	PendingResponse = []byte("PENDING\n")
+	// ExpiredResponse answers a read as of a revision that is no longer
+	// retained.
+	ExpiredResponse = []byte("EXPIRED\n")
+	// ConflictResponse answers a conditional mutation of a package whose
+	// revision is not the expected one.
+	ConflictResponse = []byte("CONFLICT\n")
+	// HeldResponse answers a REMOVE that failed because the package is
+	// held, as opposed to depended on.
+	HeldResponse = []byte("FAIL|held\n")
 )
 
+// revisionErrorResponse is the response to a read as of a revision that
+// cannot be read.
+func revisionErrorResponse(err error) []byte {
+	if err == index.ErrRevisionCompacted {
+		return ExpiredResponse
+	}
+	return ErrorResponse
+}
+
 func respond(resp []byte, conn *net.TCPConn, timeout time.Duration) {
 	err := conn.SetWriteDeadline(time.Now().Add(timeout))
 	if err != nil {
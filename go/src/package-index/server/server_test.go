@@ -2,6 +2,7 @@ package server
 
 import (
 	"bufio"
+	"bytes"
 	"fmt"
 	"log"
 	"math/rand"
@@ -10,10 +11,21 @@ import (
 	"testing"
 	"time"
 
+	"package-index/catalog"
 	"package-index/index"
 )
 
 func newTestServer(t *testing.T) (*net.TCPListener, Server) {
+	return newTestServerWithNamespaces(t, nil)
+}
+
+func newTestServerWithNamespaces(t *testing.T, ns *Namespaces) (*net.TCPListener, Server) {
+	return newTestServerWith(t, func(srv *Server) { srv.Namespaces = ns })
+}
+
+// newTestServerWith starts a test server after letting configure change its
+// settings.
+func newTestServerWith(t *testing.T, configure func(*Server)) (*net.TCPListener, Server) {
 	l, err := net.Listen("tcp", ":0")
 	if err != nil {
 		t.Fatal(err)
@@ -23,11 +35,13 @@ func newTestServer(t *testing.T) (*net.TCPListener, Server) {
 		Index:            index.NewIndex(),
 		MaxConns:         4,
 		MaxMessageSize:   16,
+		MaxBatchSize:     3,
 		ConnReadTimeout:  1 * time.Second,
 		ConnWriteTimeout: 1 * time.Second,
 		AcceptDelay:      time.Second,
 		ConnReadDelay:    time.Second,
 	}
+	configure(&srv)
 	go func() {
 		log.Println(srv.Serve(tl))
 	}()
@@ -52,6 +66,562 @@ func TestConnReadTimeout(t *testing.T) {
 	testConnReadTimeout(t, l.Addr().String())
 }
 
+func TestCommands(t *testing.T) {
+	l, _ := newTestServer(t)
+	defer l.Close()
+	testConversation(t, l.Addr().String(), []exchange{
+		{"INDEX|B|\n", "OK\n"},
+		{"INDEX|C|B\n", "OK\n"},
+		{"INDEX|A|B,C\n", "OK\n"},
+		{"DEPS|A|\n", "OK|B,C\n"},
+		{"DEPS|B|\n", "OK|\n"},
+		{"DEPS|Z|\n", "FAIL\n"},
+		{"RDEPS|B|\n", "OK|A,C\n"},
+		{"RDEPS|C|\n", "OK|A\n"},
+		{"RDEPS|A|\n", "OK|\n"},
+		{"RDEPS|Z|\n", "FAIL\n"},
+		{"RDEPS|B|foo\n", "ERROR\n"},
+		{"REMOVE|A|\n", "OK\n"},
+		{"RDEPS|B|\n", "OK|C\n"},
+		{"PURGE|Z|\n", "OK|0\n"},
+		{"PURGE|B|\n", "OK|2\n"},
+		{"QUERY|C|\n", "FAIL\n"},
+		{"INDEX|B|\n", "OK\n"},
+		{"INDEX|C|B\n", "OK\n"},
+		{"INDEX|D|\n", "OK\n"},
+		{"STATS||\n", "OK|packages=3,edges=1,max_fan_in=1,max_fan_out=1,mean_fan_in=0.3333333333333333,mean_fan_out=0.3333333333333333,longest_chain=2,roots=2,leaves=2\n"},
+	})
+}
+
+type exchange struct {
+	request, response string
+}
+
+// testConversation sends each request in turn on a single connection and
+// checks the response.
+func testConversation(t *testing.T, addr string, exchanges []exchange) {
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	for _, e := range exchanges {
+		if _, err := conn.Write([]byte(e.request)); err != nil {
+			t.Fatal(err)
+		}
+		resp, err := r.ReadString('\n')
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp != e.response {
+			t.Fatalf("%q: response %q, expected %q", e.request, resp, e.response)
+		}
+	}
+}
+
+func TestBatch(t *testing.T) {
+	l, _ := newTestServer(t)
+	defer l.Close()
+	testConversation(t, l.Addr().String(), []exchange{
+		{"COMMIT||\n", "ERROR\n"},
+		{"BEGIN||\n", "OK\n"},
+		{"INDEX|B|\n", "OK\n"},
+		{"INDEX|A|B\n", "OK\n"},
+		{"QUERY|B|\n", "ERROR\n"},
+		{"BEGIN||\n", "ERROR\n"},
+		{"COMMIT||\n", "OK\n"},
+		{"QUERY|A|\n", "OK\n"},
+		// A failing batch applies nothing.
+		{"BEGIN||\n", "OK\n"},
+		{"INDEX|C|\n", "OK\n"},
+		{"REMOVE|B|\n", "OK\n"},
+		{"COMMIT||\n", "FAIL\n"},
+		{"QUERY|C|\n", "FAIL\n"},
+		// Neither does an aborted one.
+		{"BEGIN||\n", "OK\n"},
+		{"INDEX|C|\n", "OK\n"},
+		{"ABORT||\n", "OK\n"},
+		{"QUERY|C|\n", "FAIL\n"},
+		// Nor one that grows too large.
+		{"BEGIN||\n", "OK\n"},
+		{"INDEX|C|\n", "OK\n"},
+		{"INDEX|D|\n", "OK\n"},
+		{"INDEX|E|\n", "OK\n"},
+		{"INDEX|F|\n", "ERROR\n"},
+		{"COMMIT||\n", "ERROR\n"},
+		{"QUERY|C|\n", "FAIL\n"},
+		// Each queued message keeps its own dependencies, though a
+		// connection parses the messages it reads into one map.
+		{"BEGIN||\n", "OK\n"},
+		{"INDEX|C|A\n", "OK\n"},
+		{"INDEX|D|B\n", "OK\n"},
+		{"COMMIT||\n", "OK\n"},
+		{"DEPS|C|\n", "OK|A,B\n"},
+	})
+}
+
+func TestVersions(t *testing.T) {
+	l, _ := newTestServer(t)
+	defer l.Close()
+	testConversation(t, l.Addr().String(), []exchange{
+		{"INDEX|ssl@1.1|\n", "OK\n"},
+		{"INDEX|ssl@3.0|\n", "OK\n"},
+		{"INDEX|ssl@>3|\n", "ERROR\n"},
+		{"INDEX|a|ssl@>=3\n", "OK\n"},
+		{"INDEX|b|ssl@~1\n", "OK\n"},
+		{"INDEX|c|ssl@>4\n", "FAIL\n"},
+		{"INDEX|c|ssl@?4\n", "FAIL\n"},
+		{"DEPS|a|\n", "OK|ssl@3.0\n"},
+		{"QUERY|ssl|\n", "OK\n"},
+		{"QUERY|ssl@2|\n", "FAIL\n"},
+		{"REMOVE|ssl|\n", "FAIL\n"},
+		{"REMOVE|a|\n", "OK\n"},
+		{"REMOVE|ssl@3|\n", "OK\n"},
+		{"QUERY|ssl@1.1|\n", "OK\n"},
+		{"DEPS|ssl|\n", "OK|\n"},
+		{"RDEPS|ssl|\n", "OK|b\n"},
+		{"INDEX|ssl@x|\n", "OK\n"},
+		{"QUERY|ssl@x|\n", "OK\n"},
+		{"REMOVE|ssl@x|\n", "OK\n"},
+		{"QUERY|ssl@1.1|\n", "OK\n"},
+		// Like REMOVE, PURGE of a bare name covers every version.
+		{"INDEX|ssl@3.0|\n", "OK\n"},
+		{"PURGE|ssl|\n", "OK|3\n"},
+		{"QUERY|ssl|\n", "FAIL\n"},
+	})
+}
+
+func TestUpdate(t *testing.T) {
+	l, _ := newTestServer(t)
+	defer l.Close()
+	testConversation(t, l.Addr().String(), []exchange{
+		{"INDEX|b|\n", "OK\n"},
+		{"INDEX|c|\n", "OK\n"},
+		{"INDEX|a|b\n", "OK\n"},
+		{"INDEX|x|a\n", "OK\n"},
+		{"UPDATE|a|c,d\n", "FAIL\n"},
+		{"UPDATE|a|x\n", "FAIL\n"},
+		{"UPDATE|a|c\n", "OK\n"},
+		{"DEPS|x|\n", "OK|a,c\n"},
+		{"REMOVE|b|\n", "OK\n"},
+		{"REMOVE|c|\n", "FAIL\n"},
+		{"UPDATE|y|\n", "FAIL\n"},
+	})
+}
+
+func TestWatch(t *testing.T) {
+	l, _ := newTestServer(t)
+	defer l.Close()
+	addr := l.Addr().String()
+	testConversation(t, addr, []exchange{
+		{"INDEX|a|\n", "OK\n"},
+		{"WATCH|[|\n", "ERROR\n"},
+		{"WATCH|*|x\n", "ERROR\n"},
+		{"WATCH|*|9\n", "FAIL\n"},
+	})
+	watcher, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer watcher.Close()
+	r := bufio.NewReader(watcher)
+	expect := func(line string) {
+		resp, err := r.ReadString('\n')
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp != line {
+			t.Fatalf("watcher got %q, expected %q", resp, line)
+		}
+	}
+	if _, err := watcher.Write([]byte("WATCH|b*|0\n")); err != nil {
+		t.Fatal(err)
+	}
+	expect("OK|0\n")
+	testConversation(t, addr, []exchange{
+		{"INDEX|b1|a\n", "OK\n"},
+		{"INDEX|c|\n", "OK\n"},
+		{"UPDATE|b1|c\n", "OK\n"},
+		{"REMOVE|b1|\n", "OK\n"},
+	})
+	expect("INDEXED|b1|2\n")
+	expect("UPDATED|b1|4\n")
+	expect("REMOVED|b1|5\n")
+}
+
+func TestNamespaces(t *testing.T) {
+	newIndex := func(string) (index.Index, error) { return index.NewIndex(), nil }
+	l, _ := newTestServerWithNamespaces(t, &Namespaces{New: newIndex})
+	defer l.Close()
+	testConversation(t, l.Addr().String(), []exchange{
+		{"INDEX|a|\n", "OK\n"},
+		{"USE|dev|\n", "FAIL\n"},
+		{"CREATE|dev|\n", "OK\n"},
+		{"CREATE|dev|\n", "FAIL\n"},
+		{"CREATE|-x|\n", "ERROR\n"},
+		{"CREATE|qa|\n", "OK\n"},
+		{"NAMESPACES||\n", "OK|dev,qa\n"},
+		{"USE|dev|\n", "OK\n"},
+		// Namespaces are isolated.
+		{"QUERY|a|\n", "FAIL\n"},
+		{"INDEX|b|a\n", "FAIL\n"},
+		{"INDEX|a|\n", "OK\n"},
+		{"INDEX|b|a\n", "OK\n"},
+		{"qa:QUERY|b|\n", "FAIL\n"},
+		{"qa:INDEX|c|\n", "OK\n"},
+		{"xx:INDEX|c|\n", "ERROR\n"},
+		{"QUERY|c|\n", "FAIL\n"},
+		// A batch stays in the namespace it began in.
+		{"BEGIN||\n", "OK\n"},
+		{"qa:INDEX|d|\n", "ERROR\n"},
+		{"REMOVE|b|\n", "OK\n"},
+		{"COMMIT||\n", "OK\n"},
+		{"USE|-|\n", "OK\n"},
+		{"QUERY|b|\n", "FAIL\n"},
+		{"dev:QUERY|a|\n", "OK\n"},
+	})
+
+	l, _ = newTestServerWithNamespaces(t, &Namespaces{New: newIndex, AutoCreate: true})
+	defer l.Close()
+	testConversation(t, l.Addr().String(), []exchange{
+		{"USE|dev|\n", "OK\n"},
+		{"qa:INDEX|a|\n", "OK\n"},
+		{"NAMESPACES||\n", "OK|dev,qa\n"},
+	})
+
+	l, _ = newTestServer(t)
+	defer l.Close()
+	testConversation(t, l.Addr().String(), []exchange{
+		{"USE|dev|\n", "ERROR\n"},
+		{"dev:QUERY|a|\n", "ERROR\n"},
+	})
+}
+
+func TestAutoRemove(t *testing.T) {
+	l, _ := newTestServer(t)
+	defer l.Close()
+	testConversation(t, l.Addr().String(), []exchange{
+		{"AUTOINDEX|c|\n", "OK\n"},
+		{"AUTOINDEX|b|c\n", "OK\n"},
+		{"INDEX|a|b\n", "OK\n"},
+		{"MARK|b|\n", "OK|auto\n"},
+		{"MARK|a|\n", "OK|manual\n"},
+		{"MARK|z|\n", "FAIL\n"},
+		{"MARK|a|foo\n", "ERROR\n"},
+		{"AUTOREMOVE||\n", "OK|\n"},
+		{"MARK|a|auto\n", "OK\n"},
+		{"AUTOREMOVE||\n", "OK|a,b,c\n"},
+		{"BEGIN||\n", "OK\n"},
+		{"AUTOINDEX|d|\n", "OK\n"},
+		{"COMMIT||\n", "OK\n"},
+		{"MARK|d|\n", "OK|auto\n"},
+	})
+}
+
+func TestDefer(t *testing.T) {
+	l, _ := newTestServer(t)
+	defer l.Close()
+	testConversation(t, l.Addr().String(), []exchange{
+		{"DEFER|a|b\n", "PENDING\n"},
+		{"DEFER|c|d\n", "PENDING\n"},
+		{"DEFER|e|\n", "OK\n"},
+		{"QUERY|a|\n", "FAIL\n"},
+		{"PENDING||\n", "OK|a,c\n"},
+		{"CANCEL|c|\n", "OK\n"},
+		{"CANCEL|c|\n", "FAIL\n"},
+		{"INDEX|b|\n", "OK\n"},
+		{"QUERY|a|\n", "OK\n"},
+		{"PENDING||\n", "OK|\n"},
+		{"DEFER|f@>1|\n", "ERROR\n"},
+	})
+}
+
+func TestPlan(t *testing.T) {
+	c, err := catalog.Parse(strings.NewReader("a: b  c\nb: c d\ne: f\nf: e\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	l, _ := newTestServerWith(t, func(srv *Server) { srv.Catalog = c })
+	defer l.Close()
+	testConversation(t, l.Addr().String(), []exchange{
+		{"PLAN|a|\n", "OK|c,d,b,a\n"},
+		{"INDEX|c|\n", "OK\n"},
+		{"PLAN|a|\n", "OK|d,b,a\n"},
+		{"PLAN|c|\n", "OK|\n"},
+		{"PLAN|z|\n", "FAIL\n"},
+		{"PLAN|e|\n", "FAIL\n"},
+	})
+	l, _ = newTestServer(t)
+	defer l.Close()
+	testConversation(t, l.Addr().String(), []exchange{
+		{"PLAN|a|\n", "ERROR\n"},
+	})
+}
+
+func TestExport(t *testing.T) {
+	l, srv := newTestServer(t)
+	defer l.Close()
+	addr := l.Addr().String()
+	testConversation(t, addr, []exchange{
+		{"INDEX|b|\n", "OK\n"},
+		{"INDEX|c|b\n", "OK\n"},
+		{"INDEX|a|b,c\n", "OK\n"},
+		{"INDEX|d|b|e\n", "OK\n"},
+		{"AUTOINDEX|f||e\n", "OK\n"},
+	})
+	want := "INDEX|b|\nINDEX|c|b\nINDEX|a|b,c\nINDEX|d|b|e\nAUTOINDEX|f||e\n"
+	var buf bytes.Buffer
+	if err := WriteExport(&buf, srv.Index); err != nil {
+		t.Fatal(err)
+	}
+	if buf.String() != want {
+		t.Fatalf("WriteExport wrote %q, want %q", buf.String(), want)
+	}
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if _, err := conn.Write([]byte("EXPORT||\n")); err != nil {
+		t.Fatal(err)
+	}
+	r := bufio.NewReader(conn)
+	var lines []string
+	for k := 0; k < 6; k++ {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			t.Fatal(err)
+		}
+		lines = append(lines, line)
+	}
+	if got := strings.Join(lines, ""); got != "OK|5\n"+want {
+		t.Fatalf("EXPORT returned %q", got)
+	}
+	// The export replays into an empty server.
+	l2, _ := newTestServer(t)
+	defer l2.Close()
+	var replay []exchange
+	for _, line := range lines[1:] {
+		replay = append(replay, exchange{line, "OK\n"})
+	}
+	replay = append(replay,
+		exchange{"MARK|a|\n", "OK|manual\n"},
+		exchange{"MARK|f|\n", "OK|auto\n"},
+		exchange{"CONFLICTS|f|\n", "OK|e\n"},
+	)
+	testConversation(t, l2.Addr().String(), replay)
+}
+
+func TestGraph(t *testing.T) {
+	l, _ := newTestServerWith(t, func(srv *Server) { srv.MaxMessageSize = 64 })
+	defer l.Close()
+	addr := l.Addr().String()
+	testConversation(t, addr, []exchange{
+		{"INDEX|b|\n", "OK\n"},
+		{"INDEX|a|b\n", "OK\n"},
+		{"GRAPH||svg\n", "ERROR\n"},
+		{"GRAPH||dot,1\n", "ERROR\n"},
+		{"SUBGRAPH|z|dot\n", "FAIL\n"},
+	})
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	for _, tc := range []struct {
+		request string
+		lines   []string
+	}{
+		{"SUBGRAPH|a|dot\n", []string{
+			"OK|5\n",
+			"digraph index {\n",
+			"\t\"a\" [label=\"a\\nrefcount 0\"];\n",
+			"\t\"b\" [label=\"b\\nrefcount 1\"];\n",
+			"\t\"a\" -> \"b\";\n",
+			"}\n",
+		}},
+		{"SUBGRAPH|a|json,0\n", []string{
+			"OK|1\n",
+			`{"nodes":[{"package":"a","refcount":0}],"edges":[]}` + "\n",
+		}},
+		{"GRAPH||json\n", []string{
+			"OK|1\n",
+			`{"nodes":[{"package":"a","refcount":0},{"package":"b","refcount":1}],"edges":[{"from":"a","to":"b"}],"stats":{"packages":2,"edges":1,"max_fan_in":1,"max_fan_out":1,"mean_fan_in":0.5,"mean_fan_out":0.5,"longest_chain":2,"roots":1,"leaves":1}}` + "\n",
+		}},
+	} {
+		if _, err := conn.Write([]byte(tc.request)); err != nil {
+			t.Fatal(err)
+		}
+		for _, want := range tc.lines {
+			line, err := r.ReadString('\n')
+			if err != nil {
+				t.Fatal(err)
+			}
+			if line != want {
+				t.Fatalf("%q: got line %q, expected %q", tc.request, line, want)
+			}
+		}
+	}
+}
+
+func TestSnapshot(t *testing.T) {
+	l, srv := newTestServer(t)
+	defer l.Close()
+	srv.Index.(index.Historian).SetRetention(time.Hour)
+	testConversation(t, l.Addr().String(), []exchange{
+		{"SNAPSHOT||\n", "OK|0\n"},
+		{"INDEX|b|\n", "OK\n"},
+		{"INDEX|a|b\n", "OK\n"},
+		{"SNAPSHOT||\n", "OK|2\n"},
+		{"UPDATE|a|\n", "OK\n"},
+		{"REMOVE|b|\n", "OK\n"},
+		{"QUERY|b|2\n", "OK\n"},
+		{"QUERY|b|4\n", "FAIL\n"},
+		{"QUERY|b|5\n", "ERROR\n"},
+		{"QUERY|b|x\n", "ERROR\n"},
+		{"DEPS|a|2\n", "OK|b\n"},
+		{"DEPS|a|3\n", "OK|\n"},
+		{"DEPS|a|0\n", "FAIL\n"},
+		{"DEPS|a|\n", "OK|\n"},
+	})
+	srv.Index.(index.Historian).SetRetention(0)
+	testConversation(t, l.Addr().String(), []exchange{
+		{"INDEX|c|\n", "OK\n"},
+		{"QUERY|b|2\n", "EXPIRED\n"},
+		{"QUERY|c|5\n", "OK\n"},
+	})
+}
+
+func TestConditional(t *testing.T) {
+	l, _ := newTestServer(t)
+	defer l.Close()
+	testConversation(t, l.Addr().String(), []exchange{
+		{"INDEX@0|b|\n", "OK\n"},
+		{"INDEX@0|b|\n", "CONFLICT\n"},
+		{"REVISION|b|\n", "OK|1\n"},
+		{"REVISION|z|\n", "FAIL\n"},
+		{"INDEX|a|\n", "OK\n"},
+		{"UPDATE@1|a|b\n", "CONFLICT\n"},
+		{"UPDATE@2|a|b\n", "OK\n"},
+		{"REMOVE@1|b|\n", "FAIL\n"},
+		{"REMOVE@2|a|\n", "CONFLICT\n"},
+		{"REMOVE@3|a|\n", "OK\n"},
+		{"QUERY@3|a|\n", "ERROR\n"},
+		{"INDEX@x|a|\n", "ERROR\n"},
+		{"BEGIN||\n", "OK\n"},
+		{"INDEX@0|a|\n", "ERROR\n"},
+		{"ABORT||\n", "OK\n"},
+	})
+}
+
+func TestLeases(t *testing.T) {
+	l, _ := newTestServer(t)
+	defer l.Close()
+	testConversation(t, l.Addr().String(), []exchange{
+		{"INDEX~60|b|\n", "OK\n"},
+		{"INDEX~60|a|b\n", "OK\n"},
+		{"RENEW|a|120\n", "OK\n"},
+		{"INDEX|a|b\n", "OK\n"},
+		{"RENEW|a|120\n", "FAIL\n"},
+		{"RENEW|z|120\n", "FAIL\n"},
+		{"RENEW|b|0\n", "ERROR\n"},
+		{"RENEW|b|\n", "ERROR\n"},
+		{"INDEX~0|c|\n", "ERROR\n"},
+		{"REMOVE~60|a|\n", "ERROR\n"},
+		{"INDEX~60@0|c|\n", "ERROR\n"},
+		{"BEGIN||\n", "OK\n"},
+		{"INDEX~60|c|\n", "ERROR\n"},
+		{"ABORT||\n", "OK\n"},
+	})
+}
+
+func TestEphemeral(t *testing.T) {
+	l, srv := newTestServer(t)
+	defer l.Close()
+	srv.Index.Index("p", nil)
+	testConversation(t, l.Addr().String(), []exchange{
+		{"EPHEMERAL|a|\n", "OK\n"},
+		{"EPHEMERAL|b|a\n", "OK\n"},
+		{"EPHEMERAL|k|\n", "OK\n"},
+		{"EPHEMERAL|p|\n", "OK\n"},
+		{"EPHEMERAL|c|z\n", "FAIL\n"},
+		{"INDEX|q|k\n", "OK\n"},
+		{"EPHEMERAL|h|\n", "OK\n"},
+		{"HOLD|h|\n", "OK\n"},
+		// A hold that has been released does not keep a package.
+		{"EPHEMERAL|g|\n", "OK\n"},
+		{"HOLD|g|\n", "OK\n"},
+		{"UNHOLD|g|\n", "OK\n"},
+		{"BEGIN||\n", "OK\n"},
+		{"EPHEMERAL|c|\n", "ERROR\n"},
+		{"ABORT||\n", "OK\n"},
+	})
+	// The packages are removed once the server notices the close.
+	for deadline := time.Now().Add(5 * time.Second); srv.Index.Query("a"); time.Sleep(time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatal("ephemeral package a outlived its connection")
+		}
+	}
+	for _, pkg := range []string{"b", "g"} {
+		if srv.Index.Query(pkg) {
+			t.Errorf("ephemeral package %s outlived its connection", pkg)
+		}
+	}
+	for _, pkg := range []string{"h", "k", "p", "q"} {
+		if !srv.Index.Query(pkg) {
+			t.Errorf("%s was removed with the connection", pkg)
+		}
+	}
+}
+
+func TestHolds(t *testing.T) {
+	l, _ := newTestServer(t)
+	defer l.Close()
+	testConversation(t, l.Addr().String(), []exchange{
+		{"INDEX|glibc|\n", "OK\n"},
+		{"INDEX|ssl|\n", "OK\n"},
+		{"INDEX|app|ssl\n", "OK\n"},
+		{"HOLD|glibc|\n", "OK\n"},
+		{"HOLD|ssl|\n", "OK\n"},
+		{"HOLD|zlib|\n", "FAIL\n"},
+		{"HOLDS||\n", "OK|glibc,ssl\n"},
+		{"REMOVE|glibc|\n", "FAIL|held\n"},
+		{"REMOVE|ssl|\n", "FAIL|held\n"},
+		{"UNHOLD|ssl|\n", "OK\n"},
+		{"REMOVE|ssl|\n", "FAIL\n"},
+		{"UNHOLD|glibc|\n", "OK\n"},
+		{"REMOVE|glibc|\n", "OK\n"},
+		{"HOLDS||\n", "OK|\n"},
+	})
+}
+
+func TestConflicts(t *testing.T) {
+	l, _ := newTestServer(t)
+	defer l.Close()
+	testConversation(t, l.Addr().String(), []exchange{
+		{"INDEX|my@8|\n", "OK\n"},
+		{"INDEX|db||my\n", "FAIL\n"},
+		{"INDEX|db||my@<8\n", "OK\n"},
+		{"CONFLICTS|db|\n", "OK|my@<8\n"},
+		{"CONFLICTS|my|\n", "OK|\n"},
+		{"CONFLICTS|z|\n", "FAIL\n"},
+		{"INDEX|my@5|\n", "FAIL\n"},
+		{"INDEX|x||\n", "ERROR\n"},
+		{"UPDATE|db||my\n", "ERROR\n"},
+		{"INDEX~9|x||my\n", "ERROR\n"},
+		// A leading '!' is part of a name, not a conflict.
+		{"INDEX|!my|\n", "OK\n"},
+		{"INDEX|x|!my\n", "OK\n"},
+		{"CONFLICTS|x|\n", "OK|\n"},
+		{"BEGIN||\n", "OK\n"},
+		{"INDEX|a||b\n", "OK\n"},
+		{"INDEX|b|\n", "OK\n"},
+		{"COMMIT||\n", "FAIL\n"},
+	})
+}
+
 func testMaxConns(t *testing.T, addr string, maxConns int) {
 	log.Println("testMaxConns")
 	var err error
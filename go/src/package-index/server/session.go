@@ -0,0 +1,78 @@
+package server
+
+import "package-index/index"
+
+// session holds the state of a single client connection.
+type session struct {
+	// namespace is the namespace selected by USE; "" is the default one.
+	namespace string
+	// inBatch is true between BEGIN and COMMIT or ABORT, during which INDEX
+	// and REMOVE messages are queued in batch rather than applied.
+	inBatch bool
+	batch   []index.Op
+	// batchIndex is the index of the namespace the batch was begun in.
+	batchIndex index.Index
+	// watching is set by WATCH, after which the connection streams the
+	// events after since whose packages match pattern.
+	watching bool
+	watched  index.Watcher
+	pattern  string
+	since    uint64
+	// ephemeral holds the packages indexed with EPHEMERAL, oldest first,
+	// which are removed when the connection ends; see ephemeral.go.
+	ephemeral []ephemeralPackage
+	// owner is the token by which the session owns its ephemeral packages,
+	// or 0 until it indexes one.
+	owner uint64
+	// deps is the map that the next message's dependencies are parsed
+	// into. The index does not keep the dependencies it is given, so one
+	// map serves every message, except that a batch keeps those of the
+	// messages it queues.
+	deps map[string]struct{}
+}
+
+// handleBatch handles a message sent between BEGIN and COMMIT or ABORT.
+// Queued messages are acknowledged with OK once they have been parsed; the
+// outcome of the batch as a whole is the response to COMMIT. A connection
+// that closes mid-batch applies nothing. conflicts are the conflicts an INDEX
+// declares.
+func (s *Server) handleBatch(sess *session, idx index.Index, message Message, conflicts map[string]struct{}) []byte {
+	if idx != sess.batchIndex {
+		// A batch is atomic within one namespace only.
+		return ErrorResponse
+	}
+	switch message.Command {
+	case "INDEX", "AUTOINDEX", "REMOVE":
+		if len(sess.batch) >= s.MaxBatchSize {
+			// Bound the memory a client can pin. The client will learn
+			// the batch is gone when its COMMIT gets ERROR.
+			sess.endBatch()
+			return ErrorResponse
+		}
+		sess.batch = append(sess.batch, index.Op{
+			Remove:       message.Command == "REMOVE",
+			Auto:         message.Command == "AUTOINDEX",
+			Package:      message.Package,
+			Dependencies: message.Dependencies,
+			Conflicts:    conflicts,
+		})
+		sess.deps = nil
+		return OKResponse
+	case "COMMIT":
+		ok := sess.batchIndex.(index.Batcher).Batch(sess.batch)
+		sess.endBatch()
+		return okOrFail(ok)
+	case "ABORT":
+		sess.endBatch()
+		return OKResponse
+	}
+	// Nothing else may be interleaved with a batch: reads would not see
+	// its effects, and a nested BEGIN has no meaning.
+	return ErrorResponse
+}
+
+func (sess *session) endBatch() {
+	sess.inBatch = false
+	sess.batch = nil
+	sess.batchIndex = nil
+}
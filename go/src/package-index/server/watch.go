@@ -0,0 +1,95 @@
+package server
+
+import (
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"path"
+	"time"
+
+	"package-index/index"
+)
+
+// watch handles WATCH|<pattern>|[<seq>]. The pattern is matched against
+// package names as by path.Match. Without a sequence number the stream starts
+// with the next event; with one it resumes after that event, or fails if the
+// index no longer retains the events in between. The response carries the
+// sequence number the stream starts after.
+func (s *Server) watch(sess *session, idx index.Index, message Message) []byte {
+	w, ok := idx.(index.Watcher)
+	if !ok {
+		return ErrorResponse
+	}
+	if _, err := path.Match(message.Package, ""); err != nil {
+		return ErrorResponse
+	}
+	since, resume, ok := parseOptionalUint(message.Dependencies)
+	if !ok {
+		return ErrorResponse
+	}
+	if !resume {
+		since = w.LastSeq()
+	} else {
+		// Find out now, while the client can still be told with a plain
+		// response, whether the events are available.
+		poll := make(chan struct{})
+		close(poll)
+		if _, err := w.Events(since, poll); err != nil {
+			return FailResponse
+		}
+	}
+	sess.watching = true
+	sess.watched = w
+	sess.pattern = message.Package
+	sess.since = since
+	return uintResponse(since)
+}
+
+// stream sends matching events to conn until the client closes the
+// connection, a write fails, or the client falls so far behind that events
+// are lost, in which case it sends FAIL first. Events are read from the
+// index's feed at the pace the client accepts them, so a slow watcher delays
+// only itself.
+func (s *Server) stream(conn *net.TCPConn, sess *session) {
+	done := make(chan struct{})
+	go func() {
+		// A watcher has nothing more to say, so anything it sends is
+		// ignored and the read ends only when the connection does.
+		defer close(done)
+		if err := conn.SetReadDeadline(time.Time{}); err != nil {
+			log.Printf("Conn.Read deadline set err: %v", err)
+			return
+		}
+		io.Copy(ioutil.Discard, conn)
+	}()
+	var buf []byte
+	for {
+		evs, err := sess.watched.Events(sess.since, done)
+		if err == index.ErrEventsLost {
+			respond(FailResponse, conn, s.ConnWriteTimeout)
+			return
+		}
+		if evs == nil {
+			return
+		}
+		buf = buf[:0]
+		for _, ev := range evs {
+			if ok, _ := path.Match(sess.pattern, ev.Package); ok {
+				buf = appendEvent(buf, ev)
+			}
+		}
+		sess.since = evs[len(evs)-1].Seq
+		if len(buf) == 0 {
+			continue
+		}
+		if err := conn.SetWriteDeadline(time.Now().Add(s.ConnWriteTimeout)); err != nil {
+			log.Printf("Conn.Write deadline set err: %v", err)
+			return
+		}
+		if _, err := conn.Write(buf); err != nil {
+			log.Printf("Conn.Write: %v", err)
+			return
+		}
+	}
+}
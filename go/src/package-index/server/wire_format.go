@@ -1,28 +1,67 @@
 package server
 
-import "errors"
+import (
+	"bytes"
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+
+	"package-index/index"
+)
 
 type Message struct {
 	Command      string
 	Package      string
 	Dependencies map[string]struct{}
+	// Conflicts are the conflicts an INDEX or AUTOINDEX declares in an
+	// optional fourth field; see index.Conflicter.
+	Conflicts map[string]struct{}
 }
 
 var (
-	errMustEndInNewline = errors.New("must end in newline")
-	errTooFewPipes      = errors.New("too few pipes")
-	errCommaInPackage   = errors.New("package names may not include the reserved character ','")
-	errPipeInPackage    = errors.New("package names may not include the reserved character '|'")
-	errEmptyPackage     = errors.New("package name may not be empty string")
+	errMustEndInNewline  = errors.New("must end in newline")
+	errTooFewPipes       = errors.New("too few pipes")
+	errCommaInPackage    = errors.New("package names may not include the reserved character ','")
+	errPipeInPackage     = errors.New("package names may not include the reserved character '|'")
+	errEmptyPackage      = errors.New("package name may not be empty string")
+	errUnexpectedPackage = errors.New("command does not take a package")
 )
 
-// parseMessage gets the command, package, and dependencies from a message.
+// packagelessCommands are the commands that do not refer to a package. They
+// are sent with an empty package field, e.g. "BEGIN||\n".
+var packagelessCommands = map[string]bool{
+	"BEGIN":      true,
+	"COMMIT":     true,
+	"ABORT":      true,
+	"PENDING":    true,
+	"NAMESPACES": true,
+	"STATS":      true,
+	"AUTOREMOVE": true,
+	"HOLDS":      true,
+	"EXPORT":     true,
+	"GRAPH":      true,
+	"SNAPSHOT":   true,
+}
+
+// parseMessage gets the command, package, dependencies and conflicts from a
+// message:
+//
+//	<command>|<package>|<dependencies>[|<conflicts>]\n
+//
+// The conflicts field is optional but must not be empty when present, so a
+// message that declares conflicts but has no dependencies has an empty
+// dependencies field, e.g. "INDEX|f||e\n". Conflicts get a field of their own
+// rather than a marker on the dependencies, so that every name means what it
+// always has; a server that predates conflicts rejects the fourth field
+// rather than mistaking a conflict for a dependency.
 //
 // The characters '|', ',', and '\n' are reserved by the message format, and
 // the spec does not call out any escaping for them, so package names cannot
 // contain those characters. There is no difference in the encoding of
 // Dependencies = nil and Dependencies = []string{""}, so "" cannot be a valid
-// package name. (Plus, I can't see a reason to name a package "".)
+// package name. (Plus, I can't see a reason to name a package "".) The
+// exception is packagelessCommands, for which the package must be empty.
 //
 // Perf vs readability: we could simplify by using utilities such as
 // bytes.Split, but that approach would require extra allocations and copies.
@@ -30,7 +69,13 @@ var (
 // worthwhile to optimize. If this ended up being _very_ perf-critical we
 // could generate it or write it in assembly, but that's obviously overkill
 // given the index implementation.
-func parseMessage(b []byte) (m Message, err error) {
+//
+// For the same reason the dependencies are sliced from a single string, and
+// if deps is not nil it is cleared and reused for them rather than a new map
+// being made, so that a message costs the same few allocations however many
+// dependencies it lists. The index interns the names it keeps, so it does
+// not pin the string.
+func parseMessage(b []byte, deps map[string]struct{}) (m Message, err error) {
 	if len(b) < 1 {
 		err = errMustEndInNewline
 		return
@@ -71,7 +116,12 @@ func parseMessage(b []byte) (m Message, err error) {
 		i++
 	}
 	secondPipe := i
-	if firstPipe+1 == secondPipe {
+	if _, cmd, _ := splitNamespace(m.Command); packagelessCommands[cmd] {
+		if firstPipe+1 != secondPipe {
+			err = errUnexpectedPackage
+			return
+		}
+	} else if firstPipe+1 == secondPipe {
 		err = errEmptyPackage
 		return
 	}
@@ -82,42 +132,269 @@ func parseMessage(b []byte) (m Message, err error) {
 		return
 	}
 	numCommas := 0
-	for {
-		if b[i] == '|' {
-			err = errPipeInPackage
-			return
+	thirdPipe := -1
+	for ; b[i] != '\n'; i++ {
+		switch b[i] {
+		case ',':
+			numCommas++
+		case '|':
+			if thirdPipe >= 0 {
+				err = errPipeInPackage
+				return
+			}
+			thirdPipe = i
 		}
-		if b[i] == '\n' {
-			break
+	}
+	depsEnd := i
+	if thirdPipe >= 0 {
+		depsEnd = thirdPipe
+	}
+	if secondPipe+1 < depsEnd {
+		if deps == nil {
+			deps = make(map[string]struct{}, numCommas+1)
 		}
-		if b[i] == ',' {
-			numCommas++
+		for d := range deps {
+			delete(deps, d)
 		}
-		i++
+		m.Dependencies = deps
+		if err = parseList(string(b[secondPipe+1:depsEnd]), m.Dependencies); err != nil {
+			return
+		}
+	}
+	if thirdPipe >= 0 {
+		// The index keeps the conflicts it is given, so they always get a
+		// map of their own.
+		m.Conflicts = make(map[string]struct{})
+		err = parseList(string(b[thirdPipe+1:i]), m.Conflicts)
 	}
-	m.Dependencies = make(map[string]struct{}, numCommas+1)
+	return
+}
 
-	i = secondPipe + 1
-	depStart := i
-	d := 0
-	for {
-		if b[i] == '\n' {
-			if depStart == i {
-				err = errEmptyPackage
-				return
+// parseList adds the comma-separated package names in field to set. The
+// names are sliced from field.
+func parseList(field string, set map[string]struct{}) error {
+	start := 0
+	for i := 0; ; i++ {
+		if i == len(field) || field[i] == ',' {
+			if start == i {
+				return errEmptyPackage
 			}
-			m.Dependencies[string(b[depStart:i])] = struct{}{}
-			return
+			set[field[start:i]] = struct{}{}
+			if i == len(field) {
+				return nil
+			}
+			start = i + 1
 		}
-		if b[i] == ',' {
-			if depStart == i {
-				err = errEmptyPackage
-				return
+	}
+}
+
+// splitNamespace splits a command of the form "<namespace>:<command>", which
+// directs a single message at a namespace other than the connection's.
+func splitNamespace(command string) (namespace, cmd string, ok bool) {
+	k := strings.IndexByte(command, ':')
+	if k < 0 {
+		return "", command, false
+	}
+	return command[:k], command[k+1:], true
+}
+
+// splitExpected splits a command of the form "<command>@<revision>", which
+// makes a mutation conditional on the revision of its package; see
+// conditional.go. It returns false for ok if the revision is malformed.
+func splitExpected(command string) (cmd string, expected uint64, conditional, ok bool) {
+	k := strings.IndexByte(command, '@')
+	if k < 0 {
+		return command, 0, false, true
+	}
+	n, err := strconv.ParseUint(command[k+1:], 10, 64)
+	if err != nil {
+		return "", 0, false, false
+	}
+	return command[:k], n, true, true
+}
+
+// splitTTL splits a command of the form "<command>~<seconds>", which gives
+// the package of an INDEX a lease of that many seconds; see index/lease.go.
+// It returns false for ok if the time-to-live is malformed or zero.
+func splitTTL(command string) (cmd string, ttl time.Duration, leased, ok bool) {
+	k := strings.IndexByte(command, '~')
+	if k < 0 {
+		return command, 0, false, true
+	}
+	n, ok := parseSeconds(command[k+1:])
+	if !ok {
+		return "", 0, false, false
+	}
+	return command[:k], n, true, true
+}
+
+// parseSeconds parses a positive number of seconds, as taken by INDEX~ and
+// RENEW.
+func parseSeconds(s string) (time.Duration, bool) {
+	n, err := strconv.ParseUint(s, 10, 32)
+	if err != nil || n == 0 {
+		return 0, false
+	}
+	return time.Duration(n) * time.Second, true
+}
+
+// parseRenew interprets the dependencies field of a RENEW message, which is
+// the new time-to-live in seconds.
+func parseRenew(opts map[string]struct{}) (ttl time.Duration, ok bool) {
+	if len(opts) != 1 {
+		return 0, false
+	}
+	for o := range opts {
+		ttl, ok = parseSeconds(o)
+	}
+	return ttl, ok
+}
+
+// parseTransitive interprets the dependencies field of an RDEPS message,
+// which is either empty (direct dependents) or "transitive".
+func parseTransitive(opts map[string]struct{}) (transitive, ok bool) {
+	switch len(opts) {
+	case 0:
+		return false, true
+	case 1:
+		_, ok = opts["transitive"]
+		return ok, ok
+	}
+	return false, false
+}
+
+// parseGraphOptions interprets the dependencies field of a GRAPH or SUBGRAPH
+// message: a format, dot or json, and optionally a depth limit, in either
+// order. depth is -1 if there is no limit.
+func parseGraphOptions(opts map[string]struct{}) (format string, depth int, ok bool) {
+	depth = -1
+	for o := range opts {
+		switch o {
+		case "dot", "json":
+			if format != "" {
+				return "", 0, false
+			}
+			format = o
+		default:
+			n, err := strconv.Atoi(o)
+			if err != nil || n < 0 || depth >= 0 {
+				return "", 0, false
 			}
-			m.Dependencies[string(b[depStart:i])] = struct{}{}
-			d++
-			depStart = i + 1
+			depth = n
+		}
+	}
+	return format, depth, format != ""
+}
+
+// parseMark interprets the dependencies field of a MARK message, which is
+// "auto" or "manual" to set the install reason, or empty to query it.
+func parseMark(opts map[string]struct{}) (auto, set, ok bool) {
+	switch len(opts) {
+	case 0:
+		return false, false, true
+	case 1:
+		if _, ok := opts["auto"]; ok {
+			return true, true, true
+		}
+		if _, ok := opts["manual"]; ok {
+			return false, true, true
+		}
+	}
+	return false, false, false
+}
+
+// markResponse formats the response to a MARK query: OK|auto\n or
+// OK|manual\n.
+func markResponse(auto bool) []byte {
+	if auto {
+		return []byte("OK|auto\n")
+	}
+	return []byte("OK|manual\n")
+}
+
+// listResponse formats an OK response that carries a list of packages:
+//
+//	OK|<package>,<package>,...\n
+//
+// An empty list is "OK|\n". Package names cannot contain ',' or '\n', so the
+// list is unambiguous.
+func listResponse(pkgs []string) []byte {
+	var b bytes.Buffer
+	b.WriteString("OK|")
+	for i, p := range pkgs {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		b.WriteString(p)
+	}
+	b.WriteByte('\n')
+	return b.Bytes()
+}
+
+// countResponse formats an OK response that carries a count: OK|<n>\n.
+func countResponse(n int) []byte {
+	return []byte("OK|" + strconv.Itoa(n) + "\n")
+}
+
+// parseOptionalUint interprets a dependencies field that is either empty or a
+// number: the sequence number of the last event a watcher saw in WATCH, or the
+// revision to read in QUERY and DEPS.
+func parseOptionalUint(opts map[string]struct{}) (n uint64, given, ok bool) {
+	switch len(opts) {
+	case 0:
+		return 0, false, true
+	case 1:
+		for o := range opts {
+			n, err := strconv.ParseUint(o, 10, 64)
+			return n, true, err == nil
 		}
-		i++
 	}
+	return 0, false, false
+}
+
+// uintResponse formats an OK response that carries a sequence number or a
+// revision: OK|<n>\n.
+func uintResponse(n uint64) []byte {
+	return []byte("OK|" + strconv.FormatUint(n, 10) + "\n")
+}
+
+// appendEvent appends the line that streams ev to a watcher:
+//
+//	<kind>|<package>|<seq>\n
+//
+// where kind is INDEXED, REMOVED or UPDATED.
+func appendEvent(b []byte, ev index.Event) []byte {
+	b = append(b, ev.Kind.String()...)
+	b = append(b, '|')
+	b = append(b, ev.Package...)
+	b = append(b, '|')
+	b = strconv.AppendUint(b, ev.Seq, 10)
+	return append(b, '\n')
+}
+
+// statsResponse formats an OK response that carries index statistics as
+// comma-separated key=value pairs, in a fixed order:
+//
+//	OK|packages=<n>,edges=<n>,max_fan_in=<n>,max_fan_out=<n>,mean_fan_in=<x>,mean_fan_out=<x>,longest_chain=<n>,roots=<n>,leaves=<n>\n
+func statsResponse(s index.Stats) []byte {
+	b := []byte("OK|")
+	b = append(b, "packages="...)
+	b = strconv.AppendInt(b, int64(s.Packages), 10)
+	b = append(b, ",edges="...)
+	b = strconv.AppendInt(b, int64(s.Edges), 10)
+	b = append(b, ",max_fan_in="...)
+	b = strconv.AppendInt(b, int64(s.MaxFanIn), 10)
+	b = append(b, ",max_fan_out="...)
+	b = strconv.AppendInt(b, int64(s.MaxFanOut), 10)
+	b = append(b, ",mean_fan_in="...)
+	b = strconv.AppendFloat(b, s.MeanFanIn, 'f', -1, 64)
+	b = append(b, ",mean_fan_out="...)
+	b = strconv.AppendFloat(b, s.MeanFanOut, 'f', -1, 64)
+	b = append(b, ",longest_chain="...)
+	b = strconv.AppendInt(b, int64(s.LongestChain), 10)
+	b = append(b, ",roots="...)
+	b = strconv.AppendInt(b, int64(s.Roots), 10)
+	b = append(b, ",leaves="...)
+	b = strconv.AppendInt(b, int64(s.Leaves), 10)
+	return append(b, '\n')
 }
@@ -10,13 +10,21 @@ import "testing"
 func BenchmarkParseMessageNoDeps(b *testing.B) {
 	raw := []byte("A|B|\n")
 	for i := 0; i < b.N; i++ {
-		parseMessage(raw)
+		parseMessage(raw, nil)
 	}
 }
 
 func BenchmarkParseMessage10Deps(b *testing.B) {
 	raw := []byte("A|B|C,D,E,F,G,H,I,J,K,L\n")
 	for i := 0; i < b.N; i++ {
-		parseMessage(raw)
+		parseMessage(raw, nil)
+	}
+}
+
+func BenchmarkParseMessage10DepsReused(b *testing.B) {
+	raw := []byte("A|B|C,D,E,F,G,H,I,J,K,L\n")
+	deps := make(map[string]struct{})
+	for i := 0; i < b.N; i++ {
+		parseMessage(raw, deps)
 	}
 }
@@ -3,6 +3,7 @@ package server
 import (
 	"reflect"
 	"testing"
+	"time"
 )
 
 func TestParseMessage(t *testing.T) {
@@ -17,28 +18,35 @@ func TestParseMessage(t *testing.T) {
 		{"|\n", Message{}, errTooFewPipes},
 		{"||\n", Message{}, errEmptyPackage},
 		{"|||\n", Message{}, errEmptyPackage},
-		{"A||\n", Message{"A", "", nil}, errEmptyPackage},
-		{"|A|\n", Message{"", "A", nil}, nil},
+		{"A||\n", Message{"A", "", nil, nil}, errEmptyPackage},
+		{"|A|\n", Message{"", "A", nil, nil}, nil},
 		{"|,|\n", Message{}, errCommaInPackage},
 		{"||,\n", Message{}, errEmptyPackage},
-		{"A|B|\n", Message{"A", "B", nil}, nil},
-		{"A|B|,\n", Message{"A", "B", map[string]struct{}{}}, errEmptyPackage},
-		{"A|B,|\n", Message{"A", "", nil}, errCommaInPackage},
-		{"A|B|C\n", Message{"A", "B", map[string]struct{}{"C": struct{}{}}}, nil},
-		{"A|B|C,\n", Message{"A", "B", map[string]struct{}{"C": struct{}{}}}, errEmptyPackage},
-		{"A|B|C|\n", Message{"A", "B", nil}, errPipeInPackage},
-		{"A|B|C,C\n", Message{"A", "B", map[string]struct{}{"C": struct{}{}}}, nil},
-		{"A|B|C,D\n", Message{"A", "B", map[string]struct{}{"C": struct{}{}, "D": struct{}{}}}, nil},
-		{"A,B|C|D,E\n", Message{"A,B", "C", map[string]struct{}{"D": struct{}{}, "E": struct{}{}}}, nil},
-		{"A|B,C|D,E\n", Message{"A", "", nil}, errCommaInPackage},
-		{"A|B|C,D|E,F\n", Message{"A", "B", nil}, errPipeInPackage},
-		{"A,B|C,D|E,F\n", Message{"A,B", "", nil}, errCommaInPackage},
-		{"A|B|C,D,E,F,G\n", Message{"A", "B", map[string]struct{}{"C": struct{}{}, "D": struct{}{}, "E": struct{}{}, "F": struct{}{}, "G": struct{}{}}}, nil},
-		{"aoeu|snth|aoeu,aoeu,snth,aoeu\n", Message{"aoeu", "snth", map[string]struct{}{"aoeu": struct{}{}, "snth": struct{}{}}}, nil},
-		{"ŪņЇ|ЌœđЗ|☺ unicode, € rocks ™\n", Message{"ŪņЇ", "ЌœđЗ", map[string]struct{}{"☺ unicode": struct{}{}, " € rocks ™": struct{}{}}}, nil},
+		{"A|B|\n", Message{"A", "B", nil, nil}, nil},
+		{"A|B|,\n", Message{"A", "B", map[string]struct{}{}, nil}, errEmptyPackage},
+		{"A|B,|\n", Message{"A", "", nil, nil}, errCommaInPackage},
+		{"A|B|C\n", Message{"A", "B", map[string]struct{}{"C": struct{}{}}, nil}, nil},
+		{"A|B|C,\n", Message{"A", "B", map[string]struct{}{"C": struct{}{}}, nil}, errEmptyPackage},
+		{"A|B|C|\n", Message{"A", "B", map[string]struct{}{"C": struct{}{}}, map[string]struct{}{}}, errEmptyPackage},
+		{"A|B||C\n", Message{"A", "B", nil, map[string]struct{}{"C": struct{}{}}}, nil},
+		{"A|B|C|D|E\n", Message{"A", "B", nil, nil}, errPipeInPackage},
+		{"A|B|!C\n", Message{"A", "B", map[string]struct{}{"!C": struct{}{}}, nil}, nil},
+		{"A|B|C,C\n", Message{"A", "B", map[string]struct{}{"C": struct{}{}}, nil}, nil},
+		{"A|B|C,D\n", Message{"A", "B", map[string]struct{}{"C": struct{}{}, "D": struct{}{}}, nil}, nil},
+		{"A,B|C|D,E\n", Message{"A,B", "C", map[string]struct{}{"D": struct{}{}, "E": struct{}{}}, nil}, nil},
+		{"A|B,C|D,E\n", Message{"A", "", nil, nil}, errCommaInPackage},
+		{"A|B|C,D|E,F\n", Message{"A", "B", map[string]struct{}{"C": struct{}{}, "D": struct{}{}}, map[string]struct{}{"E": struct{}{}, "F": struct{}{}}}, nil},
+		{"A,B|C,D|E,F\n", Message{"A,B", "", nil, nil}, errCommaInPackage},
+		{"A|B|C,D,E,F,G\n", Message{"A", "B", map[string]struct{}{"C": struct{}{}, "D": struct{}{}, "E": struct{}{}, "F": struct{}{}, "G": struct{}{}}, nil}, nil},
+		{"aoeu|snth|aoeu,aoeu,snth,aoeu\n", Message{"aoeu", "snth", map[string]struct{}{"aoeu": struct{}{}, "snth": struct{}{}}, nil}, nil},
+		{"BEGIN||\n", Message{"BEGIN", "", nil, nil}, nil},
+		{"COMMIT|A|\n", Message{"COMMIT", "", nil, nil}, errUnexpectedPackage},
+		{"qa:BEGIN||\n", Message{"qa:BEGIN", "", nil, nil}, nil},
+		{"qa:INDEX||\n", Message{"qa:INDEX", "", nil, nil}, errEmptyPackage},
+		{"ŪņЇ|ЌœđЗ|☺ unicode, € rocks ™\n", Message{"ŪņЇ", "ЌœđЗ", map[string]struct{}{"☺ unicode": struct{}{}, " € rocks ™": struct{}{}}, nil}, nil},
 	}
 	for i, tc := range tcs {
-		out, err := parseMessage([]byte(tc.in))
+		out, err := parseMessage([]byte(tc.in), nil)
 		if !reflect.DeepEqual(err, tc.err) {
 			t.Fatalf("test case %v: err %v, expected %v", i, err, tc.err)
 		}
@@ -48,13 +56,138 @@ func TestParseMessage(t *testing.T) {
 	}
 }
 
+func TestParseMessageReusesDeps(t *testing.T) {
+	deps := make(map[string]struct{})
+	if _, err := parseMessage([]byte("INDEX|A|B,C\n"), deps); err != nil {
+		t.Fatal(err)
+	}
+	m, err := parseMessage([]byte("INDEX|D|E\n"), deps)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]struct{}{"E": struct{}{}}
+	if !reflect.DeepEqual(m.Dependencies, want) || !reflect.DeepEqual(deps, want) {
+		t.Fatalf("Dependencies = %v, deps = %v, want %v in both", m.Dependencies, deps, want)
+	}
+}
+
 func TestAllBytes(t *testing.T) {
 	b := make([]byte, 256)
 	for i := range b {
 		b[i] = byte(i)
 	}
-	m, err := parseMessage(b)
+	m, err := parseMessage(b, nil)
 	if err == nil {
 		t.Fatal(m)
 	}
 }
+
+func TestListResponse(t *testing.T) {
+	tcs := []struct {
+		in  []string
+		out string
+	}{
+		{nil, "OK|\n"},
+		{[]string{"A"}, "OK|A\n"},
+		{[]string{"A", "B", "C"}, "OK|A,B,C\n"},
+	}
+	for i, tc := range tcs {
+		if out := string(listResponse(tc.in)); out != tc.out {
+			t.Fatalf("test case %v: out %q, expected %q", i, out, tc.out)
+		}
+	}
+}
+
+func TestParseOptionalUint(t *testing.T) {
+	tcs := []struct {
+		in             string
+		since          uint64
+		resume, wantOK bool
+	}{
+		{"", 0, false, true},
+		{"42", 42, true, true},
+		{"x", 0, true, false},
+		{"1,2", 0, false, false},
+	}
+	for i, tc := range tcs {
+		m, err := parseMessage([]byte("WATCH|*|"+tc.in+"\n"), nil)
+		if err != nil {
+			t.Fatalf("test case %v: %v", i, err)
+		}
+		since, resume, ok := parseOptionalUint(m.Dependencies)
+		if ok != tc.wantOK || ok && (since != tc.since || resume != tc.resume) {
+			t.Fatalf("test case %v: got %v, %v, %v", i, since, resume, ok)
+		}
+	}
+}
+
+func TestParseGraphOptions(t *testing.T) {
+	tcs := []struct {
+		in     string
+		format string
+		depth  int
+		wantOK bool
+	}{
+		{"dot", "dot", -1, true},
+		{"json,2", "json", 2, true},
+		{"0,dot", "dot", 0, true},
+		{"", "", 0, false},
+		{"2", "", 0, false},
+		{"dot,json", "", 0, false},
+		{"dot,1,2", "", 0, false},
+		{"dot,-1", "", 0, false},
+		{"svg", "", 0, false},
+	}
+	for i, tc := range tcs {
+		m, err := parseMessage([]byte("SUBGRAPH|a|"+tc.in+"\n"), nil)
+		if err != nil {
+			t.Fatalf("test case %v: %v", i, err)
+		}
+		format, depth, ok := parseGraphOptions(m.Dependencies)
+		if ok != tc.wantOK || ok && (format != tc.format || depth != tc.depth) {
+			t.Fatalf("test case %v: got %v, %v, %v", i, format, depth, ok)
+		}
+	}
+}
+
+func TestSplitTTL(t *testing.T) {
+	tcs := []struct {
+		in             string
+		cmd            string
+		ttl            time.Duration
+		leased, wantOK bool
+	}{
+		{"INDEX", "INDEX", 0, false, true},
+		{"INDEX~30", "INDEX", 30 * time.Second, true, true},
+		{"INDEX~0", "", 0, false, false},
+		{"INDEX~", "", 0, false, false},
+		{"INDEX~1m", "", 0, false, false},
+	}
+	for i, tc := range tcs {
+		cmd, ttl, leased, ok := splitTTL(tc.in)
+		if ok != tc.wantOK || ok && (cmd != tc.cmd || ttl != tc.ttl || leased != tc.leased) {
+			t.Fatalf("test case %v: got %v, %v, %v, %v", i, cmd, ttl, leased, ok)
+		}
+	}
+}
+
+func TestSplitExpected(t *testing.T) {
+	tcs := []struct {
+		in                  string
+		cmd                 string
+		expected            uint64
+		conditional, wantOK bool
+	}{
+		{"INDEX", "INDEX", 0, false, true},
+		{"INDEX@0", "INDEX", 0, true, true},
+		{"REMOVE@42", "REMOVE", 42, true, true},
+		{"INDEX@", "", 0, false, false},
+		{"INDEX@-1", "", 0, false, false},
+	}
+	for i, tc := range tcs {
+		cmd, expected, conditional, ok := splitExpected(tc.in)
+		if ok != tc.wantOK || ok && (cmd != tc.cmd || expected != tc.expected || conditional != tc.conditional) {
+			t.Fatalf("test case %v: got %v, %v, %v, %v", i, cmd, expected, conditional, ok)
+		}
+	}
+}